@@ -0,0 +1,579 @@
+// Command promqlsmith generates random PromQL queries from a file of series.
+//
+// Series can be read from a JSON list of label sets (or the response of the
+// Prometheus /api/v1/series endpoint), the Prometheus or OpenMetrics text
+// format, or the load commands of a promql test file.
+//
+//	promqlsmith -series series.json -n 100 -mode range -enable-offset -output json
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/cortexproject/promqlsmith"
+)
+
+var (
+	aggrs = []parser.ItemType{
+		parser.SUM, parser.MIN, parser.MAX, parser.AVG, parser.COUNT, parser.GROUP,
+		parser.STDDEV, parser.STDVAR, parser.TOPK, parser.BOTTOMK, parser.QUANTILE,
+		parser.COUNT_VALUES, parser.LIMITK, parser.LIMIT_RATIO,
+	}
+
+	binops = []parser.ItemType{
+		parser.SUB, parser.ADD, parser.MUL, parser.MOD, parser.DIV, parser.EQLC,
+		parser.NEQ, parser.LTE, parser.GTE, parser.LSS, parser.GTR, parser.POW,
+		parser.ATAN2, parser.LAND, parser.LOR, parser.LUNLESS,
+	}
+
+	exprTypes = []promqlsmith.ExprType{
+		promqlsmith.VectorSelector, promqlsmith.MatrixSelector, promqlsmith.AggregateExpr,
+		promqlsmith.BinaryExpr, promqlsmith.SubQueryExpr, promqlsmith.CallExpr,
+		promqlsmith.NumberLiteral, promqlsmith.UnaryExpr,
+	}
+
+	sampleTypes = map[string]promqlsmith.SampleType{
+		"float":                    promqlsmith.SampleTypeFloat,
+		"classic_histogram_bucket": promqlsmith.SampleTypeClassicHistogramBucket,
+		"native_histogram":         promqlsmith.SampleTypeNativeHistogram,
+	}
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, "promqlsmith:", err)
+		os.Exit(1)
+	}
+}
+
+type config struct {
+	seriesFile string
+	format     string
+	n          int
+	mode       string
+	output     string
+	seed       int64
+	querySeed  int64
+
+	enableOffset          bool
+	enableAtModifier      bool
+	atModifierMaxTs       int64
+	enableVectorMatch     bool
+	enableExperimental    bool
+	enableUTF8Names       bool
+	enableNoStepSubquery  bool
+	enableDurationExprs   bool
+	maxDepth              int
+	enabledExprs          string
+	enabledFuncs          string
+	enabledAggrs          string
+	enabledBinops         string
+	enforceMatchers       string
+	seriesSampleTypes     string
+	exprWeights           string
+	funcWeights           string
+	aggrWeights           string
+	binopWeights          string
+	numberWeights         string
+	rangeDurations        string
+	offsetDurations       string
+	scrapeInterval        string
+	costBudget            string
+	offsetProb            float64
+	atModifierProb        float64
+	vectorMatchingProb    float64
+	emptyLabelValueProb   float64
+	emptyResultRejectProb float64
+}
+
+func run(args []string, stdout io.Writer) error {
+	var cfg config
+	fs := flag.NewFlagSet("promqlsmith", flag.ContinueOnError)
+	fs.StringVar(&cfg.seriesFile, "series", "", "File to read the series from. Required.")
+	fs.StringVar(&cfg.format, "format", formatAuto, "Format of the series file. One of auto, json, openmetrics, prometheus or promqltest.")
+	fs.IntVar(&cfg.n, "n", 10, "Number of queries to generate.")
+	fs.StringVar(&cfg.mode, "mode", "instant", "Generate queries for instant or range queries, or invalid queries failing to parse or execute.")
+	fs.StringVar(&cfg.output, "output", "text", "Output format. One of text or json. The json output prints one object per line with the query and its seed.")
+	fs.Int64Var(&cfg.seed, "seed", 0, "Seed of the random generator. Defaults to the current time.")
+	fs.Int64Var(&cfg.querySeed, "query-seed", 0, "Regenerate the single query with this seed, as printed by the json output. The same flags and series file must be used, and -at-modifier-max-timestamp must be set if @ modifiers are enabled.")
+
+	fs.BoolVar(&cfg.enableOffset, "enable-offset", false, "Generate offset modifiers.")
+	fs.BoolVar(&cfg.enableAtModifier, "enable-at-modifier", false, "Generate @ modifiers.")
+	fs.Int64Var(&cfg.atModifierMaxTs, "at-modifier-max-timestamp", 0, "Max timestamp in milliseconds used in @ modifiers. Defaults to the current time, which is printed by the json output.")
+	fs.BoolVar(&cfg.enableVectorMatch, "enable-vector-matching", false, "Generate vector matching in binary expressions.")
+	fs.BoolVar(&cfg.enableExperimental, "enable-experimental-functions", false, "Generate experimental PromQL functions and aggregations.")
+	fs.BoolVar(&cfg.enableUTF8Names, "enable-utf8-names", false, "Generate quoted UTF-8 label names in selectors and grouping clauses.")
+	fs.BoolVar(&cfg.enableNoStepSubquery, "enable-no-step-subqueries", false, "Generate subqueries without a step, like foo[5m:].")
+	fs.BoolVar(&cfg.enableDurationExprs, "enable-duration-expressions", false, "Print ranges, subquery steps and offsets of instant and range queries as duration expressions, like foo[5m * 2]. They need the promql-duration-expr feature flag of Prometheus.")
+	fs.IntVar(&cfg.maxDepth, "max-depth", 0, "Max depth of the generated expressions. Defaults to 5.")
+	fs.StringVar(&cfg.enabledExprs, "enabled-exprs", "", "Comma separated expression types to generate, like VectorSelector,AggregateExpr. Defaults to all.")
+	fs.StringVar(&cfg.enabledFuncs, "enabled-funcs", "", "Comma separated functions to generate. Defaults to all supported functions.")
+	fs.StringVar(&cfg.enabledAggrs, "enabled-aggrs", "", "Comma separated aggregations to generate, like sum,topk. Defaults to all supported aggregations.")
+	fs.StringVar(&cfg.enabledBinops, "enabled-binops", "", "Comma separated binary operators to generate, like +,and. Defaults to all supported operators.")
+	fs.StringVar(&cfg.enforceMatchers, "enforce-matchers", "", `Label matchers added to every vector selector, like {job="prometheus"}.`)
+	fs.StringVar(&cfg.seriesSampleTypes, "sample-types", "", "Comma separated sample types of metrics, like foo=native_histogram. One of float, classic_histogram_bucket or native_histogram.")
+	fs.StringVar(&cfg.exprWeights, "expr-weights", "", "Comma separated weights of expression types, like AggregateExpr:2,UnaryExpr:0.")
+	fs.StringVar(&cfg.funcWeights, "func-weights", "", "Comma separated weights of functions, like rate:3.")
+	fs.StringVar(&cfg.aggrWeights, "aggr-weights", "", "Comma separated weights of aggregations, like sum:2.")
+	fs.StringVar(&cfg.binopWeights, "binop-weights", "", "Comma separated weights of binary operators, like and:0,==:2.")
+	fs.StringVar(&cfg.numberWeights, "number-literal-weights", "", "Comma separated weights of kinds of number literals, like nan:1,zero:2. One of "+numberLiteralKindList()+". Defaults to fraction only.")
+	fs.StringVar(&cfg.rangeDurations, "range-durations", "", "Distribution of the ranges of matrix selectors, like min=1s,max=1h,units=s|m|h,max-units=2,scrape-interval=15s,step=1m. Defaults to 1m to 5m.")
+	fs.StringVar(&cfg.offsetDurations, "offset-durations", "", "Distribution of offsets, in the same format as -range-durations. Defaults to 0s to 5m.")
+	fs.StringVar(&cfg.scrapeInterval, "scrape-interval", "", "Scrape interval of the series, used to estimate the samples read by queries. Defaults to 1m.")
+	fs.StringVar(&cfg.costBudget, "cost-budget", "", "Max estimated cost of the generated queries, like max-series=100,max-samples=1e6,max-subquery-steps=1000,max-output-series=10. Defaults to unbounded.")
+	fs.Float64Var(&cfg.offsetProb, "offset-probability", 0, "Probability of generating an offset modifier. Defaults to 0.5.")
+	fs.Float64Var(&cfg.atModifierProb, "at-modifier-probability", 0, "Probability of generating an @ modifier. Defaults to 0.3.")
+	fs.Float64Var(&cfg.vectorMatchingProb, "vector-matching-probability", 0, "Probability of generating vector matching. Defaults to 0.2.")
+	fs.Float64Var(&cfg.emptyLabelValueProb, "empty-label-value-probability", 0, "Probability of matching an empty label value. Defaults to 0.1.")
+	fs.Float64Var(&cfg.emptyResultRejectProb, "empty-result-reject-probability", 0, "Probability of regenerating selectors and queries which select no series. Defaults to 0.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if cfg.seriesFile == "" {
+		return errors.New("-series is required")
+	}
+	if cfg.mode != "instant" && cfg.mode != "range" && cfg.mode != "invalid" {
+		return fmt.Errorf("unknown mode %q", cfg.mode)
+	}
+	if cfg.output != "text" && cfg.output != "json" {
+		return fmt.Errorf("unknown output %q", cfg.output)
+	}
+	if cfg.enableAtModifier && !set["at-modifier-max-timestamp"] {
+		// The default changes on every run, so queries couldn't be regenerated.
+		if set["query-seed"] {
+			return errors.New("-at-modifier-max-timestamp is required to regenerate a query with @ modifiers")
+		}
+		cfg.atModifierMaxTs = time.Now().UnixMilli()
+	}
+
+	b, err := os.ReadFile(cfg.seriesFile)
+	if err != nil {
+		return err
+	}
+	format := cfg.format
+	if format == formatAuto {
+		format = detectFormat(cfg.seriesFile, b)
+	}
+	series, fileSampleTypes, err := readSeries(b, format)
+	if err != nil {
+		return err
+	}
+	if len(series) == 0 {
+		return fmt.Errorf("no series found in %s", cfg.seriesFile)
+	}
+
+	opts, err := buildOptions(cfg, set, fileSampleTypes)
+	if err != nil {
+		return err
+	}
+	seed := cfg.seed
+	if !set["seed"] {
+		seed = time.Now().UnixNano()
+	}
+	ps := promqlsmith.New(rand.New(rand.NewSource(seed)), series, opts...)
+
+	walk := exprWalker(ps, ps.WalkInstantQueryWithSeed)
+	if cfg.enableDurationExprs {
+		walk = durationExprWalker(ps, parser.ValueTypeVector, parser.ValueTypeScalar, parser.ValueTypeMatrix)
+	}
+	switch cfg.mode {
+	case "range":
+		walk = exprWalker(ps, ps.WalkRangeQueryWithSeed)
+		if cfg.enableDurationExprs {
+			walk = durationExprWalker(ps, parser.ValueTypeVector, parser.ValueTypeScalar)
+		}
+	case "invalid":
+		walk = func(seed int64) generatedQuery {
+			q := ps.WalkInvalidQueryWithSeed(seed)
+			return generatedQuery{Query: q.Query, Seed: seed, Kind: q.Kind.String(), ErrorClass: q.Kind.ErrorClass().String()}
+		}
+	}
+	emit := func(q generatedQuery) error {
+		if cfg.enableAtModifier {
+			q.AtModifierMaxTimestamp = cfg.atModifierMaxTs
+		}
+		return printQuery(stdout, cfg.output, q)
+	}
+	if set["query-seed"] {
+		return emit(walk(cfg.querySeed))
+	}
+	// Derive query seeds like the Walk methods do from the generator passed to New.
+	rnd := rand.New(rand.NewSource(seed))
+	for i := 0; i < cfg.n; i++ {
+		if err := emit(walk(rnd.Int63())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generatedQuery is a query printed by the json output. Invalid queries also have
+// the kind and class of the expected error. The max timestamp of @ modifiers is
+// printed when they are enabled since it is needed to regenerate the query.
+type generatedQuery struct {
+	Query                  string `json:"query"`
+	Seed                   int64  `json:"seed"`
+	Kind                   string `json:"kind,omitempty"`
+	ErrorClass             string `json:"error_class,omitempty"`
+	AtModifierMaxTimestamp int64  `json:"at_modifier_max_timestamp,omitempty"`
+}
+
+func exprWalker(ps *promqlsmith.PromQLSmith, walk func(int64) parser.Expr) func(int64) generatedQuery {
+	return func(seed int64) generatedQuery {
+		return generatedQuery{Query: walk(seed).String(), Seed: ps.LastSeed()}
+	}
+}
+
+// durationExprWalker is like exprWalker for queries with duration expressions,
+// which are printed by WalkDurationExprQueryWithSeed.
+func durationExprWalker(ps *promqlsmith.PromQLSmith, valueTypes ...parser.ValueType) func(int64) generatedQuery {
+	return func(seed int64) generatedQuery {
+		return generatedQuery{Query: ps.WalkDurationExprQueryWithSeed(seed, valueTypes...), Seed: ps.LastSeed()}
+	}
+}
+
+func printQuery(w io.Writer, output string, q generatedQuery) error {
+	if output == "text" {
+		_, err := fmt.Fprintln(w, q.Query)
+		return err
+	}
+	return json.NewEncoder(w).Encode(q)
+}
+
+// buildOptions converts flags to options. Only flags that were set are converted so
+// that PromQLSmith defaults apply to the others.
+func buildOptions(cfg config, set map[string]bool, fileSampleTypes map[string]promqlsmith.SampleType) ([]promqlsmith.Option, error) {
+	opts := []promqlsmith.Option{
+		promqlsmith.WithEnableOffset(cfg.enableOffset),
+		promqlsmith.WithEnableAtModifier(cfg.enableAtModifier),
+		promqlsmith.WithEnableVectorMatching(cfg.enableVectorMatch),
+		promqlsmith.WithEnableExperimentalPromQLFunctions(cfg.enableExperimental),
+		promqlsmith.WithEnableUTF8Names(cfg.enableUTF8Names),
+		promqlsmith.WithEnableNoStepSubqueries(cfg.enableNoStepSubquery),
+		promqlsmith.WithEnableDurationExpressions(cfg.enableDurationExprs),
+		promqlsmith.WithAtModifierMaxTimestamp(cfg.atModifierMaxTs),
+		promqlsmith.WithMaxDepth(cfg.maxDepth),
+	}
+
+	if cfg.enabledExprs != "" {
+		exprs := make([]promqlsmith.ExprType, 0)
+		for _, name := range splitList(cfg.enabledExprs) {
+			e, err := parseExprType(name)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, e)
+		}
+		opts = append(opts, promqlsmith.WithEnabledExprs(exprs))
+	}
+	if cfg.enabledFuncs != "" {
+		funcs := make([]*parser.Function, 0)
+		for _, name := range splitList(cfg.enabledFuncs) {
+			f, ok := parser.Functions[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown function %q", name)
+			}
+			funcs = append(funcs, f)
+		}
+		opts = append(opts, promqlsmith.WithEnabledFunctions(funcs))
+	}
+	if cfg.enabledAggrs != "" {
+		ops, err := parseItemTypes(cfg.enabledAggrs, aggrs)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, promqlsmith.WithEnabledAggrs(ops))
+	}
+	if cfg.enabledBinops != "" {
+		ops, err := parseItemTypes(cfg.enabledBinops, binops)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, promqlsmith.WithEnabledBinOps(ops))
+	}
+	if cfg.enforceMatchers != "" {
+		matchers, err := parser.ParseMetricSelector(cfg.enforceMatchers)
+		if err != nil {
+			return nil, fmt.Errorf("parse enforced matchers: %w", err)
+		}
+		opts = append(opts, promqlsmith.WithEnforceLabelMatchers(matchers))
+	}
+
+	types := make(map[string]promqlsmith.SampleType)
+	for name, t := range fileSampleTypes {
+		types[name] = t
+	}
+	for _, kv := range splitList(cfg.seriesSampleTypes) {
+		name, value, ok := strings.Cut(kv, "=")
+		t, known := sampleTypes[value]
+		if !ok || !known {
+			return nil, fmt.Errorf("invalid sample type %q", kv)
+		}
+		types[name] = t
+	}
+	if len(types) > 0 {
+		opts = append(opts, promqlsmith.WithSeriesSampleTypes(types))
+	}
+
+	if cfg.exprWeights != "" {
+		weights, err := parseWeights(cfg.exprWeights, parseExprType)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, promqlsmith.WithExprWeights(weights))
+	}
+	if cfg.funcWeights != "" {
+		weights, err := parseWeights(cfg.funcWeights, func(name string) (string, error) {
+			if _, ok := parser.Functions[name]; !ok {
+				return "", fmt.Errorf("unknown function %q", name)
+			}
+			return name, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, promqlsmith.WithFunctionWeights(weights))
+	}
+	if cfg.aggrWeights != "" {
+		weights, err := parseWeights(cfg.aggrWeights, itemTypeParser(aggrs))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, promqlsmith.WithAggrWeights(weights))
+	}
+	if cfg.binopWeights != "" {
+		weights, err := parseWeights(cfg.binopWeights, itemTypeParser(binops))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, promqlsmith.WithBinOpWeights(weights))
+	}
+
+	if cfg.numberWeights != "" {
+		weights, err := parseWeights(cfg.numberWeights, parseNumberLiteralKind)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, promqlsmith.WithNumberLiteralWeights(weights))
+	}
+	if cfg.rangeDurations != "" {
+		d, err := parseDurationDistribution(cfg.rangeDurations)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, promqlsmith.WithRangeDurations(d))
+	}
+	if cfg.offsetDurations != "" {
+		d, err := parseDurationDistribution(cfg.offsetDurations)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, promqlsmith.WithOffsetDurations(d))
+	}
+	if cfg.scrapeInterval != "" {
+		d, err := parseDuration(cfg.scrapeInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scrape interval %q: %w", cfg.scrapeInterval, err)
+		}
+		opts = append(opts, promqlsmith.WithScrapeInterval(d))
+	}
+	if cfg.costBudget != "" {
+		b, err := parseCostBudget(cfg.costBudget)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, promqlsmith.WithCostBudget(b))
+	}
+
+	if set["offset-probability"] {
+		opts = append(opts, promqlsmith.WithOffsetProbability(cfg.offsetProb))
+	}
+	if set["at-modifier-probability"] {
+		opts = append(opts, promqlsmith.WithAtModifierProbability(cfg.atModifierProb))
+	}
+	if set["vector-matching-probability"] {
+		opts = append(opts, promqlsmith.WithVectorMatchingProbability(cfg.vectorMatchingProb))
+	}
+	if set["empty-label-value-probability"] {
+		opts = append(opts, promqlsmith.WithEmptyLabelValueProbability(cfg.emptyLabelValueProb))
+	}
+	if set["empty-result-reject-probability"] {
+		opts = append(opts, promqlsmith.WithEmptyResultRejectProbability(cfg.emptyResultRejectProb))
+	}
+	return opts, nil
+}
+
+func splitList(s string) []string {
+	out := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func parseExprType(name string) (promqlsmith.ExprType, error) {
+	for _, e := range exprTypes {
+		if e.String() == name {
+			return e, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown expression type %q", name)
+}
+
+func parseNumberLiteralKind(name string) (promqlsmith.NumberLiteralKind, error) {
+	for _, k := range promqlsmith.NumberLiteralKinds {
+		if k.String() == name {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown number literal kind %q", name)
+}
+
+func numberLiteralKindList() string {
+	names := make([]string, 0, len(promqlsmith.NumberLiteralKinds))
+	for _, k := range promqlsmith.NumberLiteralKinds {
+		names = append(names, k.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+func itemTypeParser(candidates []parser.ItemType) func(string) (parser.ItemType, error) {
+	return func(name string) (parser.ItemType, error) {
+		for _, op := range candidates {
+			if op.String() == name {
+				return op, nil
+			}
+		}
+		return 0, fmt.Errorf("unknown operator %q", name)
+	}
+}
+
+func parseItemTypes(s string, candidates []parser.ItemType) ([]parser.ItemType, error) {
+	out := make([]parser.ItemType, 0)
+	for _, name := range splitList(s) {
+		op, err := itemTypeParser(candidates)(name)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, op)
+	}
+	return out, nil
+}
+
+// parseWeights parses comma separated key:weight pairs. Colons are used as
+// separator since operators like == contain equal signs.
+func parseWeights[K comparable](s string, parseKey func(string) (K, error)) (map[K]float64, error) {
+	weights := make(map[K]float64)
+	for _, kv := range splitList(s) {
+		name, value, ok := strings.Cut(kv, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid weight %q", kv)
+		}
+		key, err := parseKey(name)
+		if err != nil {
+			return nil, err
+		}
+		w, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight %q: %w", kv, err)
+		}
+		weights[key] = w
+	}
+	return weights, nil
+}
+
+// parseDurationDistribution parses comma separated key=value pairs, like
+// min=1s,max=1h,units=s|m|h,max-units=2,scrape-interval=15s,step=1m.
+func parseDurationDistribution(s string) (promqlsmith.DurationDistribution, error) {
+	var d promqlsmith.DurationDistribution
+	for _, kv := range splitList(s) {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return d, fmt.Errorf("invalid duration distribution %q", kv)
+		}
+		var err error
+		switch key {
+		case "min":
+			d.Min, err = parseDuration(value)
+		case "max":
+			d.Max, err = parseDuration(value)
+		case "scrape-interval":
+			d.ScrapeInterval, err = parseDuration(value)
+		case "step":
+			d.Step, err = parseDuration(value)
+		case "max-units":
+			d.MaxUnits, err = strconv.Atoi(value)
+		case "units":
+			for _, unit := range strings.Split(value, "|") {
+				var u time.Duration
+				if u, err = parseDuration("1" + unit); err != nil {
+					break
+				}
+				d.Units = append(d.Units, u)
+			}
+		default:
+			return d, fmt.Errorf("unknown duration distribution key %q", key)
+		}
+		if err != nil {
+			return d, fmt.Errorf("invalid duration distribution %q: %w", kv, err)
+		}
+	}
+	if d.Max < d.Min {
+		return d, fmt.Errorf("max duration %s is lower than min duration %s", d.Max, d.Min)
+	}
+	return d, nil
+}
+
+// parseCostBudget parses comma separated key=value pairs, like
+// max-series=100,max-samples=1e6,max-subquery-steps=1000,max-output-series=10.
+func parseCostBudget(s string) (promqlsmith.CostBudget, error) {
+	var b promqlsmith.CostBudget
+	for _, kv := range splitList(s) {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return b, fmt.Errorf("invalid cost budget %q", kv)
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || v < 0 {
+			return b, fmt.Errorf("invalid cost budget %q", kv)
+		}
+		switch key {
+		case "max-series":
+			b.MaxSeries = int(v)
+		case "max-samples":
+			b.MaxSamples = int64(v)
+		case "max-subquery-steps":
+			b.MaxSubquerySteps = int64(v)
+		case "max-output-series":
+			b.MaxOutputSeries = int(v)
+		default:
+			return b, fmt.Errorf("unknown cost budget key %q", key)
+		}
+	}
+	return b, nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	d, err := model.ParseDuration(s)
+	return time.Duration(d), err
+}
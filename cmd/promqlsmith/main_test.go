@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/promqlsmith"
+)
+
+const (
+	jsonSeries = `[
+  {"__name__": "http_requests_total", "job": "prometheus", "status_code": "200"},
+  {"__name__": "http_requests_total", "job": "prometheus", "status_code": "500"}
+]`
+
+	apiSeries = `{"status": "success", "data": [
+  {"__name__": "http_requests_total", "job": "prometheus", "status_code": "200"},
+  {"__name__": "http_requests_total", "job": "prometheus", "status_code": "500"}
+]}`
+
+	promTextSeries = `# HELP http_requests_total Total requests.
+# TYPE http_requests_total counter
+http_requests_total{job="prometheus",status_code="200"} 10
+http_requests_total{job="prometheus",status_code="500"} 2
+`
+
+	openMetricsSeries = `# TYPE http_requests counter
+http_requests_total{job="prometheus",status_code="200"} 10
+http_requests_total{job="prometheus",status_code="500"} 2
+# EOF
+`
+
+	promQLTestSeries = `# Comment.
+load 5m
+  http_requests_total{job="prometheus", status_code="200"} 0+10x10
+  http_requests_total{job="prometheus", status_code="500"} 0+2x10
+
+eval instant at 50m sum(http_requests_total)
+  {} 120
+
+load 5m
+  request_duration_seconds{job="prometheus"} {{schema:0 sum:5 count:4 buckets:[1 2 1]}}x10
+`
+)
+
+func TestReadSeries(t *testing.T) {
+	expected := []labels.Labels{
+		labels.FromStrings(labels.MetricName, "http_requests_total", "job", "prometheus", "status_code", "200"),
+		labels.FromStrings(labels.MetricName, "http_requests_total", "job", "prometheus", "status_code", "500"),
+	}
+	for i, tc := range []struct {
+		input               string
+		format              string
+		expected            []labels.Labels
+		expectedSampleTypes map[string]promqlsmith.SampleType
+	}{
+		{input: jsonSeries, format: formatJSON, expected: expected},
+		{input: apiSeries, format: formatJSON, expected: expected},
+		{input: promTextSeries, format: formatPromText, expected: expected},
+		{input: openMetricsSeries, format: formatOpenMetrics, expected: expected},
+		{
+			input:  promQLTestSeries,
+			format: formatPromQLTest,
+			expected: append(expected,
+				labels.FromStrings(labels.MetricName, "request_duration_seconds", "job", "prometheus"),
+			),
+			expectedSampleTypes: map[string]promqlsmith.SampleType{
+				"request_duration_seconds": promqlsmith.SampleTypeNativeHistogram,
+			},
+		},
+	} {
+		t.Run(fmt.Sprintf("test_case_%d", i), func(t *testing.T) {
+			require.Equal(t, tc.format, detectFormat("series", []byte(tc.input)))
+			series, sampleTypes, err := readSeries([]byte(tc.input), tc.format)
+			require.NoError(t, err)
+			require.Equal(t, len(tc.expected), len(series))
+			for j := range series {
+				require.True(t, labels.Equal(tc.expected[j], series[j]), "expected %s, got %s", tc.expected[j], series[j])
+			}
+			if tc.expectedSampleTypes == nil {
+				require.Empty(t, sampleTypes)
+			} else {
+				require.Equal(t, tc.expectedSampleTypes, sampleTypes)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	seriesFile := filepath.Join(dir, "series.json")
+	require.NoError(t, os.WriteFile(seriesFile, []byte(jsonSeries), 0o644))
+
+	for i, tc := range []struct {
+		args []string
+		err  bool
+	}{
+		{args: []string{"-series", seriesFile, "-n", "20"}},
+		{args: []string{"-series", seriesFile, "-n", "20", "-mode", "range", "-output", "json"}},
+		{args: []string{
+			"-series", seriesFile, "-n", "20", "-enable-offset", "-enable-at-modifier", "-enable-vector-matching",
+			"-max-depth", "3", "-enabled-exprs", "AggregateExpr,VectorSelector,BinaryExpr",
+			"-enabled-aggrs", "sum,topk", "-enabled-binops", "+,==,and", "-enforce-matchers", `{job="prometheus"}`,
+			"-expr-weights", "BinaryExpr:0", "-aggr-weights", "topk:2", "-binop-weights", "==:1,and:0",
+			"-offset-probability", "1", "-empty-label-value-probability", "0", "-empty-result-reject-probability", "0.9",
+		}},
+		{args: []string{"-series", seriesFile, "-enabled-funcs", "rate,abs", "-func-weights", "rate:2"}},
+		{args: []string{"-n", "1"}, err: true},
+		{args: []string{"-series", seriesFile, "-mode", "foo"}, err: true},
+		{args: []string{"-series", seriesFile, "-enabled-aggrs", "foo"}, err: true},
+		{args: []string{"-series", seriesFile, "-expr-weights", "BinaryExpr"}, err: true},
+		{args: []string{"-series", seriesFile, "-sample-types", "foo=bar"}, err: true},
+		{args: []string{"-series", seriesFile, "-n", "20", "-enable-offset", "-range-durations", "min=1s,max=1d,units=ms|s|m|h|d,max-units=3,scrape-interval=15s,step=1m", "-offset-durations", "max=1w"}},
+		{args: []string{"-series", seriesFile, "-n", "20", "-number-literal-weights", "nan:1,inf:1,negative_zero:1,fraction:0", "-expr-weights", "NumberLiteral:3"}},
+		{args: []string{"-series", seriesFile, "-number-literal-weights", "hex:1"}, err: true},
+		{args: []string{"-series", seriesFile, "-range-durations", "min=1h,max=1m"}, err: true},
+		{args: []string{"-series", seriesFile, "-range-durations", "units=s|x"}, err: true},
+		{args: []string{"-series", seriesFile, "-offset-durations", "foo=1s"}, err: true},
+		{args: []string{"-series", seriesFile, "-n", "20", "-mode", "range", "-scrape-interval", "15s", "-cost-budget", "max-series=10,max-samples=1e4,max-subquery-steps=100,max-output-series=5"}},
+		{args: []string{"-series", seriesFile, "-scrape-interval", "foo"}, err: true},
+		{args: []string{"-series", seriesFile, "-cost-budget", "max-samples=-1"}, err: true},
+		{args: []string{"-series", seriesFile, "-cost-budget", "max-foo=1"}, err: true},
+	} {
+		t.Run(fmt.Sprintf("test_case_%d", i), func(t *testing.T) {
+			var out bytes.Buffer
+			err := run(tc.args, &out)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				query := line
+				if strings.HasPrefix(line, `{"query"`) {
+					var res struct {
+						Query string `json:"query"`
+					}
+					require.NoError(t, json.Unmarshal([]byte(line), &res))
+					query = res.Query
+				}
+				_, err := parser.ParseExpr(query)
+				require.NoError(t, err, query)
+			}
+		})
+	}
+}
+
+func TestRunQuerySeed(t *testing.T) {
+	dir := t.TempDir()
+	seriesFile := filepath.Join(dir, "series.json")
+	require.NoError(t, os.WriteFile(seriesFile, []byte(jsonSeries), 0o644))
+	args := []string{"-series", seriesFile, "-enable-offset", "-enable-at-modifier", "-at-modifier-max-timestamp", "1000000"}
+
+	var out bytes.Buffer
+	require.NoError(t, run(append(args, "-n", "5", "-output", "json"), &out))
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var res struct {
+			Query string `json:"query"`
+			Seed  int64  `json:"seed"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(line), &res))
+
+		var replay bytes.Buffer
+		require.NoError(t, run(append(args, "-query-seed", fmt.Sprint(res.Seed)), &replay))
+		require.Equal(t, res.Query, strings.TrimSpace(replay.String()))
+	}
+
+	// The default max timestamp of @ modifiers is printed to regenerate queries.
+	args = []string{"-series", seriesFile, "-enable-at-modifier", "-at-modifier-probability", "1", "-output", "json"}
+	out.Reset()
+	require.NoError(t, run(append(args, "-n", "5"), &out))
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var res struct {
+			Seed                   int64 `json:"seed"`
+			AtModifierMaxTimestamp int64 `json:"at_modifier_max_timestamp"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(line), &res))
+		require.NotZero(t, res.AtModifierMaxTimestamp)
+
+		require.Error(t, run(append(args, "-query-seed", fmt.Sprint(res.Seed)), io.Discard))
+		var replay bytes.Buffer
+		require.NoError(t, run(append(args, "-query-seed", fmt.Sprint(res.Seed), "-at-modifier-max-timestamp", fmt.Sprint(res.AtModifierMaxTimestamp)), &replay))
+		require.Equal(t, line, strings.TrimSpace(replay.String()))
+	}
+}
+
+func TestRunInvalid(t *testing.T) {
+	dir := t.TempDir()
+	seriesFile := filepath.Join(dir, "series.json")
+	require.NoError(t, os.WriteFile(seriesFile, []byte(jsonSeries), 0o644))
+	args := []string{"-series", seriesFile, "-mode", "invalid", "-output", "json"}
+
+	var out bytes.Buffer
+	require.NoError(t, run(append(args, "-n", "50"), &out))
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var res struct {
+			Query      string `json:"query"`
+			Seed       int64  `json:"seed"`
+			Kind       string `json:"kind"`
+			ErrorClass string `json:"error_class"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(line), &res))
+		require.NotEmpty(t, res.Kind)
+		_, err := parser.ParseExpr(res.Query)
+		switch res.ErrorClass {
+		case "parse":
+			require.Error(t, err, res.Query)
+		case "execution":
+			require.NoError(t, err, res.Query)
+		default:
+			t.Fatalf("unexpected error class %q", res.ErrorClass)
+		}
+
+		var replay bytes.Buffer
+		require.NoError(t, run(append(args, "-query-seed", fmt.Sprint(res.Seed)), &replay))
+		require.Equal(t, line, strings.TrimSpace(replay.String()))
+	}
+}
+
+func TestRunDurationExpressions(t *testing.T) {
+	dir := t.TempDir()
+	seriesFile := filepath.Join(dir, "series.json")
+	require.NoError(t, os.WriteFile(seriesFile, []byte(jsonSeries), 0o644))
+	args := []string{"-series", seriesFile, "-n", "20", "-seed", "1", "-enable-offset", "-offset-probability", "1"}
+
+	for _, mode := range []string{"instant", "range"} {
+		var plain, out bytes.Buffer
+		require.NoError(t, run(append(args, "-mode", mode), &plain))
+		require.NoError(t, run(append(args, "-mode", mode, "-enable-duration-expressions"), &out))
+		// Queries are generated with the same seeds, so only their durations differ.
+		plainQueries := strings.Split(strings.TrimSpace(plain.String()), "\n")
+		queries := strings.Split(strings.TrimSpace(out.String()), "\n")
+		require.Len(t, queries, len(plainQueries))
+		require.NotEqual(t, plainQueries, queries)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/cortexproject/promqlsmith"
+)
+
+const (
+	formatAuto        = "auto"
+	formatJSON        = "json"
+	formatOpenMetrics = "openmetrics"
+	formatPromText    = "prometheus"
+	formatPromQLTest  = "promqltest"
+)
+
+var loadCommandRegexp = regexp.MustCompile(`(?m)^load\s`)
+
+// readSeries reads the series set from b in the given format. It also returns the
+// sample types of metrics that can't be guessed from their labels, like native
+// histograms loaded by promql test files.
+func readSeries(b []byte, format string) ([]labels.Labels, map[string]promqlsmith.SampleType, error) {
+	switch format {
+	case formatJSON:
+		return readJSONSeries(b)
+	case formatOpenMetrics:
+		return readTextSeries(b, "application/openmetrics-text")
+	case formatPromText:
+		return readTextSeries(b, "text/plain")
+	case formatPromQLTest:
+		return readPromQLTestSeries(b)
+	default:
+		return nil, nil, fmt.Errorf("unknown series format %q", format)
+	}
+}
+
+// detectFormat guesses the format of the series file using its extension and
+// falls back to looking at its content.
+func detectFormat(path string, b []byte) string {
+	switch filepath.Ext(path) {
+	case ".json":
+		return formatJSON
+	case ".test":
+		return formatPromQLTest
+	case ".om":
+		return formatOpenMetrics
+	case ".prom":
+		return formatPromText
+	}
+
+	trimmed := bytes.TrimSpace(b)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("[")), bytes.HasPrefix(trimmed, []byte(`{"`)):
+		return formatJSON
+	case loadCommandRegexp.Match(b):
+		return formatPromQLTest
+	case bytes.HasSuffix(trimmed, []byte("# EOF")):
+		return formatOpenMetrics
+	}
+	return formatPromText
+}
+
+// readJSONSeries reads either a list of label sets or the response of the
+// Prometheus /api/v1/series endpoint.
+func readJSONSeries(b []byte) ([]labels.Labels, map[string]promqlsmith.SampleType, error) {
+	var labelSets []map[string]string
+	if err := json.Unmarshal(b, &labelSets); err != nil {
+		var resp struct {
+			Status string              `json:"status"`
+			Data   []map[string]string `json:"data"`
+		}
+		if err := json.Unmarshal(b, &resp); err != nil {
+			return nil, nil, fmt.Errorf("parse JSON series: %w", err)
+		}
+		if resp.Status != "success" {
+			return nil, nil, fmt.Errorf("series response has status %q", resp.Status)
+		}
+		labelSets = resp.Data
+	}
+
+	series := make([]labels.Labels, 0, len(labelSets))
+	for _, ls := range labelSets {
+		series = append(series, labels.FromMap(ls))
+	}
+	return series, nil, nil
+}
+
+// readTextSeries reads the series exposed in the Prometheus or OpenMetrics text format.
+func readTextSeries(b []byte, contentType string) ([]labels.Labels, map[string]promqlsmith.SampleType, error) {
+	p, err := textparse.New(b, contentType, false, labels.NewSymbolTable())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seen := make(map[uint64]struct{})
+	series := make([]labels.Labels, 0)
+	for {
+		entry, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse series: %w", err)
+		}
+		if entry != textparse.EntrySeries && entry != textparse.EntryHistogram {
+			continue
+		}
+		var lbls labels.Labels
+		p.Metric(&lbls)
+		if _, ok := seen[lbls.Hash()]; ok {
+			continue
+		}
+		seen[lbls.Hash()] = struct{}{}
+		series = append(series, lbls)
+	}
+	return series, nil, nil
+}
+
+// readPromQLTestSeries reads the series from the load commands of a promql test file.
+// Other commands are ignored.
+func readPromQLTestSeries(b []byte) ([]labels.Labels, map[string]promqlsmith.SampleType, error) {
+	series := make([]labels.Labels, 0)
+	sampleTypes := make(map[string]promqlsmith.SampleType)
+	inLoad := false
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			inLoad = false
+			continue
+		case strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "load "):
+			inLoad = true
+			continue
+		case !inLoad:
+			continue
+		}
+
+		lbls, values, err := parser.ParseSeriesDesc(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		for _, v := range values {
+			if v.Histogram != nil {
+				sampleTypes[lbls.Get(labels.MetricName)] = promqlsmith.SampleTypeNativeHistogram
+				break
+			}
+		}
+		series = append(series, lbls)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return series, sampleTypes, nil
+}
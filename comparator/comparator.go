@@ -0,0 +1,458 @@
+// Package comparator compares the results of PromQL queries evaluated by two
+// engines. Float values are compared with a configurable tolerance, and the order
+// of series is only compared for queries whose output order is significant.
+package comparator
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/facette/natsort"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+)
+
+// Comparator compares query results. The zero value compares values exactly.
+type Comparator struct {
+	// Epsilon is the relative tolerance of float values, and of the counts and sums
+	// of histograms. Two values are equal if they differ by at most Epsilon times
+	// the smallest of their absolute values. Aggregations add up floats in no
+	// particular order, so even the same engine can return slightly different values.
+	Epsilon float64
+	// Margin is the absolute tolerance of the same values, for values close to 0.
+	Margin float64
+}
+
+// Diff is the difference between two query results.
+type Diff struct {
+	// Reasons describe differences which aren't specific to a series, such as
+	// errors, value types or series returned out of order.
+	Reasons []string
+	// Series are the series with differing samples, sorted by labels.
+	Series []SeriesDiff
+}
+
+// SeriesDiff is the difference between the samples of a series.
+type SeriesDiff struct {
+	Labels labels.Labels
+	// Left and Right are the differing samples, formatted as value @ timestamp.
+	// They are empty if the series is missing from a result.
+	Left  []string
+	Right []string
+}
+
+// Equal reports whether the results are equal.
+func (d Diff) Equal() bool {
+	return len(d.Reasons) == 0 && len(d.Series) == 0
+}
+
+// String returns the differences with one line per reason and one line per
+// differing sample, prefixed by - for the left result and + for the right one.
+// It returns an empty string if the results are equal.
+func (d Diff) String() string {
+	var sb strings.Builder
+	for _, r := range d.Reasons {
+		sb.WriteString(r)
+		sb.WriteByte('\n')
+	}
+	for _, s := range d.Series {
+		sb.WriteString(s.Labels.String())
+		sb.WriteByte('\n')
+		writeSamples(&sb, "-", s.Left)
+		writeSamples(&sb, "+", s.Right)
+	}
+	return sb.String()
+}
+
+func writeSamples(sb *strings.Builder, prefix string, samples []string) {
+	if len(samples) == 0 {
+		fmt.Fprintf(sb, "  %s <missing>\n", prefix)
+		return
+	}
+	for _, s := range samples {
+		fmt.Fprintf(sb, "  %s %s\n", prefix, s)
+	}
+}
+
+// Compare compares the results of expr. Results that both failed are equal, since
+// error messages differ between implementations. The series of vectors are
+// compared regardless of their order, which is checked separately for expressions
+// whose order is significant, see OrderSignificant. expr can be nil, in which case
+// the order of series is ignored.
+func (c Comparator) Compare(expr parser.Expr, left, right *promql.Result) Diff {
+	var d Diff
+	switch {
+	case left.Err != nil && right.Err != nil:
+		return d
+	case left.Err != nil || right.Err != nil:
+		d.Reasons = append(d.Reasons, fmt.Sprintf("- error: %s", errString(left.Err)), fmt.Sprintf("+ error: %s", errString(right.Err)))
+		return d
+	}
+
+	if left.Value.Type() != right.Value.Type() {
+		d.Reasons = append(d.Reasons, fmt.Sprintf("- %s", left.Value.Type()), fmt.Sprintf("+ %s", right.Value.Type()))
+		return d
+	}
+	if l, ok := left.Value.(promql.String); ok {
+		if r := right.Value.(promql.String); l != r {
+			d.Reasons = append(d.Reasons, fmt.Sprintf("- %s", l), fmt.Sprintf("+ %s", r))
+		}
+		return d
+	}
+
+	if o := orderOf(expr); o != nil {
+		if l, ok := left.Value.(promql.Vector); ok {
+			d.Reasons = append(d.Reasons, o.check("-", l)...)
+			d.Reasons = append(d.Reasons, o.check("+", right.Value.(promql.Vector))...)
+		}
+	}
+
+	l, lreasons := seriesOf("-", left.Value)
+	r, rreasons := seriesOf("+", right.Value)
+	d.Reasons = append(d.Reasons, lreasons...)
+	d.Reasons = append(d.Reasons, rreasons...)
+	for key, ls := range l {
+		if s, ok := c.diffSeries(ls, r[key]); !ok {
+			d.Series = append(d.Series, s)
+		}
+	}
+	for key, rs := range r {
+		if _, ok := l[key]; !ok {
+			s, _ := c.diffSeries(series{}, rs)
+			d.Series = append(d.Series, s)
+		}
+	}
+	slices.SortFunc(d.Series, func(a, b SeriesDiff) int {
+		return labels.Compare(a.Labels, b.Labels)
+	})
+	return d
+}
+
+// point is a float or histogram sample.
+type point struct {
+	T int64
+	F float64
+	H *histogram.FloatHistogram
+}
+
+func (p point) String() string {
+	if p.H != nil {
+		return fmt.Sprintf("%s @ %d", p.H, p.T)
+	}
+	return fmt.Sprintf("%s @ %d", formatFloat(p.F), p.T)
+}
+
+// series is a series of a result, with its samples by timestamp.
+type series struct {
+	labels labels.Labels
+	points map[int64]point
+}
+
+// seriesOf returns the series of v by labels. Scalars are returned as a series
+// without labels. It also returns a reason for every duplicate series of v.
+func seriesOf(prefix string, v parser.Value) (map[string]series, []string) {
+	out := make(map[string]series)
+	var reasons []string
+	add := func(lbls labels.Labels, points ...point) {
+		key := lbls.String()
+		if _, ok := out[key]; ok {
+			reasons = append(reasons, fmt.Sprintf("%s duplicate series %s", prefix, key))
+			return
+		}
+		s := series{labels: lbls, points: make(map[int64]point, len(points))}
+		for _, p := range points {
+			s.points[p.T] = p
+		}
+		out[key] = s
+	}
+	switch v := v.(type) {
+	case promql.Scalar:
+		add(labels.EmptyLabels(), point{T: v.T, F: v.V})
+	case promql.Vector:
+		for _, s := range v {
+			add(s.Metric, point{T: s.T, F: s.F, H: s.H})
+		}
+	case promql.Matrix:
+		for _, s := range v {
+			points := make([]point, 0, len(s.Floats)+len(s.Histograms))
+			for _, p := range s.Floats {
+				points = append(points, point{T: p.T, F: p.F})
+			}
+			for _, p := range s.Histograms {
+				points = append(points, point{T: p.T, H: p.H})
+			}
+			add(s.Metric, points...)
+		}
+	}
+	return out, reasons
+}
+
+// diffSeries returns the samples which differ between two series with the same
+// labels, and whether all their samples are equal. The zero series stands for a
+// series missing from the left result.
+func (c Comparator) diffSeries(l, r series) (SeriesDiff, bool) {
+	d := SeriesDiff{Labels: l.labels}
+	if l.points == nil {
+		d.Labels = r.labels
+	}
+	ts := make([]int64, 0, len(l.points)+len(r.points))
+	for t := range l.points {
+		ts = append(ts, t)
+	}
+	for t := range r.points {
+		if _, ok := l.points[t]; !ok {
+			ts = append(ts, t)
+		}
+	}
+	slices.Sort(ts)
+
+	equal := l.points != nil && r.points != nil
+	for _, t := range ts {
+		lp, lok := l.points[t]
+		rp, rok := r.points[t]
+		if lok && rok && c.pointsEqual(lp, rp) {
+			continue
+		}
+		equal = false
+		if lok {
+			d.Left = append(d.Left, lp.String())
+		}
+		if rok {
+			d.Right = append(d.Right, rp.String())
+		}
+	}
+	return d, equal
+}
+
+func (c Comparator) pointsEqual(a, b point) bool {
+	if a.H == nil || b.H == nil {
+		return a.H == nil && b.H == nil && c.floatsEqual(a.F, b.F)
+	}
+	return c.histogramsEqual(a.H, b.H)
+}
+
+// floatsEqual compares floats with the tolerance of the comparator. NaNs are
+// equal to each other, but stale markers are only equal to stale markers since
+// they are not supposed to be returned by queries.
+func (c Comparator) floatsEqual(a, b float64) bool {
+	switch {
+	case value.IsStaleNaN(a) || value.IsStaleNaN(b):
+		return value.IsStaleNaN(a) && value.IsStaleNaN(b)
+	case math.IsNaN(a) || math.IsNaN(b):
+		return math.IsNaN(a) && math.IsNaN(b)
+	case a == b:
+		return true
+	case math.IsInf(a, 0) || math.IsInf(b, 0):
+		return false
+	}
+	d := math.Abs(a - b)
+	return d <= c.Margin || d <= c.Epsilon*math.Min(math.Abs(a), math.Abs(b))
+}
+
+// histogramsEqual compares the counts and sums of histograms with the tolerance
+// of the comparator. Buckets are compared by index so that histograms with
+// different spans or empty buckets can be equal.
+func (c Comparator) histogramsEqual(a, b *histogram.FloatHistogram) bool {
+	if a.Schema != b.Schema || a.ZeroThreshold != b.ZeroThreshold || !slices.Equal(a.CustomValues, b.CustomValues) {
+		return false
+	}
+	if !c.floatsEqual(a.Count, b.Count) || !c.floatsEqual(a.Sum, b.Sum) || !c.floatsEqual(a.ZeroCount, b.ZeroCount) {
+		return false
+	}
+	return c.bucketsEqual(a.PositiveBucketIterator(), b.PositiveBucketIterator()) &&
+		c.bucketsEqual(a.NegativeBucketIterator(), b.NegativeBucketIterator())
+}
+
+func (c Comparator) bucketsEqual(a, b histogram.BucketIterator[float64]) bool {
+	la, lb := bucketCounts(a), bucketCounts(b)
+	for idx, count := range la {
+		if !c.floatsEqual(count, lb[idx]) {
+			return false
+		}
+	}
+	for idx, count := range lb {
+		if _, ok := la[idx]; !ok && !c.floatsEqual(count, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// bucketCounts returns the non empty buckets by index.
+func bucketCounts(it histogram.BucketIterator[float64]) map[int32]float64 {
+	counts := make(map[int32]float64)
+	for it.Next() {
+		if b := it.At(); b.Count != 0 {
+			counts[b.Index] = b.Count
+		}
+	}
+	return counts
+}
+
+// OrderSignificant reports whether the order of the series returned by instant
+// queries of expr is significant. This is the case for the sort functions, and for
+// topk and bottomk which sort series within each group, at the root of expr.
+// The order of range query results is never significant since series are sorted
+// by labels.
+func OrderSignificant(expr parser.Expr) bool {
+	return orderOf(expr) != nil
+}
+
+// order is the order of the series of instant query results.
+type order struct {
+	// compare compares two series of the same group. Series that compare equal
+	// can be returned in any order.
+	compare func(a, b promql.Sample) int
+	// group returns the group of a series. Series of different groups can be
+	// returned in any order.
+	group func(labels.Labels) string
+}
+
+func orderOf(expr parser.Expr) *order {
+	switch e := expr.(type) {
+	case *parser.ParenExpr:
+		return orderOf(e.Expr)
+	case *parser.StepInvariantExpr:
+		return orderOf(e.Expr)
+	case *parser.Call:
+		switch e.Func.Name {
+		case "sort":
+			return &order{compare: byValue(false)}
+		case "sort_desc":
+			return &order{compare: byValue(true)}
+		case "sort_by_label":
+			return &order{compare: byLabels(labelArgs(e.Args[1:]), false)}
+		case "sort_by_label_desc":
+			return &order{compare: byLabels(labelArgs(e.Args[1:]), true)}
+		}
+	case *parser.AggregateExpr:
+		switch e.Op {
+		case parser.TOPK:
+			return &order{compare: byValue(true), group: groupOf(e)}
+		case parser.BOTTOMK:
+			return &order{compare: byValue(false), group: groupOf(e)}
+		}
+	}
+	return nil
+}
+
+// check returns a reason for every series of v returned after a series of the
+// same group it should precede.
+func (o *order) check(prefix string, v promql.Vector) []string {
+	var reasons []string
+	last := make(map[string]promql.Sample)
+	for _, s := range v {
+		group := ""
+		if o.group != nil {
+			group = o.group(s.Metric)
+		}
+		if prev, ok := last[group]; ok && o.compare(prev, s) > 0 {
+			reasons = append(reasons, fmt.Sprintf("%s series %s %s returned after %s %s",
+				prefix, s.Metric, formatFloat(s.F), prev.Metric, formatFloat(prev.F)))
+		}
+		last[group] = s
+	}
+	return reasons
+}
+
+// byValue orders series by value, with NaN last in both directions like the
+// PromQL engine does.
+func byValue(desc bool) func(a, b promql.Sample) int {
+	return func(a, b promql.Sample) int {
+		switch an, bn := math.IsNaN(a.F), math.IsNaN(b.F); {
+		case an && bn:
+			return 0
+		case an:
+			return 1
+		case bn:
+			return -1
+		}
+		c := 0
+		switch {
+		case a.F < b.F:
+			c = -1
+		case a.F > b.F:
+			c = 1
+		}
+		if desc {
+			return -c
+		}
+		return c
+	}
+}
+
+// byLabels orders series by the natural order of the values of names, then by
+// labels, like sort_by_label.
+func byLabels(names []string, desc bool) func(a, b promql.Sample) int {
+	return func(a, b promql.Sample) int {
+		c := labels.Compare(a.Metric, b.Metric)
+		for _, name := range names {
+			va, vb := a.Metric.Get(name), b.Metric.Get(name)
+			if va == vb {
+				continue
+			}
+			c = 1
+			if natsort.Compare(va, vb) {
+				c = -1
+			}
+			break
+		}
+		if desc {
+			return -c
+		}
+		return c
+	}
+}
+
+func labelArgs(args parser.Expressions) []string {
+	names := make([]string, 0, len(args))
+	for _, arg := range args {
+		if s, ok := unwrap(arg).(*parser.StringLiteral); ok {
+			names = append(names, s.Val)
+		}
+	}
+	return names
+}
+
+// groupOf returns the group of a series in the result of an aggregation.
+func groupOf(e *parser.AggregateExpr) func(labels.Labels) string {
+	return func(lbls labels.Labels) string {
+		lb := labels.NewBuilder(lbls)
+		if e.Without {
+			lb.Del(e.Grouping...)
+			lb.Del(labels.MetricName)
+		} else {
+			lb.Keep(e.Grouping...)
+		}
+		return lb.Labels().String()
+	}
+}
+
+func unwrap(expr parser.Expr) parser.Expr {
+	switch e := expr.(type) {
+	case *parser.ParenExpr:
+		return unwrap(e.Expr)
+	case *parser.StepInvariantExpr:
+		return unwrap(e.Expr)
+	}
+	return expr
+}
+
+func formatFloat(f float64) string {
+	if value.IsStaleNaN(f) {
+		return "stale"
+	}
+	return fmt.Sprint(f)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return "<nil>"
+	}
+	return err.Error()
+}
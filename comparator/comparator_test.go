@@ -0,0 +1,327 @@
+package comparator
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/require"
+)
+
+// enableExperimentalFunctions enables the parsing of sort_by_label and limitk.
+func enableExperimentalFunctions(t *testing.T) {
+	enabled := parser.EnableExperimentalFunctions
+	parser.EnableExperimentalFunctions = true
+	t.Cleanup(func() { parser.EnableExperimentalFunctions = enabled })
+}
+
+func TestCompare(t *testing.T) {
+	enableExperimentalFunctions(t)
+	h := &histogram.FloatHistogram{
+		Count: 10, Sum: 20, Schema: 0,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+		PositiveBuckets: []float64{4, 6},
+	}
+	// The same histogram with an empty bucket in its spans.
+	hEmptyBucket := &histogram.FloatHistogram{
+		Count: 10, Sum: 20, Schema: 0,
+		PositiveSpans:   []histogram.Span{{Offset: 0, Length: 3}},
+		PositiveBuckets: []float64{4, 6, 0},
+	}
+	hOtherBucket := &histogram.FloatHistogram{
+		Count: 10, Sum: 20, Schema: 0,
+		PositiveSpans:   []histogram.Span{{Offset: 1, Length: 2}},
+		PositiveBuckets: []float64{4, 6},
+	}
+
+	for i, tc := range []struct {
+		comparator  Comparator
+		query       string
+		left, right *promql.Result
+		equal       bool
+	}{
+		{
+			left:  &promql.Result{Err: errors.New("foo")},
+			right: &promql.Result{Err: errors.New("bar")},
+			equal: true,
+		},
+		{
+			left:  &promql.Result{Err: errors.New("foo")},
+			right: &promql.Result{Value: promql.Vector{}},
+		},
+		{
+			left:  &promql.Result{Value: promql.Scalar{T: 1, V: 1}},
+			right: &promql.Result{Value: promql.Vector{}},
+		},
+		{
+			left:  &promql.Result{Value: promql.String{T: 1, V: "a"}},
+			right: &promql.Result{Value: promql.String{T: 1, V: "b"}},
+		},
+		{
+			left:  &promql.Result{Value: promql.Scalar{T: 1, V: math.NaN()}},
+			right: &promql.Result{Value: promql.Scalar{T: 1, V: math.NaN()}},
+			equal: true,
+		},
+		{
+			left:  &promql.Result{Value: promql.Scalar{T: 1, V: math.NaN()}},
+			right: &promql.Result{Value: promql.Scalar{T: 1, V: math.Float64frombits(value.StaleNaN)}},
+		},
+		{
+			left:  &promql.Result{Value: promql.Scalar{T: 1, V: math.Inf(1)}},
+			right: &promql.Result{Value: promql.Scalar{T: 1, V: math.Inf(1)}},
+			equal: true,
+		},
+		{
+			left:  &promql.Result{Value: promql.Scalar{T: 1, V: 1}},
+			right: &promql.Result{Value: promql.Scalar{T: 2, V: 1}},
+		},
+		{
+			left:  &promql.Result{Value: promql.Scalar{T: 1, V: 1}},
+			right: &promql.Result{Value: promql.Scalar{T: 1, V: 1 + 1e-12}},
+		},
+		{
+			comparator: Comparator{Epsilon: 1e-9},
+			left:       &promql.Result{Value: promql.Scalar{T: 1, V: 1}},
+			right:      &promql.Result{Value: promql.Scalar{T: 1, V: 1 + 1e-12}},
+			equal:      true,
+		},
+		{
+			comparator: Comparator{Epsilon: 1e-9},
+			left:       &promql.Result{Value: promql.Scalar{T: 1, V: 0}},
+			right:      &promql.Result{Value: promql.Scalar{T: 1, V: 1e-12}},
+		},
+		{
+			comparator: Comparator{Margin: 1e-9},
+			left:       &promql.Result{Value: promql.Scalar{T: 1, V: 0}},
+			right:      &promql.Result{Value: promql.Scalar{T: 1, V: 1e-12}},
+			equal:      true,
+		},
+		{
+			left: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "1"), F: 1},
+				{Metric: labels.FromStrings("a", "2"), F: math.NaN()},
+			}},
+			right: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "2"), F: math.NaN(), DropName: true},
+				{Metric: labels.FromStrings("a", "1"), F: 1},
+			}},
+			equal: true,
+		},
+		{
+			left: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "1"), F: 1},
+			}},
+			right: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "1"), H: h},
+			}},
+		},
+		{
+			left: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "1"), F: 1},
+				{Metric: labels.FromStrings("a", "1"), F: 1},
+			}},
+			right: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "1"), F: 1},
+			}},
+		},
+		{
+			left: &promql.Result{Value: promql.Matrix{
+				{Metric: labels.EmptyLabels(), Floats: []promql.FPoint{{T: 1, F: 1}}, Histograms: []promql.HPoint{}},
+			}},
+			right: &promql.Result{Value: promql.Matrix{
+				{Floats: []promql.FPoint{{T: 1, F: 1}}},
+			}},
+			equal: true,
+		},
+		{
+			left: &promql.Result{Value: promql.Matrix{
+				{Metric: labels.FromStrings("a", "1"), Floats: []promql.FPoint{{T: 1, F: 1}}},
+			}},
+			right: &promql.Result{Value: promql.Matrix{
+				{Metric: labels.FromStrings("a", "2"), Floats: []promql.FPoint{{T: 1, F: 1}}},
+			}},
+		},
+		{
+			left: &promql.Result{Value: promql.Matrix{
+				{Metric: labels.FromStrings("a", "1"), Histograms: []promql.HPoint{{T: 1, H: h}}},
+			}},
+			right: &promql.Result{Value: promql.Matrix{
+				{Metric: labels.FromStrings("a", "1"), Histograms: []promql.HPoint{{T: 1, H: hEmptyBucket}}},
+			}},
+			equal: true,
+		},
+		{
+			left: &promql.Result{Value: promql.Matrix{
+				{Metric: labels.FromStrings("a", "1"), Histograms: []promql.HPoint{{T: 1, H: h}}},
+			}},
+			right: &promql.Result{Value: promql.Matrix{
+				{Metric: labels.FromStrings("a", "1"), Histograms: []promql.HPoint{{T: 1, H: hOtherBucket}}},
+			}},
+		},
+		{
+			query: `sort(foo)`,
+			left: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "1"), F: 1},
+				{Metric: labels.FromStrings("a", "2"), F: 2},
+			}},
+			right: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "2"), F: 2},
+				{Metric: labels.FromStrings("a", "1"), F: 1},
+			}},
+		},
+		{
+			query: `(sort_desc(foo))`,
+			left: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "1"), F: 2},
+				{Metric: labels.FromStrings("a", "2"), F: 1},
+				{Metric: labels.FromStrings("a", "3"), F: 1},
+				{Metric: labels.FromStrings("a", "4"), F: math.NaN()},
+			}},
+			right: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "1"), F: 2},
+				{Metric: labels.FromStrings("a", "3"), F: 1},
+				{Metric: labels.FromStrings("a", "2"), F: 1},
+				{Metric: labels.FromStrings("a", "4"), F: math.NaN()},
+			}},
+			equal: true,
+		},
+		{
+			query: `sort(foo) + 1`,
+			left: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "1"), F: 1},
+				{Metric: labels.FromStrings("a", "2"), F: 2},
+			}},
+			right: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "2"), F: 2},
+				{Metric: labels.FromStrings("a", "1"), F: 1},
+			}},
+			equal: true,
+		},
+		{
+			query: `sort(foo)`,
+			left: &promql.Result{Value: promql.Matrix{
+				{Metric: labels.FromStrings("a", "2"), Floats: []promql.FPoint{{T: 1, F: 1}}},
+				{Metric: labels.FromStrings("a", "1"), Floats: []promql.FPoint{{T: 1, F: 2}}},
+			}},
+			right: &promql.Result{Value: promql.Matrix{
+				{Metric: labels.FromStrings("a", "1"), Floats: []promql.FPoint{{T: 1, F: 2}}},
+				{Metric: labels.FromStrings("a", "2"), Floats: []promql.FPoint{{T: 1, F: 1}}},
+			}},
+			equal: true,
+		},
+		{
+			query: `sort_by_label(foo, "b")`,
+			left: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "2", "b", "x2"), F: 1},
+				{Metric: labels.FromStrings("a", "1", "b", "x10"), F: 1},
+			}},
+			right: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "1", "b", "x10"), F: 1},
+				{Metric: labels.FromStrings("a", "2", "b", "x2"), F: 1},
+			}},
+		},
+		{
+			query: `topk by (b) (1, foo)`,
+			left: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "1", "b", "x"), F: 2},
+				{Metric: labels.FromStrings("a", "2", "b", "y"), F: 3},
+				{Metric: labels.FromStrings("a", "3", "b", "x"), F: 1},
+			}},
+			right: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "2", "b", "y"), F: 3},
+				{Metric: labels.FromStrings("a", "1", "b", "x"), F: 2},
+				{Metric: labels.FromStrings("a", "3", "b", "x"), F: 1},
+			}},
+			equal: true,
+		},
+		{
+			query: `bottomk by (b) (2, foo)`,
+			left: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "1", "b", "x"), F: 1},
+				{Metric: labels.FromStrings("a", "3", "b", "x"), F: 2},
+			}},
+			right: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "3", "b", "x"), F: 2},
+				{Metric: labels.FromStrings("a", "1", "b", "x"), F: 1},
+			}},
+		},
+	} {
+		t.Run(fmt.Sprintf("test_case_%d", i), func(t *testing.T) {
+			var expr parser.Expr
+			if tc.query != "" {
+				var err error
+				expr, err = parser.ParseExpr(tc.query)
+				require.NoError(t, err)
+			}
+			diff := tc.comparator.Compare(expr, tc.left, tc.right)
+			require.Equal(t, tc.equal, diff.Equal(), diff.String())
+			require.Equal(t, tc.equal, diff.String() == "")
+		})
+	}
+}
+
+func TestDiffString(t *testing.T) {
+	left := &promql.Result{Value: promql.Matrix{
+		{Metric: labels.FromStrings("a", "1"), Floats: []promql.FPoint{{T: 1, F: 1}, {T: 2, F: 2}, {T: 3, F: 3}}},
+		{Metric: labels.FromStrings("a", "2"), Floats: []promql.FPoint{{T: 1, F: 1}}},
+	}}
+	right := &promql.Result{Value: promql.Matrix{
+		{Metric: labels.FromStrings("a", "1"), Floats: []promql.FPoint{{T: 1, F: 1}, {T: 2, F: math.NaN()}}},
+		{Metric: labels.FromStrings("a", "3"), Floats: []promql.FPoint{{T: 1, F: math.Float64frombits(value.StaleNaN)}}},
+	}}
+	require.Equal(t, `{a="1"}
+  - 2 @ 2
+  - 3 @ 3
+  + NaN @ 2
+{a="2"}
+  - 1 @ 1
+  + <missing>
+{a="3"}
+  - <missing>
+  + stale @ 1
+`, Comparator{}.Compare(nil, left, right).String())
+
+	expr, err := parser.ParseExpr(`sort(foo)`)
+	require.NoError(t, err)
+	left = &promql.Result{Value: promql.Vector{
+		{Metric: labels.FromStrings("a", "1"), F: 1},
+		{Metric: labels.FromStrings("a", "2"), F: 2},
+	}}
+	right = &promql.Result{Value: promql.Vector{
+		{Metric: labels.FromStrings("a", "2"), F: 2},
+		{Metric: labels.FromStrings("a", "1"), F: 1},
+	}}
+	require.Equal(t, "+ series {a=\"1\"} 1 returned after {a=\"2\"} 2\n", Comparator{}.Compare(expr, left, right).String())
+}
+
+func TestOrderSignificant(t *testing.T) {
+	enableExperimentalFunctions(t)
+	for _, tc := range []struct {
+		query    string
+		expected bool
+	}{
+		{query: `foo`, expected: false},
+		{query: `sum(foo)`, expected: false},
+		{query: `sort(foo)`, expected: true},
+		{query: `((sort_desc(foo)))`, expected: true},
+		{query: `sort_by_label(foo, "a")`, expected: true},
+		{query: `sort_by_label_desc(foo, "a")`, expected: true},
+		{query: `topk(1, foo)`, expected: true},
+		{query: `bottomk by (a) (1, foo)`, expected: true},
+		{query: `limitk(1, foo)`, expected: false},
+		{query: `abs(sort(foo))`, expected: false},
+		{query: `sort(foo) + 1`, expected: false},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tc.query)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, OrderSignificant(expr))
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package promqlsmith
+
+import (
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	// defaultScrapeInterval is the default scrape interval of Prometheus.
+	defaultScrapeInterval = time.Minute
+	// defaultSubqueryStep is the step assumed for subqueries without one, which
+	// is the default evaluation interval of Prometheus.
+	defaultSubqueryStep = time.Minute
+
+	// max number of times queries exceeding the cost budget are regenerated at
+	// each depth.
+	maxCostBudgetRetries = 10
+)
+
+// Cost is the estimated cost of evaluating a query at a single step. Range queries
+// cost as much at every step.
+type Cost struct {
+	// Series is the number of series selected by the vector and matrix selectors
+	// of the query, counted once per selector.
+	Series int
+	// Samples is the number of samples read by the selectors, assuming one sample
+	// per scrape interval in the range of matrix selectors. Selectors in subqueries
+	// read samples at every step of the subqueries.
+	Samples int64
+	// SubquerySteps is the number of steps at which the inner expressions of
+	// subqueries are evaluated, including steps of nested subqueries.
+	SubquerySteps int64
+	// OutputSeries is the number of series returned by the query. It is Series if
+	// the output series can't be inferred.
+	OutputSeries int
+}
+
+// CostBudget bounds the cost of generated queries. Fields set to 0 are unbounded.
+// Generated queries stay within the budget unless it is too low for single
+// selectors, see WithCostBudget.
+type CostBudget struct {
+	MaxSeries        int
+	MaxSamples       int64
+	MaxSubquerySteps int64
+	MaxOutputSeries  int
+}
+
+// usage returns the highest ratio between a cost and its bound, so that costs
+// within the budget have a usage of at most 1.
+func (b CostBudget) usage(c Cost) float64 {
+	u := 0.0
+	ratio := func(v, limit int64) {
+		if limit > 0 {
+			u = max(u, float64(v)/float64(limit))
+		}
+	}
+	ratio(int64(c.Series), int64(b.MaxSeries))
+	ratio(c.Samples, b.MaxSamples)
+	ratio(c.SubquerySteps, b.MaxSubquerySteps)
+	ratio(int64(c.OutputSeries), int64(b.MaxOutputSeries))
+	return u
+}
+
+// EstimateCost estimates the cost of evaluating expr against the series set. Vector
+// selectors of expressions which were not generated by PromQLSmith are matched
+// against the series set.
+func (s *PromQLSmith) EstimateCost(expr parser.Expr) Cost {
+	var c Cost
+	s.estimateCost(expr, 1, &c)
+	if output, stop := getOutputSeries(s.withSelectedSeries(expr)); stop {
+		c.OutputSeries = c.Series
+	} else {
+		c.OutputSeries = len(output)
+	}
+	return c
+}
+
+// estimateCost adds the cost of expr to c. Every selector of expr is evaluated
+// steps times because of the subqueries expr is in.
+func (s *PromQLSmith) estimateCost(expr parser.Expr, steps int64, c *Cost) {
+	switch e := expr.(type) {
+	case *parser.VectorSelector:
+		n := s.selectedSeries(e)
+		c.Series += n
+		c.Samples += steps * int64(n)
+		return
+	case *parser.MatrixSelector:
+		n := s.selectedSeries(e.VectorSelector.(*parser.VectorSelector))
+		c.Series += n
+		c.Samples += steps * int64(n) * max(int64(e.Range/s.scrapeInterval), 1)
+		return
+	case *parser.SubqueryExpr:
+		step := e.Step
+		if step == 0 {
+			step = defaultSubqueryStep
+		}
+		steps *= max(int64(e.Range/step), 1)
+		c.SubquerySteps += steps
+	}
+	for _, child := range parser.Children(expr) {
+		if child, ok := child.(parser.Expr); ok {
+			s.estimateCost(child, steps, c)
+		}
+	}
+}
+
+// selectedSeries returns the number of series selected by the vector selector.
+func (s *PromQLSmith) selectedSeries(vs *parser.VectorSelector) int {
+	if vs.Series != nil {
+		return len(vs.Series)
+	}
+	n := 0
+	for _, series := range s.seriesSet {
+		if matchesSeries(series, vs.LabelMatchers) {
+			n++
+		}
+	}
+	return n
+}
+
+// withSelectedSeries returns expr if all its vector selectors have their selected
+// series, otherwise a copy of expr whose vector selectors are populated from the
+// series set.
+func (s *PromQLSmith) withSelectedSeries(expr parser.Expr) parser.Expr {
+	populated := true
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok && vs.Series == nil {
+			populated = false
+		}
+		return nil
+	})
+	if populated {
+		return expr
+	}
+	cp, err := parser.ParseExpr(expr.String())
+	if err != nil {
+		return expr
+	}
+	parser.Inspect(cp, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok {
+			s.populateSeries(vs)
+		}
+		return nil
+	})
+	return cp
+}
+
+// fitCostBudget returns expr if it is within the cost budget, otherwise it
+// regenerates it a few times at every depth, from the max depth down to single
+// selectors, and returns the first expression within the budget. The cheapest
+// expression is returned if none fits, which only happens if the budget is lower
+// than the cost of most single selectors.
+func (s *PromQLSmith) fitCostBudget(expr parser.Expr, valueTypes ...parser.ValueType) parser.Expr {
+	if s.costBudget == nil {
+		return expr
+	}
+	cheapest, usage := expr, s.costBudget.usage(s.EstimateCost(expr))
+	for depth := s.maxDepth; depth > 0 && usage > 1; depth-- {
+		for i := 0; i < maxCostBudgetRetries && usage > 1; i++ {
+			expr = s.walk(depth, valueTypes...)
+			if expr == nil {
+				break
+			}
+			if u := s.costBudget.usage(s.EstimateCost(expr)); u < usage {
+				cheapest, usage = expr, u
+			}
+		}
+	}
+	return cheapest
+}
@@ -0,0 +1,59 @@
+package promqlsmith
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateCost(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet, WithScrapeInterval(15*time.Second))
+	for _, tc := range []struct {
+		query    string
+		expected Cost
+	}{
+		{query: `1`, expected: Cost{}},
+		{query: `http_requests_total`, expected: Cost{Series: 6, Samples: 6, OutputSeries: 6}},
+		{query: `http_requests_total{status_code="200"} offset 5m`, expected: Cost{Series: 2, Samples: 2, OutputSeries: 2}},
+		{query: `rate(http_requests_total[5m])`, expected: Cost{Series: 6, Samples: 120, OutputSeries: 6}},
+		{query: `rate(http_requests_total[5s])`, expected: Cost{Series: 6, Samples: 6, OutputSeries: 6}},
+		{query: `sum by (cluster) (http_requests_total) + sum by (cluster) (http_requests_total)`, expected: Cost{Series: 12, Samples: 12, OutputSeries: 2}},
+		{query: `max_over_time(rate(http_requests_total[1m])[10m:])`, expected: Cost{Series: 6, Samples: 240, SubquerySteps: 10, OutputSeries: 6}},
+		{query: `max_over_time(max_over_time(http_requests_total[10m:5m])[1h:30s])`, expected: Cost{Series: 6, Samples: 1440, SubquerySteps: 360, OutputSeries: 6}},
+		{query: `absent(nonexistent)`, expected: Cost{OutputSeries: 1}},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tc.query)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, ps.EstimateCost(expr))
+		})
+	}
+}
+
+func TestCostBudgetUsage(t *testing.T) {
+	b := CostBudget{MaxSamples: 100, MaxOutputSeries: 10}
+	require.Equal(t, 0.0, b.usage(Cost{Series: 1000, SubquerySteps: 1000}))
+	require.Equal(t, 0.5, b.usage(Cost{Samples: 50, OutputSeries: 2}))
+	require.Equal(t, 2.0, b.usage(Cost{Samples: 50, OutputSeries: 20}))
+}
+
+func TestWithCostBudget(t *testing.T) {
+	budget := CostBudget{MaxSamples: 100, MaxSubquerySteps: 20, MaxOutputSeries: 3}
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet, WithCostBudget(budget), WithScrapeInterval(15*time.Second))
+	unbounded := New(rnd, testSeriesSet, WithScrapeInterval(15*time.Second))
+
+	unboundedWithin := 0
+	for i := 0; i < 200; i++ {
+		expr := ps.WalkRangeQuery()
+		require.LessOrEqual(t, budget.usage(ps.EstimateCost(expr)), 1.0, expr.String())
+		if budget.usage(unbounded.EstimateCost(unbounded.WalkRangeQuery())) <= 1 {
+			unboundedWithin++
+		}
+	}
+	require.Less(t, unboundedWithin, 200)
+}
@@ -0,0 +1,169 @@
+package promqlsmith
+
+import (
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// maxCoverageWeightFactor bounds the factor by which CoverageGuide multiplies or
+// divides the weights of expression types, functions and operators.
+const maxCoverageWeightFactor = 10
+
+// choiceStats counts the queries using a choice and the new coverage they reached.
+type choiceStats struct {
+	queries int
+	gain    int
+}
+
+// CoverageGuide steers generation towards queries reaching new coverage of the
+// engine under test. Callers report the coverage of each generated query with
+// Report, as a set of opaque code path IDs or hashes, and the guide updates the
+// weights of expression types, functions, aggregations and binary operators of
+// the PromQLSmith instance: choices used by queries reaching new coverage get
+// higher weights, choices used by queries reaching none lower ones, and choices
+// not used yet are explored first. Weights set with options like WithExprWeights
+// are multiplied by the factor of each choice, so disabled choices stay disabled.
+// Queries reaching new coverage are kept as seeds, for example to be mutated.
+// A CoverageGuide is not safe for concurrent use.
+type CoverageGuide struct {
+	ps *PromQLSmith
+
+	exprWeights  map[ExprType]float64
+	funcWeights  map[string]float64
+	aggrWeights  map[parser.ItemType]float64
+	binopWeights map[parser.ItemType]float64
+
+	covered map[string]struct{}
+	stats   map[string]*choiceStats
+	queries int
+	gain    int
+	seeds   []parser.Expr
+}
+
+// NewCoverageGuide returns a guide updating the weights of ps. The weights of ps
+// at this point are used as base weights.
+func NewCoverageGuide(ps *PromQLSmith) *CoverageGuide {
+	return &CoverageGuide{
+		ps:           ps,
+		exprWeights:  ps.exprWeights,
+		funcWeights:  ps.funcWeights,
+		aggrWeights:  ps.aggrWeights,
+		binopWeights: ps.binopWeights,
+		covered:      make(map[string]struct{}),
+		stats:        make(map[string]*choiceStats),
+	}
+}
+
+// Report records the coverage reached by evaluating expr, which must have been
+// generated by the PromQLSmith instance of the guide, and updates its weights.
+// It returns the number of coverage IDs which weren't reported before.
+func (g *CoverageGuide) Report(expr parser.Expr, coverage []string) int {
+	gain := 0
+	for _, id := range coverage {
+		if _, ok := g.covered[id]; !ok {
+			g.covered[id] = struct{}{}
+			gain++
+		}
+	}
+	g.queries++
+	g.gain += gain
+	for choice := range exprChoices(expr) {
+		stats, ok := g.stats[choice]
+		if !ok {
+			stats = &choiceStats{}
+			g.stats[choice] = stats
+		}
+		stats.queries++
+		stats.gain += gain
+	}
+	if gain > 0 {
+		g.seeds = append(g.seeds, expr)
+	}
+	g.updateWeights()
+	return gain
+}
+
+// Coverage returns the number of distinct coverage IDs reported so far.
+func (g *CoverageGuide) Coverage() int {
+	return len(g.covered)
+}
+
+// Seeds returns the queries which reached new coverage, in the order they were reported.
+func (g *CoverageGuide) Seeds() []parser.Expr {
+	return g.seeds
+}
+
+func (g *CoverageGuide) updateWeights() {
+	g.ps.exprWeights = make(map[ExprType]float64, len(g.ps.supportedExprs))
+	for _, e := range g.ps.supportedExprs {
+		g.ps.exprWeights[e] = baseWeight(g.exprWeights, e) * g.factor(exprChoice(e))
+	}
+	g.ps.funcWeights = make(map[string]float64, len(g.ps.supportedFuncs))
+	for _, f := range g.ps.supportedFuncs {
+		g.ps.funcWeights[f.Name] = baseWeight(g.funcWeights, f.Name) * g.factor(funcChoice(f.Name))
+	}
+	g.ps.aggrWeights = make(map[parser.ItemType]float64, len(g.ps.supportedAggrs))
+	for _, op := range g.ps.supportedAggrs {
+		g.ps.aggrWeights[op] = baseWeight(g.aggrWeights, op) * g.factor(aggrChoice(op))
+	}
+	g.ps.binopWeights = make(map[parser.ItemType]float64, len(g.ps.supportedBinops))
+	for _, op := range g.ps.supportedBinops {
+		g.ps.binopWeights[op] = baseWeight(g.binopWeights, op) * g.factor(binopChoice(op))
+	}
+}
+
+// factor compares the average coverage gain of queries using the choice with the
+// average gain of all queries. Choices not used yet have the highest factor so that
+// they are explored first.
+func (g *CoverageGuide) factor(choice string) float64 {
+	stats, ok := g.stats[choice]
+	if !ok {
+		return maxCoverageWeightFactor
+	}
+	mean := float64(g.gain+1) / float64(g.queries+1)
+	score := float64(stats.gain+1) / float64(stats.queries+1)
+	return min(max(score/mean, 1.0/maxCoverageWeightFactor), maxCoverageWeightFactor)
+}
+
+// baseWeight returns the weight of the key, which is 1 if it has none like in pickWeighted.
+func baseWeight[K comparable](weights map[K]float64, key K) float64 {
+	w, ok := weights[key]
+	if !ok {
+		return 1
+	}
+	return max(w, 0)
+}
+
+func exprChoice(e ExprType) string          { return "expr:" + e.String() }
+func funcChoice(name string) string         { return "func:" + name }
+func aggrChoice(op parser.ItemType) string  { return "aggr:" + op.String() }
+func binopChoice(op parser.ItemType) string { return "binop:" + op.String() }
+
+// exprChoices returns the expression types, functions and operators used in expr.
+func exprChoices(expr parser.Expr) map[string]struct{} {
+	choices := make(map[string]struct{})
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			choices[exprChoice(VectorSelector)] = struct{}{}
+		case *parser.MatrixSelector:
+			choices[exprChoice(MatrixSelector)] = struct{}{}
+		case *parser.SubqueryExpr:
+			choices[exprChoice(SubQueryExpr)] = struct{}{}
+		case *parser.NumberLiteral:
+			choices[exprChoice(NumberLiteral)] = struct{}{}
+		case *parser.UnaryExpr:
+			choices[exprChoice(UnaryExpr)] = struct{}{}
+		case *parser.AggregateExpr:
+			choices[exprChoice(AggregateExpr)] = struct{}{}
+			choices[aggrChoice(n.Op)] = struct{}{}
+		case *parser.BinaryExpr:
+			choices[exprChoice(BinaryExpr)] = struct{}{}
+			choices[binopChoice(n.Op)] = struct{}{}
+		case *parser.Call:
+			choices[exprChoice(CallExpr)] = struct{}{}
+			choices[funcChoice(n.Func.Name)] = struct{}{}
+		}
+		return nil
+	})
+	return choices
+}
@@ -0,0 +1,86 @@
+package promqlsmith
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoverageGuideReport(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet, WithFunctionWeights(map[string]float64{"exp": 0}))
+	g := NewCoverageGuide(ps)
+
+	rate, err := parser.ParseExpr(`rate(http_requests_total[5m])`)
+	require.NoError(t, err)
+	abs, err := parser.ParseExpr(`abs(http_requests_total)`)
+	require.NoError(t, err)
+
+	require.Equal(t, 2, g.Report(rate, []string{"a", "b"}))
+	for i := 0; i < 4; i++ {
+		require.Equal(t, 0, g.Report(abs, []string{"a"}))
+	}
+	require.Equal(t, 2, g.Coverage())
+	require.Equal(t, []parser.Expr{rate}, g.Seeds())
+
+	// The mean gain is 2/5. Factors are relative to (2+1)/(5+1), unused choices
+	// have the highest factor.
+	require.InDelta(t, 3, ps.funcWeights["rate"], 1e-9)
+	require.InDelta(t, 0.4, ps.funcWeights["abs"], 1e-9)
+	require.InDelta(t, maxCoverageWeightFactor, ps.funcWeights["ceil"], 1e-9)
+	require.InDelta(t, 1, ps.exprWeights[VectorSelector], 1e-9)
+	require.InDelta(t, maxCoverageWeightFactor, ps.exprWeights[AggregateExpr], 1e-9)
+	require.Zero(t, ps.funcWeights["exp"])
+}
+
+func TestCoverageGuideFactorBounds(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet)
+	g := NewCoverageGuide(ps)
+
+	maxExpr, err := parser.ParseExpr(`max(http_requests_total)`)
+	require.NoError(t, err)
+	coverage := make([]string, 100)
+	for i := range coverage {
+		coverage[i] = fmt.Sprint(i)
+	}
+	require.Equal(t, 100, g.Report(maxExpr, coverage))
+	// The average gain is above 1, unused choices are still preferred.
+	require.Greater(t, ps.aggrWeights[parser.MIN], ps.aggrWeights[parser.MAX])
+
+	expr, err := parser.ParseExpr(`sum(http_requests_total) + 1`)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.Zero(t, g.Report(expr, coverage))
+	}
+	require.Equal(t, float64(maxCoverageWeightFactor), ps.aggrWeights[parser.MAX])
+	require.Equal(t, 1.0/maxCoverageWeightFactor, ps.aggrWeights[parser.SUM])
+	require.Equal(t, 1.0/maxCoverageWeightFactor, ps.binopWeights[parser.ADD])
+	require.Equal(t, float64(maxCoverageWeightFactor), ps.aggrWeights[parser.MIN])
+}
+
+func TestCoverageGuideLoop(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet, WithEnableVectorMatching(true))
+	g := NewCoverageGuide(ps)
+	for i := 0; i < 200; i++ {
+		expr := ps.WalkInstantQuery()
+		_, err := parser.ParseExpr(expr.String())
+		require.NoError(t, err, expr.String())
+		// Use the choices of the query as coverage, so that covering every choice
+		// is the best the guide can do.
+		coverage := make([]string, 0)
+		for choice := range exprChoices(expr) {
+			coverage = append(coverage, choice)
+		}
+		sort.Strings(coverage)
+		g.Report(expr, coverage)
+	}
+	require.NotEmpty(t, g.Seeds())
+	require.Greater(t, g.Coverage(), len(ps.supportedExprs))
+}
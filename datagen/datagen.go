@@ -0,0 +1,354 @@
+// Package datagen generates random series and samples to evaluate the queries
+// generated by PromQLSmith against. Generated data includes counters with
+// resets, gauges, classic histograms with `le` buckets, native histograms,
+// sparse series and stale series with varied label cardinality.
+//
+// Using the same random generator for the data and for PromQLSmith drives both
+// from a single seed:
+//
+//	rnd := rand.New(rand.NewSource(seed))
+//	data := datagen.Generate(rnd)
+//	err := data.Append(ctx, storage)
+//	ps := promqlsmith.New(rnd, data.Labels(), promqlsmith.WithSeriesSampleTypes(data.SampleTypes))
+package datagen
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/cortexproject/promqlsmith"
+)
+
+var (
+	labelNames = []string{"env", "instance", "job", "pod", "region", "status_code"}
+
+	bucketBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+const (
+	// nativeBuckets is the number of positive buckets of native histograms.
+	nativeBuckets = 8
+	// nativeBucketOffset is the index of the first positive bucket of native
+	// histograms. With schema 0 the first bucket is (0.125, 0.25].
+	nativeBucketOffset = -2
+)
+
+// Data is a set of generated series and their samples.
+type Data struct {
+	// Series holds the samples of every series sorted by labels. Stale markers
+	// are float samples, including for native histogram series.
+	Series promql.Matrix
+	// SampleTypes holds the sample type of every classic histogram bucket and
+	// native histogram metric, to be passed to promqlsmith.WithSeriesSampleTypes.
+	SampleTypes map[string]promqlsmith.SampleType
+	// Start and End are the timestamps of the first and last possible samples.
+	Start time.Time
+	End   time.Time
+}
+
+// Labels returns the labels of all series.
+func (d *Data) Labels() []labels.Labels {
+	out := make([]labels.Labels, 0, len(d.Series))
+	for _, s := range d.Series {
+		out = append(out, s.Metric)
+	}
+	return out
+}
+
+// Append appends all samples to the appendable and commits them.
+func (d *Data) Append(ctx context.Context, a storage.Appendable) error {
+	app := a.Appender(ctx)
+	for _, s := range d.Series {
+		if err := appendSeries(app, s); err != nil {
+			if rerr := app.Rollback(); rerr != nil {
+				return fmt.Errorf("%w, rollback: %w", err, rerr)
+			}
+			return err
+		}
+	}
+	return app.Commit()
+}
+
+// appendSeries appends the float and histogram samples of the series in time order.
+func appendSeries(app storage.Appender, s promql.Series) error {
+	i, j := 0, 0
+	for i < len(s.Floats) || j < len(s.Histograms) {
+		var err error
+		if j == len(s.Histograms) || (i < len(s.Floats) && s.Floats[i].T < s.Histograms[j].T) {
+			_, err = app.Append(0, s.Metric, s.Floats[i].T, s.Floats[i].F)
+			i++
+		} else {
+			_, err = app.AppendHistogram(0, s.Metric, s.Histograms[j].T, nil, s.Histograms[j].H)
+			j++
+		}
+		if err != nil {
+			return fmt.Errorf("append series %s: %w", s.Metric, err)
+		}
+	}
+	return nil
+}
+
+// Generate generates random series and samples.
+func Generate(rnd *rand.Rand, opts ...Option) *Data {
+	options := options{}
+	for _, o := range opts {
+		o.apply(&options)
+	}
+	options.applyDefaults()
+
+	g := &generator{rnd: rnd, opts: options}
+	d := &Data{
+		SampleTypes: make(map[string]promqlsmith.SampleType),
+		Start:       options.start,
+		End:         options.start.Add(time.Duration(options.samples-1) * options.interval),
+	}
+	for i := 0; i < options.metricsPerType; i++ {
+		d.Series = append(d.Series, g.counter(fmt.Sprintf("counter_%d_total", i))...)
+		d.Series = append(d.Series, g.gauge(fmt.Sprintf("gauge_%d", i))...)
+
+		name := fmt.Sprintf("classic_histogram_%d", i)
+		d.Series = append(d.Series, g.classicHistogram(name)...)
+		d.SampleTypes[name+"_bucket"] = promqlsmith.SampleTypeClassicHistogramBucket
+
+		if !options.disableNative {
+			name := fmt.Sprintf("native_histogram_%d", i)
+			d.Series = append(d.Series, g.nativeHistogram(name)...)
+			d.SampleTypes[name] = promqlsmith.SampleTypeNativeHistogram
+		}
+	}
+	sort.Sort(d.Series)
+	return d
+}
+
+type generator struct {
+	rnd  *rand.Rand
+	opts options
+}
+
+// seriesLabels returns the label sets of a new metric. Each metric has between 1
+// and 4 label names and between 1 and maxSeriesPerMetric series.
+func (g *generator) seriesLabels(name string) []labels.Labels {
+	names := make([]string, 1+g.rnd.Intn(4))
+	for i, idx := range g.rnd.Perm(len(labelNames))[:len(names)] {
+		names[i] = labelNames[idx]
+	}
+	sort.Strings(names)
+	cardinality := make([]int, len(names))
+	for i := range names {
+		cardinality[i] = 1 + g.rnd.Intn(g.opts.maxSeriesPerMetric)
+	}
+
+	n := 1 + g.rnd.Intn(g.opts.maxSeriesPerMetric)
+	seen := make(map[string]struct{}, n)
+	out := make([]labels.Labels, 0, n)
+	// Label sets are picked randomly, so stop after a few attempts if there
+	// are fewer possible combinations than series.
+	for attempts := 0; len(out) < n && attempts < 4*n; attempts++ {
+		b := labels.NewScratchBuilder(len(names) + 1)
+		b.Add(labels.MetricName, name)
+		for i, ln := range names {
+			b.Add(ln, ln+"-"+strconv.Itoa(g.rnd.Intn(cardinality[i])))
+		}
+		b.Sort()
+		lbls := b.Labels()
+		if _, ok := seen[lbls.String()]; ok {
+			continue
+		}
+		seen[lbls.String()] = struct{}{}
+		out = append(out, lbls)
+	}
+	return out
+}
+
+// timeline returns the steps that have a sample and the step of the stale
+// marker, which is -1 if the series is not stale.
+func (g *generator) timeline() ([]int, int) {
+	last, stale := g.opts.samples, -1
+	if g.opts.samples > 1 && g.rnd.Float64() < *g.opts.staleProbability {
+		stale = 1 + g.rnd.Intn(g.opts.samples-1)
+		last = stale
+	}
+	sparse := g.rnd.Float64() < *g.opts.sparseProbability
+	steps := make([]int, 0, last)
+	for i := 0; i < last; i++ {
+		// Keep the first sample so that every series has at least one sample.
+		if sparse && i > 0 && g.rnd.Intn(2) == 0 {
+			continue
+		}
+		steps = append(steps, i)
+	}
+	return steps, stale
+}
+
+func (g *generator) timestamp(step int) int64 {
+	return g.opts.start.Add(time.Duration(step) * g.opts.interval).UnixMilli()
+}
+
+func (g *generator) staleMarker(step int) promql.FPoint {
+	return promql.FPoint{T: g.timestamp(step), F: math.Float64frombits(value.StaleNaN)}
+}
+
+func (g *generator) reset() bool {
+	return g.rnd.Float64() < *g.opts.resetProbability
+}
+
+// floatSeries generates float series of a new metric using next to compute
+// each sample from the previous one.
+func (g *generator) floatSeries(name string, first func() float64, next func(float64) float64) promql.Matrix {
+	out := make(promql.Matrix, 0)
+	for _, lbls := range g.seriesLabels(name) {
+		steps, stale := g.timeline()
+		s := promql.Series{Metric: lbls}
+		v := first()
+		for i, step := range steps {
+			if i > 0 {
+				v = next(v)
+			}
+			s.Floats = append(s.Floats, promql.FPoint{T: g.timestamp(step), F: v})
+		}
+		if stale >= 0 {
+			s.Floats = append(s.Floats, g.staleMarker(stale))
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func (g *generator) counter(name string) promql.Matrix {
+	return g.floatSeries(name,
+		func() float64 { return math.Round(g.rnd.Float64() * 100) },
+		func(v float64) float64 {
+			if g.reset() {
+				return math.Round(g.rnd.Float64() * 10)
+			}
+			return v + math.Round(g.rnd.Float64()*20)
+		},
+	)
+}
+
+func (g *generator) gauge(name string) promql.Matrix {
+	return g.floatSeries(name,
+		func() float64 { return g.rnd.NormFloat64() * 50 },
+		func(v float64) float64 { return v + g.rnd.NormFloat64()*5 },
+	)
+}
+
+// classicHistogram generates the bucket, sum and count series of a new classic histogram.
+func (g *generator) classicHistogram(name string) promql.Matrix {
+	// Pick between 2 and 6 bucket bounds in addition to +Inf.
+	n := 2 + g.rnd.Intn(5)
+	idx := g.rnd.Perm(len(bucketBounds))[:n]
+	sort.Ints(idx)
+	bounds := make([]float64, 0, n+1)
+	for _, i := range idx {
+		bounds = append(bounds, bucketBounds[i])
+	}
+	bounds = append(bounds, math.Inf(1))
+
+	out := make(promql.Matrix, 0)
+	for _, lbls := range g.seriesLabels(name) {
+		steps, stale := g.timeline()
+		buckets := make([]promql.Series, len(bounds))
+		for i, bound := range bounds {
+			buckets[i].Metric = labels.NewBuilder(lbls).
+				Set(labels.MetricName, name+"_bucket").
+				Set(labels.BucketLabel, formatBound(bound)).
+				Labels()
+		}
+		sum := promql.Series{Metric: labels.NewBuilder(lbls).Set(labels.MetricName, name+"_sum").Labels()}
+		count := promql.Series{Metric: labels.NewBuilder(lbls).Set(labels.MetricName, name+"_count").Labels()}
+
+		counts := make([]float64, len(bounds))
+		var sumValue float64
+		for i, step := range steps {
+			if i > 0 && g.reset() {
+				clear(counts)
+				sumValue = 0
+			}
+			for o := g.rnd.Intn(20); o > 0; o-- {
+				obs := g.rnd.ExpFloat64() * bounds[len(bounds)/2]
+				sumValue += obs
+				for b, bound := range bounds {
+					if obs <= bound {
+						counts[b]++
+					}
+				}
+			}
+			t := g.timestamp(step)
+			for b := range buckets {
+				buckets[b].Floats = append(buckets[b].Floats, promql.FPoint{T: t, F: counts[b]})
+			}
+			sum.Floats = append(sum.Floats, promql.FPoint{T: t, F: sumValue})
+			count.Floats = append(count.Floats, promql.FPoint{T: t, F: counts[len(counts)-1]})
+		}
+		if stale >= 0 {
+			for b := range buckets {
+				buckets[b].Floats = append(buckets[b].Floats, g.staleMarker(stale))
+			}
+			sum.Floats = append(sum.Floats, g.staleMarker(stale))
+			count.Floats = append(count.Floats, g.staleMarker(stale))
+		}
+		out = append(out, buckets...)
+		out = append(out, sum, count)
+	}
+	return out
+}
+
+func (g *generator) nativeHistogram(name string) promql.Matrix {
+	out := make(promql.Matrix, 0)
+	for _, lbls := range g.seriesLabels(name) {
+		steps, stale := g.timeline()
+		s := promql.Series{Metric: lbls}
+		h := newNativeHistogram()
+		for i, step := range steps {
+			if i > 0 && g.reset() {
+				h = newNativeHistogram()
+			}
+			for o := g.rnd.Intn(20); o > 0; o-- {
+				if g.rnd.Intn(10) == 0 {
+					h.ZeroCount++
+				} else {
+					// Observations in (2^(i-1), 2^i] fall in the bucket with index i.
+					b := g.rnd.Intn(nativeBuckets)
+					upper := math.Ldexp(1, b+nativeBucketOffset)
+					h.PositiveBuckets[b]++
+					h.Sum += upper * (0.5 + g.rnd.Float64()/2)
+				}
+				h.Count++
+			}
+			s.Histograms = append(s.Histograms, promql.HPoint{T: g.timestamp(step), H: h.Copy()})
+		}
+		if stale >= 0 {
+			s.Floats = append(s.Floats, g.staleMarker(stale))
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func newNativeHistogram() *histogram.FloatHistogram {
+	return &histogram.FloatHistogram{
+		Schema:          0,
+		ZeroThreshold:   1e-3,
+		PositiveSpans:   []histogram.Span{{Offset: nativeBucketOffset, Length: nativeBuckets}},
+		PositiveBuckets: make([]float64, nativeBuckets),
+	}
+}
+
+func formatBound(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bound, 'f', -1, 64)
+}
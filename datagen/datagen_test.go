@@ -0,0 +1,105 @@
+package datagen
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/util/teststorage"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/promqlsmith"
+)
+
+func TestGenerate(t *testing.T) {
+	for i, tc := range []struct {
+		opts []Option
+	}{
+		{},
+		{opts: []Option{WithSamples(1), WithMetricsPerType(1), WithMaxSeriesPerMetric(1)}},
+		{opts: []Option{WithStaleProbability(1), WithSparseProbability(1), WithResetProbability(1)}},
+		{opts: []Option{WithNativeHistograms(false), WithStart(time.Unix(1000, 0)), WithInterval(time.Minute)}},
+	} {
+		t.Run(fmt.Sprintf("test_case_%d", i), func(t *testing.T) {
+			seed := time.Now().UnixNano()
+			d := Generate(rand.New(rand.NewSource(seed)), tc.opts...)
+			// Stale markers are NaN, so compare the string representation.
+			other := Generate(rand.New(rand.NewSource(seed)), tc.opts...)
+			require.Equal(t, d.Series.String(), other.Series.String())
+			require.Equal(t, d.SampleTypes, other.SampleTypes)
+			require.NotEmpty(t, d.Series)
+
+			for _, s := range d.Series {
+				require.NotEmpty(t, len(s.Floats)+len(s.Histograms), s.Metric.String())
+				require.True(t, s.Metric.Has(labels.MetricName))
+				for _, p := range s.Floats {
+					require.GreaterOrEqual(t, p.T, d.Start.UnixMilli())
+					require.LessOrEqual(t, p.T, d.End.UnixMilli())
+				}
+				for _, p := range s.Histograms {
+					require.NoError(t, p.H.Validate())
+				}
+				typ := d.SampleTypes[s.Metric.Get(labels.MetricName)]
+				if typ == promqlsmith.SampleTypeClassicHistogramBucket {
+					require.True(t, s.Metric.Has(labels.BucketLabel))
+				}
+				if typ == promqlsmith.SampleTypeNativeHistogram {
+					require.NotEmpty(t, s.Histograms)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateCounterResets(t *testing.T) {
+	d := Generate(rand.New(rand.NewSource(time.Now().UnixNano())), WithResetProbability(0), WithNativeHistograms(false))
+	for _, s := range d.Series {
+		name := s.Metric.Get(labels.MetricName)
+		if s.Metric.Has(labels.BucketLabel) || strings.HasPrefix(name, "counter_") {
+			for i := 1; i < len(s.Floats); i++ {
+				if value.IsStaleNaN(s.Floats[i].F) {
+					continue
+				}
+				require.GreaterOrEqual(t, s.Floats[i].F, s.Floats[i-1].F, s.Metric.String())
+			}
+		}
+	}
+}
+
+func TestDataAppend(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	d := Generate(rnd, WithStaleProbability(0.5))
+
+	st := teststorage.New(t)
+	t.Cleanup(func() { st.Close() })
+	ctx := context.Background()
+	require.NoError(t, d.Append(ctx, st))
+
+	q, err := st.Querier(math.MinInt64, math.MaxInt64)
+	require.NoError(t, err)
+	defer q.Close()
+	ss := q.Select(ctx, false, nil, labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+"))
+	count := 0
+	for ss.Next() {
+		count++
+	}
+	require.NoError(t, ss.Err())
+	require.Equal(t, len(d.Series), count)
+
+	// Generated queries can be evaluated against the generated data.
+	engine := promql.NewEngine(promql.EngineOpts{MaxSamples: 5000000, Timeout: time.Minute, LookbackDelta: 5 * time.Minute})
+	ps := promqlsmith.New(rnd, d.Labels(), promqlsmith.WithSeriesSampleTypes(d.SampleTypes))
+	for i := 0; i < 20; i++ {
+		qry, err := engine.NewRangeQuery(ctx, st, nil, ps.WalkRangeQuery().String(), d.Start, d.End, time.Minute)
+		require.NoError(t, err)
+		qry.Exec(ctx)
+		qry.Close()
+	}
+}
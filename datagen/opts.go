@@ -0,0 +1,136 @@
+package datagen
+
+import "time"
+
+const (
+	defaultInterval           = 30 * time.Second
+	defaultSamples            = 60
+	defaultMetricsPerType     = 2
+	defaultMaxSeriesPerMetric = 8
+	defaultSparseProbability  = 0.2
+	defaultStaleProbability   = 0.1
+	defaultResetProbability   = 0.05
+)
+
+type options struct {
+	start              time.Time
+	interval           time.Duration
+	samples            int
+	metricsPerType     int
+	maxSeriesPerMetric int
+	disableNative      bool
+
+	// Probabilities are pointers to tell apart 0 from unset.
+	sparseProbability *float64
+	staleProbability  *float64
+	resetProbability  *float64
+}
+
+func (o *options) applyDefaults() {
+	if o.start.IsZero() {
+		// promqltest loads samples from the Unix epoch.
+		o.start = time.Unix(0, 0)
+	}
+	if o.interval == 0 {
+		o.interval = defaultInterval
+	}
+	if o.samples == 0 {
+		o.samples = defaultSamples
+	}
+	if o.metricsPerType == 0 {
+		o.metricsPerType = defaultMetricsPerType
+	}
+	if o.maxSeriesPerMetric == 0 {
+		o.maxSeriesPerMetric = defaultMaxSeriesPerMetric
+	}
+	setDefaultProbability(&o.sparseProbability, defaultSparseProbability)
+	setDefaultProbability(&o.staleProbability, defaultStaleProbability)
+	setDefaultProbability(&o.resetProbability, defaultResetProbability)
+}
+
+func setDefaultProbability(p **float64, defaultValue float64) {
+	if *p == nil {
+		*p = &defaultValue
+	}
+}
+
+// Option specifies options when generating data.
+type Option interface {
+	apply(*options)
+}
+
+type optionFunc func(*options)
+
+func (f optionFunc) apply(o *options) {
+	f(o)
+}
+
+// WithStart sets the timestamp of the first sample. Defaults to the Unix epoch.
+func WithStart(start time.Time) Option {
+	return optionFunc(func(o *options) {
+		o.start = start
+	})
+}
+
+// WithInterval sets the interval between samples. Defaults to 30s.
+func WithInterval(interval time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.interval = interval
+	})
+}
+
+// WithSamples sets the number of sample timestamps of each series. Sparse and stale
+// series have fewer samples. Defaults to 60.
+func WithSamples(samples int) Option {
+	return optionFunc(func(o *options) {
+		o.samples = samples
+	})
+}
+
+// WithMetricsPerType sets the number of metrics generated for each type of
+// metric: counters, gauges, classic histograms and native histograms. Defaults to 2.
+func WithMetricsPerType(metrics int) Option {
+	return optionFunc(func(o *options) {
+		o.metricsPerType = metrics
+	})
+}
+
+// WithMaxSeriesPerMetric sets the max number of series of each metric. Each
+// classic histogram series has one bucket series per bucket plus a sum and a count
+// series. Defaults to 8.
+func WithMaxSeriesPerMetric(series int) Option {
+	return optionFunc(func(o *options) {
+		o.maxSeriesPerMetric = series
+	})
+}
+
+// WithNativeHistograms enables or disables native histogram metrics. Enabled by default.
+func WithNativeHistograms(enabled bool) Option {
+	return optionFunc(func(o *options) {
+		o.disableNative = !enabled
+	})
+}
+
+// WithSparseProbability sets the probability of a series to miss samples.
+// Sparse series miss about half of their samples. Defaults to 0.2.
+func WithSparseProbability(p float64) Option {
+	return optionFunc(func(o *options) {
+		o.sparseProbability = &p
+	})
+}
+
+// WithStaleProbability sets the probability of a series to be marked stale
+// and stop having samples before the end of the data. Defaults to 0.1.
+func WithStaleProbability(p float64) Option {
+	return optionFunc(func(o *options) {
+		o.staleProbability = &p
+	})
+}
+
+// WithResetProbability sets the probability of a counter or histogram to
+// reset at each sample. Defaults to 0.05.
+func WithResetProbability(p float64) Option {
+	return optionFunc(func(o *options) {
+		o.resetProbability = &p
+	})
+}
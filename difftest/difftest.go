@@ -0,0 +1,328 @@
+// Package difftest runs queries generated by PromQLSmith against two PromQL
+// engines, or two Prometheus compatible HTTP APIs, and reports the queries whose
+// results differ.
+package difftest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"golang.org/x/exp/slices"
+
+	"github.com/cortexproject/promqlsmith"
+	"github.com/cortexproject/promqlsmith/comparator"
+)
+
+// QueryType is the type of query that produced a mismatch.
+type QueryType int
+
+const (
+	InstantQuery QueryType = iota
+	RangeQuery
+)
+
+func (t QueryType) String() string {
+	switch t {
+	case InstantQuery:
+		return "instant"
+	case RangeQuery:
+		return "range"
+	default:
+		return fmt.Sprintf("QueryType(%d)", int(t))
+	}
+}
+
+// Target is a query engine together with the storage it evaluates queries against.
+type Target struct {
+	Engine    promql.QueryEngine
+	Queryable storage.Queryable
+}
+
+// Config controls how many queries are generated and the time range they are evaluated at.
+type Config struct {
+	// Iterations is the number of instant queries and the number of range
+	// queries to generate.
+	Iterations int
+	// Start and End are the range query time range. Instant queries are evaluated at End.
+	Start time.Time
+	End   time.Time
+	// Step is the range query resolution. Defaults to 30s.
+	Step time.Duration
+	// QueryOpts is passed to both engines when creating queries.
+	QueryOpts promql.QueryOpts
+	// Epsilon is the relative tolerance of float values, see comparator.Comparator.
+	// Defaults to 1e-9.
+	Epsilon float64
+}
+
+// defaultEpsilon tolerates floats added up in a different order.
+const defaultEpsilon = 1e-9
+
+// Mismatch describes a query whose results differ between the two targets.
+type Mismatch struct {
+	Query string
+	Type  QueryType
+	// Seed regenerates Query with PromQLSmith.WalkInstantQueryWithSeed or
+	// PromQLSmith.WalkRangeQueryWithSeed, depending on Type.
+	Seed int64
+	// Start and End are equal for instant queries.
+	Start time.Time
+	End   time.Time
+	Step  time.Duration
+
+	Left  *promql.Result
+	Right *promql.Result
+	// Diff is a human readable diff between the two results.
+	Diff string
+}
+
+func (m Mismatch) String() string {
+	if m.Type == InstantQuery {
+		return fmt.Sprintf("instant query %q (seed %d) at %s returned different results (-left +right):\n%s",
+			m.Query, m.Seed, m.End.Format(time.RFC3339), m.Diff)
+	}
+	return fmt.Sprintf("range query %q (seed %d) from %s to %s step %s returned different results (-left +right):\n%s",
+		m.Query, m.Seed, m.Start.Format(time.RFC3339), m.End.Format(time.RFC3339), m.Step, m.Diff)
+}
+
+// Run generates cfg.Iterations instant and range queries with ps, evaluates
+// them against both targets and returns every query with differing results.
+// Queries that fail on both targets are considered equal.
+func Run(ctx context.Context, left, right Target, ps *promqlsmith.PromQLSmith, cfg Config) ([]Mismatch, error) {
+	if cfg.End.Before(cfg.Start) {
+		return nil, errors.New("end time must not be before start time")
+	}
+	cfg = withDefaults(cfg)
+
+	mismatches := make([]Mismatch, 0)
+	for i := 0; i < cfg.Iterations; i++ {
+		expr := ps.WalkInstantQuery()
+		query := expr.String()
+		if m, ok := compare(ctx, InstantQuery, expr, cfg, func(t Target) (promql.Query, error) {
+			return t.Engine.NewInstantQuery(ctx, t.Queryable, cfg.QueryOpts, query, cfg.End)
+		}, left, right); ok {
+			m.Seed = ps.LastSeed()
+			mismatches = append(mismatches, m)
+		}
+		if err := ctx.Err(); err != nil {
+			return mismatches, err
+		}
+
+		expr = ps.WalkRangeQuery()
+		query = expr.String()
+		if m, ok := compare(ctx, RangeQuery, expr, cfg, func(t Target) (promql.Query, error) {
+			return t.Engine.NewRangeQuery(ctx, t.Queryable, cfg.QueryOpts, query, cfg.Start, cfg.End, cfg.Step)
+		}, left, right); ok {
+			m.Seed = ps.LastSeed()
+			mismatches = append(mismatches, m)
+		}
+		if err := ctx.Err(); err != nil {
+			return mismatches, err
+		}
+	}
+	return mismatches, nil
+}
+
+// RunBytes is like Run, but generates a single query from data with
+// PromQLSmith.WalkBytes, which is evaluated as an instant and as a range query.
+// The Seed of mismatches is 0 since the query is regenerated from data instead.
+// cfg.Iterations is ignored. It is meant to be called from fuzz targets, see
+// the difftestfuzz package.
+func RunBytes(ctx context.Context, left, right Target, ps *promqlsmith.PromQLSmith, cfg Config, data []byte) ([]Mismatch, error) {
+	if cfg.End.Before(cfg.Start) {
+		return nil, errors.New("end time must not be before start time")
+	}
+	cfg = withDefaults(cfg)
+
+	mismatches := make([]Mismatch, 0)
+	expr := ps.WalkBytes(data, parser.ValueTypeVector, parser.ValueTypeScalar)
+	query := expr.String()
+	if m, ok := compare(ctx, InstantQuery, expr, cfg, func(t Target) (promql.Query, error) {
+		return t.Engine.NewInstantQuery(ctx, t.Queryable, cfg.QueryOpts, query, cfg.End)
+	}, left, right); ok {
+		mismatches = append(mismatches, m)
+	}
+	if m, ok := compare(ctx, RangeQuery, expr, cfg, func(t Target) (promql.Query, error) {
+		return t.Engine.NewRangeQuery(ctx, t.Queryable, cfg.QueryOpts, query, cfg.Start, cfg.End, cfg.Step)
+	}, left, right); ok {
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, ctx.Err()
+}
+
+// RunInvalid generates cfg.Iterations invalid queries with ps, evaluates them as
+// instant queries at cfg.End against both targets and returns every query which
+// isn't rejected by both targets with the expected class of error. Error messages
+// are not compared since they differ between implementations. Execution errors
+// require the selected series to have samples at cfg.End.
+func RunInvalid(ctx context.Context, left, right Target, ps *promqlsmith.PromQLSmith, cfg Config) ([]Mismatch, error) {
+	mismatches := make([]Mismatch, 0)
+	for i := 0; i < cfg.Iterations; i++ {
+		query := ps.WalkInvalidQuery()
+		newQuery := func(t Target) (promql.Query, error) {
+			return t.Engine.NewInstantQuery(ctx, t.Queryable, cfg.QueryOpts, query.Query, cfg.End)
+		}
+		l, lclass := execClass(ctx, left, newQuery)
+		r, rclass := execClass(ctx, right, newQuery)
+		expected := errorClasses[query.Kind.ErrorClass()]
+		if lclass != expected || rclass != expected {
+			mismatches = append(mismatches, Mismatch{
+				Query: query.Query,
+				Type:  InstantQuery,
+				Seed:  ps.LastSeed(),
+				Start: cfg.End,
+				End:   cfg.End,
+				Left:  l,
+				Right: r,
+				Diff: fmt.Sprintf("expected %s for %s query, left: %s %q, right: %s %q",
+					expected, query.Kind, lclass, errString(l.Err), rclass, errString(r.Err)),
+			})
+		}
+		if err := ctx.Err(); err != nil {
+			return mismatches, err
+		}
+	}
+	return mismatches, nil
+}
+
+// resultClass is how the execution of a query ended.
+type resultClass int
+
+const (
+	noError resultClass = iota
+	parseError
+	executionError
+)
+
+// errorClasses are the result classes of the error classes of invalid queries.
+var errorClasses = map[promqlsmith.ErrorClass]resultClass{
+	promqlsmith.ParseError:     parseError,
+	promqlsmith.ExecutionError: executionError,
+}
+
+func (c resultClass) String() string {
+	switch c {
+	case noError:
+		return "no error"
+	case parseError:
+		return "parse error"
+	case executionError:
+		return "execution error"
+	default:
+		return fmt.Sprintf("resultClass(%d)", int(c))
+	}
+}
+
+// execClass runs the query on the target and returns its result along with the
+// class of its error, or noError if it succeeded.
+func execClass(ctx context.Context, t Target, newQuery func(Target) (promql.Query, error)) (*promql.Result, resultClass) {
+	q, err := newQuery(t)
+	if err != nil {
+		return &promql.Result{Err: err}, parseError
+	}
+	defer q.Close()
+	res := cloneResult(q.Exec(ctx))
+	if res.Err != nil {
+		return res, executionError
+	}
+	return res, noError
+}
+
+func withDefaults(cfg Config) Config {
+	if cfg.Step == 0 {
+		cfg.Step = 30 * time.Second
+	}
+	if cfg.Epsilon == 0 {
+		cfg.Epsilon = defaultEpsilon
+	}
+	return cfg
+}
+
+// compare executes the query of expr created by newQuery on both targets and
+// returns a mismatch if the results differ.
+func compare(ctx context.Context, typ QueryType, expr parser.Expr, cfg Config, newQuery func(Target) (promql.Query, error), left, right Target) (Mismatch, bool) {
+	l, closeLeft := exec(ctx, left, newQuery)
+	defer closeLeft()
+	r, closeRight := exec(ctx, right, newQuery)
+	defer closeRight()
+
+	diff := comparator.Comparator{Epsilon: cfg.Epsilon}.Compare(expr, l, r)
+	if diff.Equal() {
+		return Mismatch{}, false
+	}
+	// Results are only valid until the query is closed.
+	return newMismatch(typ, expr, cfg, cloneResult(l), cloneResult(r), diff.String()), true
+}
+
+func newMismatch(typ QueryType, expr parser.Expr, cfg Config, left, right *promql.Result, diff string) Mismatch {
+	m := Mismatch{
+		Query: expr.String(),
+		Type:  typ,
+		Start: cfg.Start,
+		End:   cfg.End,
+		Step:  cfg.Step,
+		Left:  left,
+		Right: right,
+		Diff:  diff,
+	}
+	if typ == InstantQuery {
+		m.Start, m.Step = cfg.End, 0
+	}
+	return m
+}
+
+// exec runs the query on the target. The returned function closes the query,
+// after which the result must no longer be used.
+func exec(ctx context.Context, t Target, newQuery func(Target) (promql.Query, error)) (*promql.Result, func()) {
+	q, err := newQuery(t)
+	if err != nil {
+		return &promql.Result{Err: err}, func() {}
+	}
+	return q.Exec(ctx), q.Close
+}
+
+func cloneResult(r *promql.Result) *promql.Result {
+	out := *r
+	switch v := r.Value.(type) {
+	case promql.Vector:
+		vec := make(promql.Vector, len(v))
+		for i, s := range v {
+			vec[i] = s
+			if s.H != nil {
+				vec[i].H = s.H.Copy()
+			}
+		}
+		out.Value = vec
+	case promql.Matrix:
+		mat := make(promql.Matrix, len(v))
+		for i, s := range v {
+			mat[i] = s
+			mat[i].Floats = slices.Clone(s.Floats)
+			mat[i].Histograms = slices.Clone(s.Histograms)
+			for j, p := range mat[i].Histograms {
+				mat[i].Histograms[j].H = p.H.Copy()
+			}
+		}
+		out.Value = mat
+	}
+	return &out
+}
+
+// Diff returns a human readable diff between two query results, or an empty
+// string if they are equal, ignoring the order of series. Results that both
+// failed are equal.
+func Diff(left, right *promql.Result) string {
+	return comparator.Comparator{Epsilon: defaultEpsilon}.Compare(nil, left, right).String()
+}
+
+func errString(err error) string {
+	if err == nil {
+		return "<nil>"
+	}
+	return err.Error()
+}
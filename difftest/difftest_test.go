@@ -0,0 +1,211 @@
+package difftest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/promql/promqltest"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/promqlsmith"
+)
+
+func TestRun(t *testing.T) {
+	load := `load 30s
+http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+http_requests_total{pod="nginx-3", series="3"} 6+0.8x60
+http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
+`
+	st := promqltest.LoadedStorage(t, load)
+	t.Cleanup(func() { st.Close() })
+	series := getSeries(t, st)
+
+	opts := promql.EngineOpts{
+		Timeout:              time.Minute,
+		LookbackDelta:        5 * time.Minute,
+		EnableAtModifier:     true,
+		EnableNegativeOffset: true,
+		MaxSamples:           5000000,
+	}
+	engine := promql.NewEngine(opts)
+	start := time.Unix(0, 0)
+	end := start.Add(30 * time.Minute)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ps := promqlsmith.New(rnd, series,
+		promqlsmith.WithEnableOffset(true),
+		promqlsmith.WithEnableAtModifier(true),
+		promqlsmith.WithAtModifierMaxTimestamp(end.UnixMilli()),
+		// topk and bottomk pick series randomly on ties so even the same engine
+		// can return different results.
+		promqlsmith.WithEnabledAggrs([]parser.ItemType{
+			parser.SUM, parser.MIN, parser.MAX, parser.AVG, parser.COUNT, parser.GROUP,
+			parser.STDDEV, parser.STDVAR, parser.QUANTILE, parser.COUNT_VALUES,
+		}),
+	)
+
+	target := Target{Engine: engine, Queryable: st}
+	mismatches, err := Run(context.Background(), target, target, ps, Config{
+		Iterations: 20,
+		Start:      start,
+		End:        end,
+	})
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+
+	_, err = Run(context.Background(), target, target, ps, Config{Start: end, End: start})
+	require.Error(t, err)
+}
+
+func TestRunBytes(t *testing.T) {
+	load := `load 30s
+http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+`
+	st := promqltest.LoadedStorage(t, load)
+	t.Cleanup(func() { st.Close() })
+
+	engine := promql.NewEngine(promql.EngineOpts{Timeout: time.Minute, LookbackDelta: 5 * time.Minute, MaxSamples: 5000000})
+	target := Target{Engine: engine, Queryable: st}
+	ps := promqlsmith.New(rand.New(rand.NewSource(0)), getSeries(t, st))
+	start := time.Unix(0, 0)
+	end := start.Add(20 * time.Minute)
+	for _, data := range [][]byte{{}, {0, 0, 0, 3, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff}} {
+		mismatches, err := RunBytes(context.Background(), target, target, ps, Config{Start: start, End: end}, data)
+		require.NoError(t, err)
+		require.Empty(t, mismatches)
+	}
+
+	_, err := RunBytes(context.Background(), target, target, ps, Config{Start: end, End: start}, nil)
+	require.Error(t, err)
+}
+
+func TestRunInvalid(t *testing.T) {
+	load := `load 30s
+http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+up{pod="nginx-1"} 1x40
+up{pod="nginx-2"} 1x40
+`
+	st := promqltest.LoadedStorage(t, load)
+	t.Cleanup(func() { st.Close() })
+	empty := promqltest.LoadedStorage(t, "")
+	t.Cleanup(func() { empty.Close() })
+
+	engine := promqltest.NewTestEngine(t, false, 0, promqltest.DefaultMaxSamplesPerQuery)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ps := promqlsmith.New(rnd, getSeries(t, st))
+	cfg := Config{Iterations: 50, End: time.Unix(0, 0).Add(10 * time.Minute)}
+
+	target := Target{Engine: engine, Queryable: st}
+	mismatches, err := RunInvalid(context.Background(), target, target, ps, cfg)
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+
+	// Queries with execution errors succeed without samples.
+	mismatches, err = RunInvalid(context.Background(), target, Target{Engine: engine, Queryable: empty}, ps, cfg)
+	require.NoError(t, err)
+	require.NotEmpty(t, mismatches)
+	for _, m := range mismatches {
+		require.Error(t, m.Left.Err)
+		require.NoError(t, m.Right.Err)
+		require.Contains(t, m.Diff, "expected execution error")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	for i, tc := range []struct {
+		left, right *promql.Result
+		equal       bool
+	}{
+		{
+			left:  &promql.Result{Err: errors.New("foo")},
+			right: &promql.Result{Err: errors.New("bar")},
+			equal: true,
+		},
+		{
+			left:  &promql.Result{Err: errors.New("foo")},
+			right: &promql.Result{Value: promql.Vector{}},
+			equal: false,
+		},
+		{
+			left:  &promql.Result{Value: promql.Scalar{T: 1, V: math.NaN()}},
+			right: &promql.Result{Value: promql.Scalar{T: 1, V: math.NaN()}},
+			equal: true,
+		},
+		{
+			left:  &promql.Result{Value: promql.Scalar{T: 1, V: 1}},
+			right: &promql.Result{Value: promql.Vector{}},
+			equal: false,
+		},
+		{
+			left: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "1"), F: 1},
+				{Metric: labels.FromStrings("a", "2"), F: math.NaN()},
+			}},
+			right: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "2"), F: math.NaN(), DropName: true},
+				{Metric: labels.FromStrings("a", "1"), F: 1},
+			}},
+			equal: true,
+		},
+		{
+			left: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "1"), F: 1},
+			}},
+			right: &promql.Result{Value: promql.Vector{
+				{Metric: labels.FromStrings("a", "1"), F: 2},
+			}},
+			equal: false,
+		},
+		{
+			left: &promql.Result{Value: promql.Matrix{
+				{Metric: labels.EmptyLabels(), Floats: []promql.FPoint{{T: 1, F: 1}}, Histograms: []promql.HPoint{}},
+			}},
+			right: &promql.Result{Value: promql.Matrix{
+				{Floats: []promql.FPoint{{T: 1, F: 1}}},
+			}},
+			equal: true,
+		},
+		{
+			left: &promql.Result{Value: promql.Matrix{
+				{Metric: labels.FromStrings("a", "1"), Floats: []promql.FPoint{{T: 1, F: 1}}},
+			}},
+			right: &promql.Result{Value: promql.Matrix{
+				{Metric: labels.FromStrings("a", "2"), Floats: []promql.FPoint{{T: 1, F: 1}}},
+			}},
+			equal: false,
+		},
+	} {
+		t.Run(fmt.Sprintf("test_case_%d", i), func(t *testing.T) {
+			diff := Diff(tc.left, tc.right)
+			if tc.equal {
+				require.Empty(t, diff)
+			} else {
+				require.NotEmpty(t, diff)
+			}
+		})
+	}
+}
+
+func getSeries(t testing.TB, q storage.Queryable) []labels.Labels {
+	querier, err := q.Querier(math.MinInt64, math.MaxInt64)
+	require.NoError(t, err)
+	defer querier.Close()
+	res := make([]labels.Labels, 0)
+	ss := querier.Select(context.Background(), false, nil, labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+"))
+	for ss.Next() {
+		res = append(res, ss.At().Labels())
+	}
+	require.NoError(t, ss.Err())
+	return res
+}
@@ -0,0 +1,29 @@
+// Package difftestfuzz adapts difftest to the fuzz targets of go test -fuzz. It is
+// kept apart from difftest so that importing difftest doesn't import testing.
+package difftestfuzz
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cortexproject/promqlsmith"
+	"github.com/cortexproject/promqlsmith/difftest"
+)
+
+// FuzzFunc returns a function to pass to testing.F.Fuzz which generates a query
+// from the fuzz input with PromQLSmith.WalkBytes, evaluates it as an instant and
+// as a range query against both targets and fails the test if the results differ.
+// Usually left is a reference engine and right is the engine under test. Failing
+// inputs are saved to testdata/fuzz by go test -fuzz so they can be replayed.
+// cfg.Iterations is ignored. The returned function must not be called concurrently.
+func FuzzFunc(left, right difftest.Target, ps *promqlsmith.PromQLSmith, cfg difftest.Config) func(*testing.T, []byte) {
+	return func(t *testing.T, data []byte) {
+		mismatches, err := difftest.RunBytes(context.Background(), left, right, ps, cfg, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range mismatches {
+			t.Errorf("%s query %q returned different results (-left +right):\n%s", m.Type, m.Query, m.Diff)
+		}
+	}
+}
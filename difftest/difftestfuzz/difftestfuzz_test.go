@@ -0,0 +1,74 @@
+package difftestfuzz
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/promql/promqltest"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/promqlsmith"
+	"github.com/cortexproject/promqlsmith/difftest"
+)
+
+// FuzzEngine is an example fuzz target comparing an engine under test with the
+// Prometheus engine. Run it with go test -fuzz FuzzEngine ./difftest/difftestfuzz.
+func FuzzEngine(f *testing.F) {
+	load := `load 30s
+http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+http_requests_total{pod="nginx-3", series="3"} 6+0.8x60
+http_requests_total{pod="nginx-4", series="3"} 5+2.4x50
+`
+	st := promqltest.LoadedStorage(f, load)
+	f.Cleanup(func() { st.Close() })
+
+	opts := promql.EngineOpts{
+		Timeout:              time.Minute,
+		LookbackDelta:        5 * time.Minute,
+		EnableAtModifier:     true,
+		EnableNegativeOffset: true,
+		MaxSamples:           5000000,
+	}
+	reference := difftest.Target{Engine: promql.NewEngine(opts), Queryable: st}
+	// Replace with the engine under test.
+	underTest := difftest.Target{Engine: promql.NewEngine(opts), Queryable: st}
+
+	start := time.Unix(0, 0)
+	end := start.Add(30 * time.Minute)
+	// The random generator is only used by the Walk methods, WalkBytes reads the
+	// fuzz input instead.
+	ps := promqlsmith.New(rand.New(rand.NewSource(0)), getSeries(f, st),
+		promqlsmith.WithEnableOffset(true),
+		promqlsmith.WithEnableAtModifier(true),
+		promqlsmith.WithAtModifierMaxTimestamp(end.UnixMilli()),
+		promqlsmith.WithEnabledAggrs([]parser.ItemType{
+			parser.SUM, parser.MIN, parser.MAX, parser.AVG, parser.COUNT, parser.GROUP,
+			parser.STDDEV, parser.STDVAR, parser.QUANTILE, parser.COUNT_VALUES,
+		}),
+	)
+
+	f.Add([]byte{})
+	f.Add([]byte{0, 0, 0, 3, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(FuzzFunc(reference, underTest, ps, difftest.Config{Start: start, End: end}))
+}
+
+func getSeries(t testing.TB, q storage.Queryable) []labels.Labels {
+	querier, err := q.Querier(math.MinInt64, math.MaxInt64)
+	require.NoError(t, err)
+	defer querier.Close()
+	res := make([]labels.Labels, 0)
+	ss := querier.Select(context.Background(), false, nil, labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+"))
+	for ss.Next() {
+		res = append(res, ss.At().Labels())
+	}
+	require.NoError(t, ss.Err())
+	return res
+}
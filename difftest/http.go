@@ -0,0 +1,302 @@
+package difftest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/cortexproject/promqlsmith"
+	"github.com/cortexproject/promqlsmith/comparator"
+)
+
+// HTTPTarget is a Prometheus compatible HTTP API, like Prometheus or Cortex.
+type HTTPTarget struct {
+	// Address is the base URL of the API, like http://localhost:9090 or
+	// http://cortex/prometheus.
+	Address string
+	// Client sends the requests. Defaults to http.DefaultClient. Headers, like the
+	// tenant ID of Cortex, can be added by its transport.
+	Client *http.Client
+}
+
+func (t HTTPTarget) api() (v1.API, error) {
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	c, err := api.NewClient(api.Config{Address: t.Address, Client: client})
+	if err != nil {
+		return nil, fmt.Errorf("create client for %s: %w", t.Address, err)
+	}
+	return v1.NewAPI(c), nil
+}
+
+// DiscoverSeries returns the series of the target matching any of the series
+// selectors between start and end, from the /api/v1/series endpoint. The series
+// can be passed to promqlsmith.New.
+func DiscoverSeries(ctx context.Context, t HTTPTarget, matchers []string, start, end time.Time) ([]labels.Labels, error) {
+	a, err := t.api()
+	if err != nil {
+		return nil, err
+	}
+	labelSets, _, err := a.Series(ctx, matchers, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("get series from %s: %w", t.Address, err)
+	}
+	out := make([]labels.Labels, len(labelSets))
+	for i, ls := range labelSets {
+		out[i] = labelSetToLabels(ls)
+	}
+	return out, nil
+}
+
+// RunHTTP is like Run, but evaluates queries through the HTTP APIs of the
+// targets. Queries rejected by a target with a bad_data or execution error have
+// failed results, which are equal on both targets. Other errors, like network
+// errors or timeouts, abort the run. cfg.QueryOpts is ignored.
+func RunHTTP(ctx context.Context, left, right HTTPTarget, ps *promqlsmith.PromQLSmith, cfg Config) ([]Mismatch, error) {
+	if cfg.End.Before(cfg.Start) {
+		return nil, errors.New("end time must not be before start time")
+	}
+	cfg = withDefaults(cfg)
+	l, err := left.api()
+	if err != nil {
+		return nil, err
+	}
+	r, err := right.api()
+	if err != nil {
+		return nil, err
+	}
+
+	mismatches := make([]Mismatch, 0)
+	for i := 0; i < cfg.Iterations; i++ {
+		for _, typ := range []QueryType{InstantQuery, RangeQuery} {
+			var expr parser.Expr
+			if typ == InstantQuery {
+				expr = ps.WalkInstantQuery()
+			} else {
+				expr = ps.WalkRangeQuery()
+			}
+			m, ok, err := compareHTTP(ctx, typ, expr, cfg, l, r)
+			if err != nil {
+				return mismatches, err
+			}
+			if ok {
+				m.Seed = ps.LastSeed()
+				mismatches = append(mismatches, m)
+			}
+		}
+	}
+	return mismatches, nil
+}
+
+// compareHTTP evaluates expr on both APIs and returns a mismatch if the results
+// differ.
+func compareHTTP(ctx context.Context, typ QueryType, expr parser.Expr, cfg Config, left, right v1.API) (Mismatch, bool, error) {
+	l, err := queryHTTP(ctx, typ, expr.String(), cfg, left)
+	if err != nil {
+		return Mismatch{}, false, fmt.Errorf("left: %w", err)
+	}
+	r, err := queryHTTP(ctx, typ, expr.String(), cfg, right)
+	if err != nil {
+		return Mismatch{}, false, fmt.Errorf("right: %w", err)
+	}
+	diff := comparator.Comparator{Epsilon: cfg.Epsilon}.Compare(expr, l, r)
+	if diff.Equal() {
+		return Mismatch{}, false, nil
+	}
+	return newMismatch(typ, expr, cfg, l, r, diff.String()), true, nil
+}
+
+// queryHTTP runs the query with the API. Errors of the query are returned in the
+// result, while other errors are returned as is.
+func queryHTTP(ctx context.Context, typ QueryType, query string, cfg Config, a v1.API) (*promql.Result, error) {
+	var (
+		v   model.Value
+		err error
+	)
+	if typ == InstantQuery {
+		v, _, err = a.Query(ctx, query, cfg.End)
+	} else {
+		v, _, err = a.QueryRange(ctx, query, v1.Range{Start: cfg.Start, End: cfg.End, Step: cfg.Step})
+	}
+	var apiErr *v1.Error
+	if errors.As(err, &apiErr) && (apiErr.Type == v1.ErrBadData || apiErr.Type == v1.ErrExec) {
+		return &promql.Result{Err: err}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s query %q: %w", typ, query, err)
+	}
+	res, err := valueFromAPI(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s query %q: %w", typ, query, err)
+	}
+	return &promql.Result{Value: res}, nil
+}
+
+// valueFromAPI converts a query result of the HTTP API to the value returned by
+// the PromQL engine.
+func valueFromAPI(v model.Value) (parser.Value, error) {
+	switch v := v.(type) {
+	case *model.Scalar:
+		return promql.Scalar{T: int64(v.Timestamp), V: float64(v.Value)}, nil
+	case *model.String:
+		return promql.String{T: int64(v.Timestamp), V: v.Value}, nil
+	case model.Vector:
+		out := make(promql.Vector, len(v))
+		for i, s := range v {
+			out[i] = promql.Sample{Metric: labelSetToLabels(model.LabelSet(s.Metric)), T: int64(s.Timestamp), F: float64(s.Value)}
+			if s.Histogram != nil {
+				h, err := histogramFromAPI(s.Histogram)
+				if err != nil {
+					return nil, err
+				}
+				out[i].F, out[i].H = 0, h
+			}
+		}
+		return out, nil
+	case model.Matrix:
+		out := make(promql.Matrix, len(v))
+		for i, s := range v {
+			out[i].Metric = labelSetToLabels(model.LabelSet(s.Metric))
+			for _, p := range s.Values {
+				out[i].Floats = append(out[i].Floats, promql.FPoint{T: int64(p.Timestamp), F: float64(p.Value)})
+			}
+			for _, p := range s.Histograms {
+				h, err := histogramFromAPI(p.Histogram)
+				if err != nil {
+					return nil, err
+				}
+				out[i].Histograms = append(out[i].Histograms, promql.HPoint{T: int64(p.Timestamp), H: h})
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unsupported result type %s", v.Type())
+}
+
+func labelSetToLabels(ls model.LabelSet) labels.Labels {
+	b := labels.NewScratchBuilder(len(ls))
+	for k, v := range ls {
+		b.Add(string(k), string(v))
+	}
+	b.Sort()
+	return b.Labels()
+}
+
+// histogramFromAPI rebuilds a native histogram from the buckets returned by the
+// HTTP API, which only have their boundaries. The schema is the lowest one whose
+// bucket boundaries include the boundaries of all buckets, from which the bucket
+// indexes are derived. Empty buckets are not returned by the API so each span has
+// a single bucket. Native histograms with custom buckets are not supported.
+func histogramFromAPI(h *model.SampleHistogram) (*histogram.FloatHistogram, error) {
+	out := &histogram.FloatHistogram{Count: float64(h.Count), Sum: float64(h.Sum)}
+	var positive, negative []model.HistogramBucket
+	for _, b := range h.Buckets {
+		switch {
+		case b.Lower == -b.Upper:
+			out.ZeroThreshold, out.ZeroCount = float64(b.Upper), float64(b.Count)
+		case b.Lower >= 0:
+			positive = append(positive, *b)
+		default:
+			negative = append(negative, *b)
+		}
+	}
+
+	// The bounds closest to zero are clipped to the zero threshold, which is unknown
+	// if the zero bucket is empty, so the schema must fit the other bounds.
+	bounds := make([]float64, 0, len(positive)+len(negative))
+	inner := make([]float64, 0, len(positive)+len(negative))
+	for _, b := range positive {
+		bounds = append(bounds, float64(b.Upper))
+		if float64(b.Lower) > out.ZeroThreshold {
+			inner = append(inner, float64(b.Lower))
+		}
+	}
+	for _, b := range negative {
+		bounds = append(bounds, -float64(b.Lower))
+		if -float64(b.Upper) > out.ZeroThreshold {
+			inner = append(inner, -float64(b.Upper))
+		}
+	}
+	schema, ok := histogramSchema(append(inner, bounds...))
+	if !ok {
+		schema, ok = histogramSchema(bounds)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unsupported bucket boundaries of histogram %s", h)
+	}
+	out.Schema = schema
+	out.PositiveSpans, out.PositiveBuckets = histogramBuckets(positive, schema, func(b model.HistogramBucket) float64 { return float64(b.Upper) })
+	out.NegativeSpans, out.NegativeBuckets = histogramBuckets(negative, schema, func(b model.HistogramBucket) float64 { return -float64(b.Lower) })
+	return out, nil
+}
+
+// histogramSchema returns the lowest schema having all bounds as bucket boundaries,
+// or schema 0 if there are no bounds.
+func histogramSchema(bounds []float64) (int32, bool) {
+	if len(bounds) == 0 {
+		return 0, true
+	}
+	for schema := histogram.ExponentialSchemaMin; schema <= histogram.ExponentialSchemaMax; schema++ {
+		ok := true
+		for _, b := range bounds {
+			if _, ok = bucketIndex(b, schema); !ok {
+				break
+			}
+		}
+		if ok {
+			return schema, true
+		}
+	}
+	return 0, false
+}
+
+// bucketIndex returns the index of the bucket whose upper bound is bound.
+func bucketIndex(bound float64, schema int32) (int32, bool) {
+	if bound <= 0 || math.IsInf(bound, 0) || math.IsNaN(bound) {
+		return 0, false
+	}
+	perPowerOfTwo := math.Exp2(float64(schema))
+	idx := math.Round(math.Log2(bound) * perPowerOfTwo)
+	return int32(idx), math.Abs(math.Exp2(idx/perPowerOfTwo)-bound) <= 1e-9*bound
+}
+
+func histogramBuckets(buckets []model.HistogramBucket, schema int32, bound func(model.HistogramBucket) float64) ([]histogram.Span, []float64) {
+	if len(buckets) == 0 {
+		return nil, nil
+	}
+	type indexedBucket struct {
+		idx   int32
+		count float64
+	}
+	indexed := make([]indexedBucket, len(buckets))
+	for i, b := range buckets {
+		idx, _ := bucketIndex(bound(b), schema)
+		indexed[i] = indexedBucket{idx: idx, count: float64(b.Count)}
+	}
+	sort.Slice(indexed, func(i, j int) bool { return indexed[i].idx < indexed[j].idx })
+
+	spans := make([]histogram.Span, len(indexed))
+	counts := make([]float64, len(indexed))
+	for i, b := range indexed {
+		spans[i] = histogram.Span{Offset: b.idx, Length: 1}
+		if i > 0 {
+			spans[i].Offset = b.idx - indexed[i-1].idx - 1
+		}
+		counts[i] = b.count
+	}
+	return spans, counts
+}
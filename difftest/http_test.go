@@ -0,0 +1,355 @@
+package difftest
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/promql/promqltest"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cortexproject/promqlsmith"
+	"github.com/cortexproject/promqlsmith/comparator"
+)
+
+const httpTestLoad = `load 30s
+http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+http_requests_total{pod="nginx-3", series="3"} 6+0.8x60
+up{pod="nginx-1"} 1x60
+`
+
+func TestDiscoverSeries(t *testing.T) {
+	st := promqltest.LoadedStorage(t, httpTestLoad)
+	t.Cleanup(func() { st.Close() })
+	srv := newAPIServer(t, newTestEngine(), st)
+
+	start := time.Unix(0, 0)
+	series, err := DiscoverSeries(context.Background(), HTTPTarget{Address: srv.URL}, []string{`{__name__=~".+"}`}, start, start.Add(time.Hour))
+	require.NoError(t, err)
+	require.ElementsMatch(t, getSeries(t, st), series)
+
+	series, err = DiscoverSeries(context.Background(), HTTPTarget{Address: srv.URL}, []string{`up`}, start, start.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, []labels.Labels{labels.FromStrings(labels.MetricName, "up", "pod", "nginx-1")}, series)
+
+	_, err = DiscoverSeries(context.Background(), HTTPTarget{Address: srv.URL}, []string{`{`}, start, start.Add(time.Hour))
+	require.Error(t, err)
+}
+
+func TestRunHTTP(t *testing.T) {
+	st := promqltest.LoadedStorage(t, httpTestLoad)
+	t.Cleanup(func() { st.Close() })
+	engine := newTestEngine()
+	left := HTTPTarget{Address: newAPIServer(t, engine, st).URL}
+	right := HTTPTarget{Address: newAPIServer(t, engine, st).URL}
+
+	start := time.Unix(0, 0)
+	end := start.Add(30 * time.Minute)
+	series, err := DiscoverSeries(context.Background(), left, []string{`{__name__=~".+"}`}, start, end)
+	require.NoError(t, err)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ps := promqlsmith.New(rnd, series,
+		promqlsmith.WithEnableOffset(true),
+		promqlsmith.WithEnableAtModifier(true),
+		promqlsmith.WithAtModifierMaxTimestamp(end.UnixMilli()),
+		// topk and bottomk pick series randomly on ties so even the same engine
+		// can return different results.
+		promqlsmith.WithEnabledAggrs([]parser.ItemType{
+			parser.SUM, parser.MIN, parser.MAX, parser.AVG, parser.COUNT, parser.GROUP,
+			parser.STDDEV, parser.STDVAR, parser.QUANTILE, parser.COUNT_VALUES,
+		}),
+	)
+
+	cfg := Config{Iterations: 20, Start: start, End: end}
+	mismatches, err := RunHTTP(context.Background(), left, right, ps, cfg)
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+
+	_, err = RunHTTP(context.Background(), left, right, ps, Config{Start: end, End: start})
+	require.Error(t, err)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+	}))
+	t.Cleanup(failing.Close)
+	_, err = RunHTTP(context.Background(), left, HTTPTarget{Address: failing.URL}, ps, cfg)
+	require.Error(t, err)
+}
+
+func TestRunHTTPMismatch(t *testing.T) {
+	st := promqltest.LoadedStorage(t, httpTestLoad)
+	t.Cleanup(func() { st.Close() })
+	other := promqltest.LoadedStorage(t, `load 30s
+http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+`)
+	t.Cleanup(func() { other.Close() })
+	engine := newTestEngine()
+	left, err := HTTPTarget{Address: newAPIServer(t, engine, st).URL}.api()
+	require.NoError(t, err)
+	right, err := HTTPTarget{Address: newAPIServer(t, engine, other).URL}.api()
+	require.NoError(t, err)
+
+	start := time.Unix(0, 0)
+	cfg := withDefaults(Config{Start: start, End: start.Add(10 * time.Minute)})
+	for _, tc := range []struct {
+		query    string
+		expr     parser.Expr
+		mismatch bool
+		diff     string
+	}{
+		{query: `sum(http_requests_total{series!="3"})`},
+		{query: `sum(http_requests_total)`, mismatch: true, diff: "  + 71 @ 600000\n"},
+		{query: `http_requests_total{pod="nginx-3"}`, mismatch: true, diff: `{__name__="http_requests_total", pod="nginx-3", series="3"}`},
+		{query: `1`},
+		// Both targets reject the queries.
+		{expr: &parser.Call{Func: parser.Functions["abs"]}},
+		{query: `label_replace(http_requests_total{series!="3"}, "pod", "x", "", "")`},
+	} {
+		expr := tc.expr
+		if expr == nil {
+			expr, err = parser.ParseExpr(tc.query)
+			require.NoError(t, err)
+		}
+		for _, typ := range []QueryType{InstantQuery, RangeQuery} {
+			m, ok, err := compareHTTP(context.Background(), typ, expr, cfg, left, right)
+			require.NoError(t, err)
+			require.Equal(t, tc.mismatch, ok, "%s %s: %s", typ, tc.query, m.Diff)
+			require.Contains(t, m.Diff, tc.diff)
+		}
+	}
+}
+
+func TestHistogramFromAPI(t *testing.T) {
+	for _, h := range []*histogram.FloatHistogram{
+		{Count: 0, Sum: 0},
+		{
+			Schema: 0, Count: 10, Sum: 20,
+			PositiveSpans:   []histogram.Span{{Offset: 0, Length: 4}},
+			PositiveBuckets: []float64{1, 0, 3, 6},
+		},
+		{
+			Schema: 3, Count: 15, Sum: -5, ZeroThreshold: 0.001, ZeroCount: 2,
+			PositiveSpans:   []histogram.Span{{Offset: -2, Length: 2}, {Offset: 5, Length: 1}},
+			PositiveBuckets: []float64{1, 2, 3},
+			NegativeSpans:   []histogram.Span{{Offset: 1, Length: 3}},
+			NegativeBuckets: []float64{4, 0, 3},
+		},
+		{
+			Schema: -2, Count: 3, Sum: 100, ZeroThreshold: 1, ZeroCount: 1,
+			PositiveSpans:   []histogram.Span{{Offset: 1, Length: 1}},
+			PositiveBuckets: []float64{2},
+		},
+		{
+			Schema: 8, Count: 2, Sum: 1,
+			NegativeSpans:   []histogram.Span{{Offset: -100, Length: 1}},
+			NegativeBuckets: []float64{2},
+		},
+	} {
+		t.Run(h.String(), func(t *testing.T) {
+			out, err := histogramFromAPI(histogramToAPI(h))
+			require.NoError(t, err)
+			diff := comparator.Comparator{}.Compare(nil,
+				&promql.Result{Value: promql.Vector{{H: h}}},
+				&promql.Result{Value: promql.Vector{{H: out}}},
+			)
+			require.True(t, diff.Equal(), diff.String())
+		})
+	}
+
+	_, err := histogramFromAPI(&model.SampleHistogram{Count: 2, Sum: 2, Buckets: model.HistogramBuckets{
+		{Boundaries: 0, Lower: 1, Upper: 5, Count: 1},
+		{Boundaries: 0, Lower: 5, Upper: 7, Count: 1},
+	}})
+	require.Error(t, err)
+}
+
+func newTestEngine() *promql.Engine {
+	return promql.NewEngine(promql.EngineOpts{
+		Timeout:              time.Minute,
+		LookbackDelta:        5 * time.Minute,
+		EnableAtModifier:     true,
+		EnableNegativeOffset: true,
+		MaxSamples:           5000000,
+	})
+}
+
+// newAPIServer serves the series, instant query and range query endpoints of the
+// Prometheus HTTP API from the storage.
+func newAPIServer(t *testing.T, engine *promql.Engine, q storage.Queryable) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		querier, err := q.Querier(math.MinInt64, math.MaxInt64)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal", err)
+			return
+		}
+		defer querier.Close()
+		out := make([]model.LabelSet, 0)
+		for _, match := range r.Form["match[]"] {
+			matchers, err := parser.ParseMetricSelector(match)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "bad_data", err)
+				return
+			}
+			ss := querier.Select(r.Context(), false, nil, matchers...)
+			for ss.Next() {
+				ls := model.LabelSet{}
+				ss.At().Labels().Range(func(l labels.Label) {
+					ls[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+				})
+				out = append(out, ls)
+			}
+		}
+		writeAPIData(w, out)
+	})
+	query := func(w http.ResponseWriter, r *http.Request, newQuery func() (promql.Query, error)) {
+		qry, err := newQuery()
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		defer qry.Close()
+		res := qry.Exec(r.Context())
+		if res.Err != nil {
+			writeAPIError(w, http.StatusUnprocessableEntity, "execution", res.Err)
+			return
+		}
+		v := valueToAPI(res.Value)
+		writeAPIData(w, map[string]any{"resultType": v.Type(), "result": v})
+	}
+	mux.HandleFunc("/api/v1/query", func(w http.ResponseWriter, r *http.Request) {
+		query(w, r, func() (promql.Query, error) {
+			ts, err := parseAPITime(r.FormValue("time"))
+			if err != nil {
+				return nil, err
+			}
+			return engine.NewInstantQuery(r.Context(), q, nil, r.FormValue("query"), ts)
+		})
+	})
+	mux.HandleFunc("/api/v1/query_range", func(w http.ResponseWriter, r *http.Request) {
+		query(w, r, func() (promql.Query, error) {
+			start, err := parseAPITime(r.FormValue("start"))
+			if err != nil {
+				return nil, err
+			}
+			end, err := parseAPITime(r.FormValue("end"))
+			if err != nil {
+				return nil, err
+			}
+			step, err := strconv.ParseFloat(r.FormValue("step"), 64)
+			if err != nil {
+				return nil, err
+			}
+			return engine.NewRangeQuery(r.Context(), q, nil, r.FormValue("query"), start, end, time.Duration(step*float64(time.Second)))
+		})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func parseAPITime(s string) (time.Time, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(int64(math.Round(f * 1000))), nil
+}
+
+func writeAPIData(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "success", "data": data})
+}
+
+func writeAPIError(w http.ResponseWriter, code int, typ string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": "error", "errorType": typ, "error": err.Error()})
+}
+
+// valueToAPI converts a query result to the value returned by the HTTP API.
+func valueToAPI(v parser.Value) model.Value {
+	switch v := v.(type) {
+	case promql.Scalar:
+		return &model.Scalar{Timestamp: model.Time(v.T), Value: model.SampleValue(v.V)}
+	case promql.String:
+		return &model.String{Timestamp: model.Time(v.T), Value: v.V}
+	case promql.Vector:
+		out := make(model.Vector, len(v))
+		for i, s := range v {
+			out[i] = &model.Sample{Metric: metricToAPI(s.Metric), Timestamp: model.Time(s.T), Value: model.SampleValue(s.F)}
+			if s.H != nil {
+				out[i].Histogram = histogramToAPI(s.H)
+			}
+		}
+		return out
+	case promql.Matrix:
+		out := make(model.Matrix, len(v))
+		for i, s := range v {
+			out[i] = &model.SampleStream{Metric: metricToAPI(s.Metric)}
+			for _, p := range s.Floats {
+				out[i].Values = append(out[i].Values, model.SamplePair{Timestamp: model.Time(p.T), Value: model.SampleValue(p.F)})
+			}
+			for _, p := range s.Histograms {
+				out[i].Histograms = append(out[i].Histograms, model.SampleHistogramPair{Timestamp: model.Time(p.T), Histogram: histogramToAPI(p.H)})
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func metricToAPI(lbls labels.Labels) model.Metric {
+	m := model.Metric{}
+	lbls.Range(func(l labels.Label) {
+		m[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	})
+	return m
+}
+
+// histogramToAPI converts a native histogram like the HTTP API of Prometheus,
+// which skips empty buckets.
+func histogramToAPI(h *histogram.FloatHistogram) *model.SampleHistogram {
+	out := &model.SampleHistogram{Count: model.FloatString(h.Count), Sum: model.FloatString(h.Sum)}
+	it := h.AllBucketIterator()
+	for it.Next() {
+		b := it.At()
+		if b.Count == 0 {
+			continue
+		}
+		boundaries := int32(2)
+		switch {
+		case b.LowerInclusive && b.UpperInclusive:
+			boundaries = 3
+		case b.LowerInclusive:
+			boundaries = 1
+		case b.UpperInclusive:
+			boundaries = 0
+		}
+		out.Buckets = append(out.Buckets, &model.HistogramBucket{
+			Boundaries: boundaries,
+			Lower:      model.FloatString(b.Lower),
+			Upper:      model.FloatString(b.Upper),
+			Count:      model.FloatString(b.Count),
+		})
+	}
+	return out
+}
@@ -0,0 +1,115 @@
+package promqlsmith
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// Day, Week and Year are the duration units of PromQL longer than an hour.
+	Day  = 24 * time.Hour
+	Week = 7 * Day
+	Year = 365 * Day
+)
+
+// DurationUnits are the units of PromQL duration literals, from ms to y.
+var DurationUnits = []time.Duration{time.Millisecond, time.Second, time.Minute, time.Hour, Day, Week, Year}
+
+// DurationDistribution describes how durations like the range of matrix selectors
+// or offsets are generated.
+type DurationDistribution struct {
+	// Min and Max bound the generated durations. Durations are made of whole
+	// units, so Min is rounded up to the smallest unit if it is not a multiple
+	// of it, unless that exceeds Max.
+	Min time.Duration
+	Max time.Duration
+	// Units are the units generated durations are made of, among DurationUnits.
+	// Units longer than Max are ignored. Defaults to the units which are not
+	// longer than Max.
+	Units []time.Duration
+	// MaxUnits is the maximum number of different units in composite durations
+	// like 1h30m. Defaults to 1.
+	MaxUnits int
+	// ScrapeInterval makes a fourth of the durations shorter than it, ignoring Min.
+	// They still don't exceed Max.
+	ScrapeInterval time.Duration
+	// Step makes a fourth of the durations a multiple of it plus or minus the
+	// smallest unit, so that they are not aligned to the query step. It is
+	// ignored if it is longer than Max.
+	Step time.Duration
+}
+
+// walkDuration generates a positive duration following d.
+func (d DurationDistribution) walkDuration(rnd Rand) time.Duration {
+	units := d.units()
+	smallest := units[len(units)-1]
+	switch {
+	case d.ScrapeInterval > smallest && smallest <= d.Max && rnd.Intn(4) == 0:
+		return time.Duration(rnd.Int63n(int64(min(d.ScrapeInterval-1, d.Max)/smallest))+1) * smallest
+	case d.Step > 0 && d.Step <= d.Max && rnd.Intn(4) == 0:
+		// The multiple of the step is at most the largest one not exceeding Max, and
+		// it is only moved past the step when it stays within Max.
+		out := time.Duration(rnd.Int63n(int64(d.Max/d.Step))+1) * d.Step
+		switch {
+		case rnd.Intn(2) == 0 && out > smallest:
+			out -= smallest
+		case out+smallest <= d.Max:
+			out += smallest
+		}
+		return out
+	}
+
+	target := d.Min
+	if d.Max > d.Min {
+		target += time.Duration(rnd.Int63n(int64(d.Max - d.Min + 1)))
+	}
+	// Pick the units of the duration, longest first.
+	n := 1
+	if d.MaxUnits > 1 {
+		n = rnd.Intn(min(d.MaxUnits, len(units))) + 1
+	}
+	picked := make([]time.Duration, 0, n)
+	for _, i := range perm(rnd, len(units))[:n] {
+		picked = append(picked, units[i])
+	}
+	sort.Slice(picked, func(i, j int) bool { return picked[i] > picked[j] })
+
+	var out time.Duration
+	remaining := target
+	for i, unit := range picked {
+		count := remaining / unit
+		if i < len(picked)-1 && count > 0 {
+			count = time.Duration(rnd.Int63n(int64(count) + 1))
+		}
+		out += count * unit
+		remaining -= count * unit
+	}
+	if out < d.Min || out <= 0 {
+		out += ((max(d.Min-out, 1) + smallest - 1) / smallest) * smallest
+	}
+	// Rounding up to the smallest unit may exceed Max, in which case the largest
+	// multiple of it within Max is used instead.
+	if out > d.Max && d.Max >= smallest {
+		out = d.Max / smallest * smallest
+	}
+	return out
+}
+
+// units returns the allowed units from the longest to the shortest.
+func (d DurationDistribution) units() []time.Duration {
+	units := make([]time.Duration, 0, len(DurationUnits))
+	for _, u := range d.Units {
+		if u > 0 && u <= d.Max {
+			units = append(units, u)
+		}
+	}
+	if len(units) == 0 {
+		for _, u := range DurationUnits {
+			if u <= d.Max || len(units) == 0 {
+				units = append(units, u)
+			}
+		}
+	}
+	sort.Slice(units, func(i, j int) bool { return units[i] > units[j] })
+	return units
+}
@@ -0,0 +1,124 @@
+package promqlsmith
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkDuration(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	for i, d := range []DurationDistribution{
+		{Min: time.Second, Max: time.Hour},
+		{Min: 1500 * time.Millisecond, Max: 2 * time.Second, Units: []time.Duration{time.Second}},
+		{Min: time.Minute, Max: 2 * Year, MaxUnits: 3},
+		{Max: 10 * time.Millisecond},
+	} {
+		units := d.units()
+		for j := 0; j < 100; j++ {
+			out := d.walkDuration(rnd)
+			require.Greater(t, out, time.Duration(0), "case %d", i)
+			require.GreaterOrEqual(t, out, d.Min, "case %d", i)
+			require.LessOrEqual(t, out, d.Max, "case %d", i)
+			require.Zero(t, out%units[len(units)-1], "case %d", i)
+		}
+	}
+}
+
+func TestWalkDurationWithinMax(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	for i, d := range []DurationDistribution{
+		// Rounding Min up to the smallest unit exceeds Max.
+		{Min: 1500 * time.Millisecond, Max: 1900 * time.Millisecond, Units: []time.Duration{time.Second}},
+		// Units longer than Max.
+		{Min: time.Minute, Max: time.Hour, Units: []time.Duration{Day, time.Minute}},
+		{Min: time.Minute, Max: time.Hour, Units: []time.Duration{Week}},
+		// ScrapeInterval longer than Max.
+		{Min: time.Second, Max: 10 * time.Second, Units: []time.Duration{time.Second}, ScrapeInterval: time.Minute},
+	} {
+		units := d.units()
+		for j := 0; j < 200; j++ {
+			out := d.walkDuration(rnd)
+			require.Greater(t, out, time.Duration(0), "case %d", i)
+			require.LessOrEqual(t, out, d.Max, "case %d", i)
+			require.Zero(t, out%units[len(units)-1], "case %d", i)
+		}
+	}
+}
+
+func TestWalkDurationComposite(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	d := DurationDistribution{Min: time.Hour, Max: Week, Units: []time.Duration{time.Hour, time.Minute}, MaxUnits: 2}
+	composite := false
+	for i := 0; i < 100; i++ {
+		out := d.walkDuration(rnd)
+		require.Zero(t, out%time.Minute)
+		if out%time.Hour != 0 && out > time.Hour {
+			composite = true
+		}
+	}
+	require.True(t, composite)
+}
+
+func TestWalkDurationScrapeIntervalAndStep(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	d := DurationDistribution{Min: time.Minute, Max: time.Hour, Units: []time.Duration{time.Second}, ScrapeInterval: 15 * time.Second, Step: time.Minute}
+	belowScrapeInterval, misaligned := false, false
+	for i := 0; i < 200; i++ {
+		out := d.walkDuration(rnd)
+		require.Greater(t, out, time.Duration(0))
+		if out < d.ScrapeInterval {
+			belowScrapeInterval = true
+		}
+		if out%d.Step == time.Second || out%d.Step == d.Step-time.Second {
+			misaligned = true
+		}
+	}
+	require.True(t, belowScrapeInterval)
+	require.True(t, misaligned)
+}
+
+func TestWalkDurationStepWithinMax(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	// Max is not a multiple of Step, and adding the smallest unit to the largest
+	// multiple of Step, or to Step itself, exceeds it.
+	for _, step := range []time.Duration{70 * time.Second, 200 * time.Second} {
+		d := DurationDistribution{Min: time.Minute, Max: 150 * time.Second, Units: []time.Duration{time.Minute}, Step: step}
+		for i := 0; i < 200; i++ {
+			out := d.walkDuration(rnd)
+			require.Greater(t, out, time.Duration(0), "step %s", step)
+			require.LessOrEqual(t, out, d.Max, "step %s", step)
+		}
+	}
+}
+
+func TestWalkRangeAndOffsetDurations(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet,
+		WithEnableOffset(true),
+		WithOffsetProbability(1),
+		WithRangeDurations(DurationDistribution{Min: time.Millisecond, Max: Week, MaxUnits: 3}),
+		WithOffsetDurations(DurationDistribution{Min: time.Second, Max: Year, Units: []time.Duration{Day, Year}}),
+	)
+	for i := 0; i < 100; i++ {
+		expr := ps.walkMatrixSelector()
+		ms := expr.(*parser.MatrixSelector)
+		require.Greater(t, ms.Range, time.Duration(0))
+		require.LessOrEqual(t, ms.Range, Week)
+		offset := ms.VectorSelector.(*parser.VectorSelector).OriginalOffset
+		require.Zero(t, offset%Day)
+		require.NotZero(t, offset)
+
+		// The parser converts ranges to float seconds, so long ranges with
+		// milliseconds may be off by a millisecond.
+		parsed, err := parser.ParseExpr(expr.String())
+		require.NoError(t, err, expr.String())
+		require.InDelta(t, ms.Range, parsed.(*parser.MatrixSelector).Range, float64(time.Millisecond), expr.String())
+	}
+	// Composite durations print in the same form PromQL parses.
+	require.Equal(t, "1d2h30m", model.Duration(Day+2*time.Hour+30*time.Minute).String())
+}
@@ -0,0 +1,126 @@
+package promqlsmith
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// durationPlaceholder is the first of the durations set in an expression before
+// printing it, so that they can be found in the printed query and replaced by
+// duration expressions. The following ones are a day longer each, so that they are
+// printed as different numbers of days of the same length, like 36500d1ms. It is
+// longer than the durations PromQLSmith generates.
+const durationPlaceholder = 100*Year + time.Millisecond
+
+// WalkDurationExprQuery generates a query like Walk, whose ranges, subquery steps
+// and offsets are duration expressions like 5m * 2 or (1h + 5m) if enabled with
+// WithEnableDurationExpressions. Duration expressions evaluate to the durations
+// of the expression generated by WalkWithSeed with the same seed, so both queries
+// return the same result. Queries are strings since the parser can't represent
+// duration expressions.
+func (s *PromQLSmith) WalkDurationExprQuery(valueTypes ...parser.ValueType) string {
+	return s.WalkDurationExprQueryWithSeed(s.rnd.Int63(), valueTypes...)
+}
+
+// WalkDurationExprQueryWithSeed is like WalkDurationExprQuery but uses the given seed.
+func (s *PromQLSmith) WalkDurationExprQueryWithSeed(seed int64, valueTypes ...parser.ValueType) (query string) {
+	s.withSeed(seed, func() {
+		expr := s.walkRoot(valueTypes...)
+		if !s.enableDurationExprs {
+			query = expr.String()
+			return
+		}
+		query = s.durationExprString(expr)
+	})
+	return query
+}
+
+type durationReplacement struct {
+	placeholder string
+	expr        string
+}
+
+// durationExprString prints expr with its durations replaced by duration
+// expressions. The durations are set to placeholders before printing, so expr
+// must not be used afterwards.
+func (s *PromQLSmith) durationExprString(expr parser.Expr) string {
+	original := expr.String()
+	replacements := make([]durationReplacement, 0)
+	n := 0
+	replace := func(d *time.Duration, offset bool) {
+		if *d == 0 {
+			return
+		}
+		n++
+		abs := *d
+		if abs < 0 {
+			abs = -abs
+		}
+		placeholder := durationPlaceholder + time.Duration(n-1)*Day
+		r := durationReplacement{
+			placeholder: model.Duration(placeholder).String(),
+			expr:        s.walkDurationExpr(abs),
+		}
+		// Durations are kept if a label value contains their placeholder.
+		if strings.Contains(original, r.placeholder) {
+			return
+		}
+		// Offsets are followed by the rest of the query, so expressions are
+		// parenthesized to be parsed as a single duration.
+		if offset && r.expr != model.Duration(abs).String() {
+			r.expr = "(" + r.expr + ")"
+		}
+		replacements = append(replacements, r)
+		if *d < 0 {
+			placeholder = -placeholder
+		}
+		*d = placeholder
+	}
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			replace(&n.OriginalOffset, true)
+		case *parser.MatrixSelector:
+			replace(&n.Range, false)
+		case *parser.SubqueryExpr:
+			replace(&n.Range, false)
+			replace(&n.Step, false)
+			replace(&n.OriginalOffset, true)
+		}
+		return nil
+	})
+
+	query := expr.String()
+	for _, r := range replacements {
+		query = strings.Replace(query, r.placeholder, r.expr, 1)
+	}
+	return query
+}
+
+// walkDurationExpr generates a duration expression evaluating to d, which is a
+// positive number of milliseconds.
+func (s *PromQLSmith) walkDurationExpr(d time.Duration) string {
+	literal := model.Duration(d).String()
+	switch s.rnd.Intn(5) {
+	case 0:
+		if k := time.Duration(s.rnd.Intn(3) + 2); d%(k*time.Millisecond) == 0 {
+			return fmt.Sprintf("%s * %d", model.Duration(d/k), k)
+		}
+	case 1:
+		if d > time.Millisecond {
+			a := time.Duration(s.rnd.Int63n(int64(d/time.Millisecond-1))+1) * time.Millisecond
+			return fmt.Sprintf("%s + %s", model.Duration(a), model.Duration(d-a))
+		}
+	case 2:
+		unit := DurationUnits[s.rnd.Intn(4)]
+		return fmt.Sprintf("%s - %s", model.Duration(d+unit), model.Duration(unit))
+	case 3:
+		// step() cancels out so that the duration doesn't depend on the query step.
+		return literal + " + step() - step()"
+	}
+	return literal
+}
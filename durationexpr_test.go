@@ -0,0 +1,102 @@
+package promqlsmith
+
+import (
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/require"
+)
+
+// evalDurationExpr evaluates the duration expressions generated by walkDurationExpr,
+// with step() evaluating to step.
+func evalDurationExpr(t *testing.T, expr string, step time.Duration) time.Duration {
+	if strings.HasPrefix(expr, "(") {
+		expr = strings.TrimSuffix(strings.TrimPrefix(expr, "("), ")")
+	}
+	tokens := strings.Split(expr, " ")
+	operand := func(token string) time.Duration {
+		if token == "step()" {
+			return step
+		}
+		if k, err := strconv.Atoi(token); err == nil {
+			return time.Duration(k)
+		}
+		d, err := model.ParseDuration(token)
+		require.NoError(t, err, expr)
+		return time.Duration(d)
+	}
+	out := operand(tokens[0])
+	for i := 1; i+1 < len(tokens); i += 2 {
+		switch v := operand(tokens[i+1]); tokens[i] {
+		case "+":
+			out += v
+		case "-":
+			out -= v
+		case "*":
+			out *= v
+		default:
+			require.Fail(t, "unknown operator", expr)
+		}
+	}
+	return out
+}
+
+func TestWalkDurationExpr(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	p := New(rnd, testSeriesSet)
+	for _, d := range []time.Duration{time.Millisecond, time.Second, 90 * time.Second, time.Hour + 5*time.Minute, Week} {
+		for i := 0; i < 100; i++ {
+			expr := p.walkDurationExpr(d)
+			require.Equal(t, d, evalDurationExpr(t, expr, 0), expr)
+			require.Equal(t, d, evalDurationExpr(t, expr, time.Minute), expr)
+		}
+	}
+}
+
+func TestDurationExprString(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	p := New(rnd, testSeriesSet)
+	// The label value is the placeholder of the first duration.
+	value := model.Duration(durationPlaceholder).String()
+	re := regexp.MustCompile(`^sum_over_time\(rate\(x\{a="` + value + `"\}\[(.+)\] offset -(.+)\)\[(.+):(.+)\] offset (.+)\)$`)
+	for i := 0; i < 100; i++ {
+		expr, err := parser.ParseExpr(`sum_over_time(rate(x{a="` + value + `"}[5m] offset -1h)[10m:1m] offset 2m)`)
+		require.NoError(t, err)
+		query := p.durationExprString(expr)
+		m := re.FindStringSubmatch(query)
+		require.NotNil(t, m, query)
+		// The first duration, the range of the subquery, is kept as a literal.
+		require.Equal(t, "10m", m[3])
+		for j, d := range []time.Duration{5 * time.Minute, time.Hour, 10 * time.Minute, time.Minute, 2 * time.Minute} {
+			require.Equal(t, d, evalDurationExpr(t, m[j+1], time.Minute), query)
+		}
+		require.True(t, m[5] == "2m" || strings.HasPrefix(m[5], "("), query)
+	}
+}
+
+func TestWalkDurationExprQuery(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	opts := []Option{WithEnableOffset(true), WithOffsetProbability(1)}
+	p := New(rnd, testSeriesSet, opts...)
+	enabled := New(rnd, testSeriesSet, append(opts, WithEnableDurationExpressions(true))...)
+	found := false
+	for i := 0; i < 100; i++ {
+		seed := rnd.Int63()
+		// Without the option, queries are the expressions generated with the same seed.
+		require.Equal(t, p.WalkWithSeed(seed, parser.ValueTypeVector).String(), p.WalkDurationExprQueryWithSeed(seed, parser.ValueTypeVector))
+
+		query := enabled.WalkDurationExprQueryWithSeed(seed, parser.ValueTypeVector)
+		// Placeholders are printed as days, which generated durations don't have.
+		require.NotContains(t, query, "d1ms")
+		if query != p.WalkWithSeed(seed, parser.ValueTypeVector).String() {
+			found = true
+		}
+	}
+	require.True(t, found)
+}
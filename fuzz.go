@@ -0,0 +1,54 @@
+package promqlsmith
+
+import (
+	"encoding/binary"
+	"math/rand"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// ByteSource is a rand.Source reading its values from a byte slice instead of
+// generating them, so that the input of a coverage guided fuzzer drives the
+// choices made while generating queries. Every value consumes 4 bytes. Once the
+// bytes are exhausted it returns zeros, which picks the first option of every
+// choice and keeps the rest of the expression shallow.
+type ByteSource struct {
+	data []byte
+}
+
+// NewByteSource returns a source reading its values from data.
+func NewByteSource(data []byte) *ByteSource {
+	return &ByteSource{data: data}
+}
+
+// Uint64 returns the next 4 bytes in both halves of the value, since rand.Rand
+// only uses the high bits for small numbers and the low bits for powers of two.
+func (s *ByteSource) Uint64() uint64 {
+	var b [4]byte
+	n := copy(b[:], s.data)
+	s.data = s.data[n:]
+	v := uint64(binary.BigEndian.Uint32(b[:]))
+	return v<<32 | v
+}
+
+// Int63 returns the next value without its sign bit.
+func (s *ByteSource) Int63() int64 {
+	return int64(s.Uint64() & (1<<63 - 1))
+}
+
+// Seed does nothing since values only depend on the bytes.
+func (s *ByteSource) Seed(int64) {}
+
+// WalkBytes is like Walk but draws every random choice from data with a
+// ByteSource instead of deriving a seed from the generator passed to New, so
+// that the same data always generates the same expression and fuzzers like
+// go test -fuzz can mutate queries a choice at a time. It is meant to be called
+// from fuzz targets:
+//
+//	f.Fuzz(func(t *testing.T, data []byte) {
+//		expr := ps.WalkBytes(data, parser.ValueTypeVector, parser.ValueTypeScalar)
+//		// Evaluate expr with the engine under test.
+//	})
+func (s *PromQLSmith) WalkBytes(data []byte, valueTypes ...parser.ValueType) parser.Expr {
+	return s.WalkRand(rand.New(NewByteSource(data)), valueTypes...)
+}
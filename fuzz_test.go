@@ -0,0 +1,59 @@
+package promqlsmith
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestByteSource(t *testing.T) {
+	src := NewByteSource([]byte{0x80, 0, 0, 1, 0xff})
+	require.Equal(t, uint64(0x8000000180000001), src.Uint64())
+	require.Equal(t, int64(0x7f000000ff000000), src.Int63())
+	require.Equal(t, uint64(0), src.Uint64())
+
+	rnd := rand.New(NewByteSource(nil))
+	require.Equal(t, 0, rnd.Intn(10))
+	require.Equal(t, float64(0), rnd.Float64())
+}
+
+func TestWalkBytes(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet,
+		WithEnableOffset(true),
+		WithEnableAtModifier(true),
+		WithEnableVectorMatching(true),
+	)
+	for _, data := range [][]byte{nil, {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}} {
+		expr := ps.WalkBytes(data, instantQueryValueTypes...)
+		_, err := parser.ParseExpr(expr.String())
+		require.NoError(t, err, expr.String())
+	}
+	for i := 0; i < 100; i++ {
+		data := make([]byte, rnd.Intn(256))
+		rnd.Read(data)
+		expr := ps.WalkBytes(data, vectorAndScalarValueTypes...)
+		_, err := parser.ParseExpr(expr.String())
+		require.NoError(t, err, expr.String())
+		require.Equal(t, expr.String(), ps.WalkBytes(data, vectorAndScalarValueTypes...).String())
+	}
+}
+
+func FuzzWalkBytes(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("sum(rate(http_requests_total[5m]))"))
+	ps := New(rand.New(rand.NewSource(0)), testSeriesSet,
+		WithEnableOffset(true),
+		WithEnableAtModifier(true),
+		WithAtModifierMaxTimestamp(time.Hour.Milliseconds()),
+		WithEnableVectorMatching(true),
+	)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		expr := ps.WalkBytes(data, instantQueryValueTypes...)
+		_, err := parser.ParseExpr(expr.String())
+		require.NoError(t, err, expr.String())
+	})
+}
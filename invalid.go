@@ -0,0 +1,363 @@
+package promqlsmith
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+)
+
+// InvalidQueryKind is the reason why a query generated by WalkInvalidQuery fails.
+type InvalidQueryKind int
+
+const (
+	// InvalidSyntax is a query with a syntax error, like a missing operand or an
+	// unbalanced parenthesis.
+	InvalidSyntax InvalidQueryKind = iota
+	// InvalidType is a query with an argument or operand of the wrong type, like an
+	// instant vector passed to rate.
+	InvalidType
+	// InvalidRegex is a selector with an invalid regular expression.
+	InvalidRegex
+	// InvalidLabelReplaceRegex is a label_replace call with an invalid regular expression.
+	InvalidLabelReplaceRegex
+	// InvalidManyToManyMatching is a binary expression between vectors matching
+	// several series on both sides.
+	InvalidManyToManyMatching
+	// InvalidDuplicateSeries is an expression returning several series with the same
+	// labels, either because the metric name is dropped or because label_replace
+	// removes the labels telling series apart.
+	InvalidDuplicateSeries
+)
+
+var invalidQueryKindNames = map[InvalidQueryKind]string{
+	InvalidSyntax:             "syntax",
+	InvalidType:               "type",
+	InvalidRegex:              "regex",
+	InvalidLabelReplaceRegex:  "label_replace_regex",
+	InvalidManyToManyMatching: "many_to_many_matching",
+	InvalidDuplicateSeries:    "duplicate_series",
+}
+
+func (k InvalidQueryKind) String() string {
+	if name, ok := invalidQueryKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("InvalidQueryKind(%d)", int(k))
+}
+
+// ErrorClass returns the class of the error expected for queries of this kind.
+func (k InvalidQueryKind) ErrorClass() ErrorClass {
+	switch k {
+	case InvalidSyntax, InvalidType, InvalidRegex:
+		return ParseError
+	}
+	return ExecutionError
+}
+
+// ErrorClass tells when an invalid query fails.
+type ErrorClass int
+
+const (
+	// ParseError is returned when the query is parsed, before it is executed.
+	ParseError ErrorClass = iota
+	// ExecutionError is returned when the query is executed. Queries of this class
+	// only fail if the series they select have samples at the evaluation time.
+	ExecutionError
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ParseError:
+		return "parse"
+	case ExecutionError:
+		return "execution"
+	default:
+		return fmt.Sprintf("ErrorClass(%d)", int(c))
+	}
+}
+
+// InvalidQuery is a query which must fail with an error of the class of its kind.
+// Queries are strings since queries failing to parse can't be represented by an
+// expression.
+type InvalidQuery struct {
+	Query string
+	Kind  InvalidQueryKind
+}
+
+// invalidRegexes are regular expressions which fail to compile.
+var invalidRegexes = []string{"(", "[a-", "*a", "a{2,1}", `\x`}
+
+// WalkInvalidQuery generates a query which fails either when it is parsed or
+// when it is executed, which is useful to test error handling. Kinds requiring
+// metrics with several series are only generated if the series set has them.
+func (s *PromQLSmith) WalkInvalidQuery() InvalidQuery {
+	return s.WalkInvalidQueryWithSeed(s.rnd.Int63())
+}
+
+// WalkInvalidQueryWithSeed is like WalkInvalidQuery but uses the given seed.
+func (s *PromQLSmith) WalkInvalidQueryWithSeed(seed int64) (query InvalidQuery) {
+	s.withSeed(seed, func() { query = s.walkInvalidQuery() })
+	return query
+}
+
+func (s *PromQLSmith) walkInvalidQuery() InvalidQuery {
+	names := s.metricsWithSeveralSeries()
+	kinds := []InvalidQueryKind{InvalidSyntax, InvalidType, InvalidRegex, InvalidLabelReplaceRegex}
+	if len(names) > 0 {
+		kinds = append(kinds, InvalidManyToManyMatching, InvalidDuplicateSeries)
+	}
+	kind := kinds[s.rnd.Intn(len(kinds))]
+
+	var query string
+	switch kind {
+	case InvalidSyntax:
+		query = s.walkInvalidSyntax()
+	case InvalidType:
+		query = s.walkInvalidType()
+	case InvalidRegex:
+		query = s.walkInvalidRegex()
+	case InvalidLabelReplaceRegex:
+		query = (&parser.Call{
+			Func: parser.Functions["label_replace"],
+			Args: []parser.Expr{
+				s.walkVectorExpr(s.maxDepth - 1),
+				&parser.StringLiteral{Val: destinationLabel},
+				&parser.StringLiteral{Val: "$1"},
+				&parser.StringLiteral{Val: s.walkLabelName()},
+				&parser.StringLiteral{Val: invalidRegexes[s.rnd.Intn(len(invalidRegexes))]},
+			},
+		}).String()
+	case InvalidManyToManyMatching:
+		query = s.walkManyToManyMatching(names)
+	case InvalidDuplicateSeries:
+		query = s.walkDuplicateSeries(names)
+	}
+	return InvalidQuery{Query: query, Kind: kind}
+}
+
+// walkVectorExpr generates an expression of instant vector type, falling back to a
+// vector selector.
+func (s *PromQLSmith) walkVectorExpr(depth int) parser.Expr {
+	if expr := s.walk(depth, parser.ValueTypeVector); expr != nil {
+		return expr
+	}
+	return s.walkVectorSelector(s.enableAtModifier)
+}
+
+func (s *PromQLSmith) walkInvalidSyntax() string {
+	query := s.walkVectorExpr(s.maxDepth).String()
+	switch s.rnd.Intn(3) {
+	case 0:
+		return query + " " + s.supportedBinops[s.rnd.Intn(len(s.supportedBinops))].String()
+	case 1:
+		return "(" + query
+	default:
+		return query + ")"
+	}
+}
+
+func (s *PromQLSmith) walkInvalidType() string {
+	var expr parser.Expr
+	switch s.rnd.Intn(3) {
+	case 0:
+		// Functions taking a range vector.
+		expr = &parser.Call{
+			Func: parser.Functions["rate"],
+			Args: []parser.Expr{s.walkVectorExpr(s.maxDepth - 1)},
+		}
+	case 1:
+		expr = &parser.AggregateExpr{
+			Op:   s.supportedAggrs[s.rnd.Intn(len(s.supportedAggrs))],
+			Expr: s.walkMatrixSelector(),
+		}
+		if expr.(*parser.AggregateExpr).Op.IsAggregatorWithParam() {
+			expr.(*parser.AggregateExpr).Param = &parser.NumberLiteral{Val: 1}
+		}
+	default:
+		// Binary expressions only take scalars and instant vectors.
+		expr = &parser.BinaryExpr{
+			Op:             parser.ADD,
+			LHS:            wrapParenExpr(s.walkVectorExpr(s.maxDepth - 1)),
+			RHS:            s.walkMatrixSelector(),
+			VectorMatching: &parser.VectorMatching{Card: parser.CardOneToOne},
+		}
+	}
+	return expr.String()
+}
+
+func (s *PromQLSmith) walkInvalidRegex() string {
+	// Modifiers are dropped since the regex matcher is appended to the printed selector.
+	expr := &parser.VectorSelector{
+		LabelMatchers: s.walkVectorSelector(false).(*parser.VectorSelector).LabelMatchers,
+	}
+	op := "=~"
+	if s.rnd.Intn(2) == 0 {
+		op = "!~"
+	}
+	name := s.walkLabelName()
+	if !isLegacyLabelName(name) {
+		name = strconv.Quote(name)
+	}
+	matcher := fmt.Sprintf("%s%s%q", name, op, invalidRegexes[s.rnd.Intn(len(invalidRegexes))])
+	query := strings.TrimSuffix(expr.String(), "{}")
+	if strings.HasSuffix(query, "}") {
+		return strings.TrimSuffix(query, "}") + "," + matcher + "}"
+	}
+	return query + "{" + matcher + "}"
+}
+
+// walkManyToManyMatching generates a binary expression matching on no labels between
+// metrics with several series.
+func (s *PromQLSmith) walkManyToManyMatching(names []string) string {
+	expr := &parser.BinaryExpr{
+		Op:  s.walkBinaryOp(false),
+		LHS: s.nameSelector(labels.MatchEqual, names[s.rnd.Intn(len(names))]),
+		RHS: s.nameSelector(labels.MatchEqual, names[s.rnd.Intn(len(names))]),
+		VectorMatching: &parser.VectorMatching{
+			Card: parser.CardOneToOne,
+			On:   true,
+		},
+	}
+	if expr.Op.IsSetOperator() {
+		// Set operators allow many-to-many matching.
+		expr.Op = parser.ADD
+	}
+	if expr.Op.IsComparisonOperator() {
+		expr.ReturnBool = s.rnd.Intn(2) == 0
+	}
+	if s.rnd.Intn(2) == 0 {
+		expr.VectorMatching.Card = parser.CardManyToOne
+	}
+	return expr.String()
+}
+
+// walkDuplicateSeries generates an expression returning series with the same labels,
+// by dropping the metric name of metrics with the same labels, or by removing the
+// labels telling the series of a metric apart with label_replace.
+func (s *PromQLSmith) walkDuplicateSeries(names []string) string {
+	if pair := s.metricsWithSameLabels(); pair != nil && s.rnd.Intn(2) == 0 {
+		return (&parser.Call{
+			Func: parser.Functions["abs"],
+			Args: []parser.Expr{s.nameSelector(labels.MatchRegexp, regexp.QuoteMeta(pair[0])+"|"+regexp.QuoteMeta(pair[1]))},
+		}).String()
+	}
+
+	name := names[s.rnd.Intn(len(names))]
+	var expr parser.Expr = s.nameSelector(labels.MatchEqual, name)
+	for _, label := range s.labelsTellingApart(name) {
+		expr = &parser.Call{
+			Func: parser.Functions["label_replace"],
+			Args: []parser.Expr{
+				expr,
+				&parser.StringLiteral{Val: label},
+				&parser.StringLiteral{Val: ""},
+				&parser.StringLiteral{Val: ""},
+				&parser.StringLiteral{Val: ""},
+			},
+		}
+	}
+	return expr.String()
+}
+
+// walkLabelName returns one of the label names of the series set, or the metric
+// name label if there are none.
+func (s *PromQLSmith) walkLabelName() string {
+	if len(s.labelNames) == 0 {
+		return labels.MetricName
+	}
+	return s.labelNames[s.rnd.Intn(len(s.labelNames))]
+}
+
+func (s *PromQLSmith) nameSelector(t labels.MatchType, value string) *parser.VectorSelector {
+	expr := &parser.VectorSelector{
+		LabelMatchers: append([]*labels.Matcher{labels.MustNewMatcher(t, labels.MetricName, value)}, s.enforceMatchers...),
+	}
+	s.populateSeries(expr)
+	return expr
+}
+
+// enforcedSeries returns the series of the series set matching the enforced label
+// matchers, which are the only ones generated selectors can select.
+func (s *PromQLSmith) enforcedSeries() []labels.Labels {
+	output := make([]labels.Labels, 0, len(s.seriesSet))
+	for _, series := range s.seriesSet {
+		if matchesSeries(series, s.enforceMatchers) {
+			output = append(output, series)
+		}
+	}
+	return output
+}
+
+// metricsWithSeveralSeries returns the sorted names of metrics with several series.
+func (s *PromQLSmith) metricsWithSeveralSeries() []string {
+	counts := make(map[string]int)
+	for _, series := range s.enforcedSeries() {
+		counts[series.Get(labels.MetricName)]++
+	}
+	names := make([]string, 0)
+	for name, count := range counts {
+		if name != "" && count > 1 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// metricsWithSameLabels returns two metric names with a series with the same labels
+// other than the metric name, if any.
+func (s *PromQLSmith) metricsWithSameLabels() []string {
+	seen := make(map[string]string)
+	for _, series := range s.enforcedSeries() {
+		name := series.Get(labels.MetricName)
+		if name == "" {
+			continue
+		}
+		key := series.DropMetricName().String()
+		if other, ok := seen[key]; ok && other != name {
+			return []string{other, name}
+		}
+		seen[key] = name
+	}
+	return nil
+}
+
+// labelsTellingApart returns the sorted names of labels whose values differ between
+// the series of the metric. Labels missing from some of the series count as having
+// an empty value.
+func (s *PromQLSmith) labelsTellingApart(name string) []string {
+	seriesSet := make([]labels.Labels, 0)
+	for _, series := range s.enforcedSeries() {
+		if series.Get(labels.MetricName) == name {
+			seriesSet = append(seriesSet, series)
+		}
+	}
+	output := make([]string, 0)
+	for _, label := range labelNamesOf(seriesSet) {
+		for _, series := range seriesSet[1:] {
+			if series.Get(label) != seriesSet[0].Get(label) {
+				output = append(output, label)
+				break
+			}
+		}
+	}
+	return output
+}
+
+// labelNamesOf returns the sorted names of the labels of the series.
+func labelNamesOf(seriesSet []labels.Labels) []string {
+	output := make([]string, 0)
+	for _, series := range seriesSet {
+		series.Range(func(l labels.Label) {
+			output = append(output, l.Name)
+		})
+	}
+	slices.Sort(output)
+	return slices.Compact(output)
+}
@@ -0,0 +1,91 @@
+package promqlsmith
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/promql/promqltest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkInvalidQuery(t *testing.T) {
+	sameLabels := append([]labels.Labels{
+		labels.FromStrings(labels.MetricName, "a", "job", "prometheus"),
+		labels.FromStrings(labels.MetricName, "b", "job", "prometheus"),
+	}, testSeriesSet...)
+	for _, tc := range []struct {
+		name      string
+		seriesSet []labels.Labels
+		opts      []Option
+	}{
+		{name: "default", seriesSet: testSeriesSet},
+		{name: "metrics with the same labels", seriesSet: sameLabels},
+		{name: "offset and @ modifier", seriesSet: testSeriesSet, opts: []Option{WithEnableOffset(true), WithEnableAtModifier(true)}},
+		{name: "enforced matchers", seriesSet: testSeriesSet, opts: []Option{
+			WithEnforceLabelMatchers([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "job", "prometheus")}),
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var load strings.Builder
+			load.WriteString("load 30s\n")
+			for _, lbls := range tc.seriesSet {
+				fmt.Fprintf(&load, "%s 1+1x20\n", lbls.String())
+			}
+			st := promqltest.LoadedStorage(t, load.String())
+			t.Cleanup(func() { st.Close() })
+
+			rnd := rand.New(rand.NewSource(time.Now().Unix()))
+			ps := New(rnd, tc.seriesSet, tc.opts...)
+			ctx := context.Background()
+			engine := promqltest.NewTestEngine(t, false, 0, promqltest.DefaultMaxSamplesPerQuery)
+			kinds := make(map[InvalidQueryKind]struct{})
+			for i := 0; i < 300; i++ {
+				query := ps.WalkInvalidQuery()
+				kinds[query.Kind] = struct{}{}
+				_, parseErr := parser.ParseExpr(query.Query)
+				q, err := engine.NewInstantQuery(ctx, st, nil, query.Query, time.Unix(0, 0).Add(5*time.Minute))
+				if query.Kind.ErrorClass() == ParseError {
+					require.Error(t, parseErr, "%s: %s", query.Kind, query.Query)
+					require.Error(t, err, "%s: %s", query.Kind, query.Query)
+					continue
+				}
+				require.NoError(t, parseErr, "%s: %s", query.Kind, query.Query)
+				require.NoError(t, err, "%s: %s", query.Kind, query.Query)
+				res := q.Exec(ctx)
+				q.Close()
+				require.Error(t, res.Err, "%s: %s", query.Kind, query.Query)
+			}
+			require.Len(t, kinds, len(invalidQueryKindNames))
+		})
+	}
+}
+
+func TestWalkInvalidQueryWithoutSeveralSeries(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, []labels.Labels{labels.FromStrings(labels.MetricName, "up")})
+	for i := 0; i < 100; i++ {
+		query := ps.WalkInvalidQuery()
+		require.NotEqual(t, InvalidManyToManyMatching, query.Kind)
+		require.NotEqual(t, InvalidDuplicateSeries, query.Kind)
+	}
+}
+
+func TestWalkInvalidQueryWithSeed(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet)
+	query := ps.WalkInvalidQuery()
+	require.Equal(t, query, ps.WalkInvalidQueryWithSeed(ps.LastSeed()))
+}
+
+func TestInvalidQueryKindString(t *testing.T) {
+	require.Equal(t, "duplicate_series", InvalidDuplicateSeries.String())
+	require.Equal(t, "InvalidQueryKind(100)", InvalidQueryKind(100).String())
+	require.Equal(t, ParseError, InvalidRegex.ErrorClass())
+	require.Equal(t, "execution", InvalidManyToManyMatching.ErrorClass().String())
+}
@@ -0,0 +1,341 @@
+package promqlsmith
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+)
+
+// nameKeepingFuncs are the functions returning series with the metric name of
+// their vector or matrix argument.
+var nameKeepingFuncs = map[string]struct{}{
+	"last_over_time":     {},
+	"sort":               {},
+	"sort_desc":          {},
+	"sort_by_label":      {},
+	"sort_by_label_desc": {},
+}
+
+// EquivalentExprs returns expressions that must return the same result as expr
+// when evaluated at the same time, which is useful for metamorphic testing of a
+// single engine. Every expression applies a single rewrite to one node of expr:
+//
+//   - sum, min, max and group aggregations are applied on top of a finer
+//     grained aggregation of the same kind, and count becomes a sum of counts.
+//   - max(x) becomes -min(-x) and min(x) becomes -max(-x).
+//   - Operands of + and * are commuted.
+//   - x becomes x * 1, -(-x), x and x or x or x.
+//   - The range of sum_over_time and count_over_time is split into two ranges
+//     with offsets.
+//   - Label matchers are replaced by equivalent regular expression matchers and
+//     regular expressions by equivalent ones.
+//
+// Rewrites that would change the labels of the result, like arithmetic on
+// series that may have a metric name, are skipped. Results can still differ
+// for float sums added up in a different order, for aggregations mixing float
+// and histogram samples and for expressions which are not deterministic, such
+// as topk or bottomk with equal values.
+func (s *PromQLSmith) EquivalentExprs(expr parser.Expr) []parser.Expr {
+	// Rewrite the expression as parsed from its string, which is what engines
+	// evaluate. Generated expressions like (-x) ^ y are printed as -x ^ y which
+	// is parsed as -(x ^ y).
+	if parsed, err := parser.ParseExpr(expr.String()); err == nil {
+		expr = parsed
+	}
+	// timestamp returns the timestamps of the samples only for vector selectors
+	// and the evaluation time for anything else, so only their matchers can be
+	// rewritten. absent and absent_over_time take the labels of their result from
+	// the equality matchers of selectors, which must be kept as they are.
+	selectorArgs := make(map[parser.Expr]bool)
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		c, ok := node.(*parser.Call)
+		if !ok {
+			return nil
+		}
+		switch c.Func.Name {
+		case "timestamp":
+			selectorArgs[unwrapExpr(c.Args[0])] = true
+		case "absent", "absent_over_time":
+			arg := unwrapExpr(c.Args[0])
+			if ms, ok := arg.(*parser.MatrixSelector); ok {
+				arg = ms.VectorSelector
+			}
+			selectorArgs[arg] = false
+		}
+		return nil
+	})
+	return parseCandidates(expr, rewriteExpr(expr, func(e parser.Expr) []parser.Expr {
+		vs, ok := e.(*parser.VectorSelector)
+		if !ok {
+			return s.equivalentExprs(e)
+		}
+		rewriteMatchers, ok := selectorArgs[vs]
+		switch {
+		case !ok:
+			return s.equivalentExprs(e)
+		case rewriteMatchers:
+			return equivalentMatchers(vs)
+		}
+		return nil
+	}))
+}
+
+// unwrapExpr removes the parentheses and step invariant nodes around expr.
+func unwrapExpr(expr parser.Expr) parser.Expr {
+	switch e := expr.(type) {
+	case *parser.ParenExpr:
+		return unwrapExpr(e.Expr)
+	case *parser.StepInvariantExpr:
+		return unwrapExpr(e.Expr)
+	}
+	return expr
+}
+
+// equivalentExprs returns the equivalent replacements for the given node.
+func (s *PromQLSmith) equivalentExprs(expr parser.Expr) []parser.Expr {
+	out := make([]parser.Expr, 0)
+	switch e := expr.(type) {
+	case *parser.ParenExpr, *parser.StepInvariantExpr, *parser.StringLiteral, *parser.MatrixSelector, *parser.SubqueryExpr:
+		return out
+	case *parser.AggregateExpr:
+		out = append(out, s.nestedAggregations(e)...)
+		if (e.Op == parser.MAX || e.Op == parser.MIN) && !mayHaveMetricName(e) {
+			out = append(out, negatedAggregation(e))
+		}
+	case *parser.BinaryExpr:
+		if (e.Op == parser.ADD || e.Op == parser.MUL) && canCommute(e) {
+			n := *e
+			n.LHS, n.RHS = wrapOperand(e.RHS), wrapOperand(e.LHS)
+			out = append(out, &n)
+		}
+	case *parser.Call:
+		if repl := splitRange(e); repl != nil {
+			out = append(out, repl)
+		}
+	case *parser.VectorSelector:
+		out = append(out, equivalentMatchers(e)...)
+	}
+
+	if !mayHaveMetricName(expr) {
+		out = append(out,
+			parenExpr(&parser.BinaryExpr{Op: parser.MUL, LHS: wrapOperand(expr), RHS: &parser.NumberLiteral{Val: 1}}),
+			parenExpr(negate(negate(expr))),
+		)
+	}
+	if expr.Type() == parser.ValueTypeVector {
+		for _, op := range []parser.ItemType{parser.LAND, parser.LOR} {
+			out = append(out, parenExpr(&parser.BinaryExpr{
+				Op:             op,
+				LHS:            wrapOperand(expr),
+				RHS:            wrapOperand(expr),
+				VectorMatching: &parser.VectorMatching{Card: parser.CardManyToMany},
+			}))
+		}
+	}
+	return out
+}
+
+// nestedAggregations wraps a finer grained aggregation of the same kind inside
+// the aggregation. Finer grained aggregations group by an additional label or
+// drop one label less than the original one.
+func (s *PromQLSmith) nestedAggregations(e *parser.AggregateExpr) []parser.Expr {
+	outer := e.Op
+	switch e.Op {
+	case parser.SUM, parser.MIN, parser.MAX, parser.GROUP:
+	case parser.COUNT:
+		outer = parser.SUM
+	default:
+		return nil
+	}
+
+	inner := *e
+	if e.Without {
+		if len(e.Grouping) > 0 {
+			inner.Grouping = slices.Clone(e.Grouping[:len(e.Grouping)-1])
+		}
+	} else {
+		candidates := make([]string, 0, len(s.labelNames))
+		for _, name := range s.labelNames {
+			if name != labels.MetricName && isGroupingLabelName(name) && !slices.Contains(e.Grouping, name) {
+				candidates = append(candidates, name)
+			}
+		}
+		if len(candidates) > 0 {
+			inner.Grouping = append(slices.Clone(e.Grouping), candidates[s.rnd.Intn(len(candidates))])
+		}
+	}
+	return []parser.Expr{&parser.AggregateExpr{
+		Op:       outer,
+		Expr:     &inner,
+		Grouping: e.Grouping,
+		Without:  e.Without,
+	}}
+}
+
+// negatedAggregation turns max(x) into -min(-x) and min(x) into -max(-x).
+func negatedAggregation(e *parser.AggregateExpr) parser.Expr {
+	n := *e
+	n.Op = parser.MIN
+	if e.Op == parser.MIN {
+		n.Op = parser.MAX
+	}
+	n.Expr = negate(e.Expr)
+	return parenExpr(negate(&n))
+}
+
+// canCommute checks whether swapping the operands of the binary expression keeps
+// the labels of its result. Vector to vector operations only commute if both sides
+// can't have series with the same labels once their metric name is dropped, since
+// duplicates on the right side are an error even if they match nothing.
+func canCommute(e *parser.BinaryExpr) bool {
+	if e.LHS.Type() != parser.ValueTypeVector || e.RHS.Type() != parser.ValueTypeVector {
+		return true
+	}
+	if vm := e.VectorMatching; vm != nil && (vm.Card != parser.CardOneToOne || vm.On || len(vm.MatchingLabels) > 0) {
+		return false
+	}
+	return !mayHaveMetricName(e.LHS) && !mayHaveMetricName(e.RHS)
+}
+
+// splitRange splits the range of sum_over_time and count_over_time into a recent
+// part and an older part. Range selectors include samples at both ends of the range
+// so the older part ends one millisecond before the recent part starts.
+func splitRange(e *parser.Call) parser.Expr {
+	if e.Func.Name != "sum_over_time" && e.Func.Name != "count_over_time" {
+		return nil
+	}
+	ms, ok := e.Args[0].(*parser.MatrixSelector)
+	if !ok {
+		return nil
+	}
+	vs, ok := ms.VectorSelector.(*parser.VectorSelector)
+	if !ok {
+		return nil
+	}
+	recentRange := (ms.Range / 2).Truncate(time.Millisecond)
+	olderRange := ms.Range - recentRange - time.Millisecond
+	if recentRange <= 0 || olderRange <= 0 {
+		return nil
+	}
+
+	recent := &parser.Call{Func: e.Func, Args: parser.Expressions{&parser.MatrixSelector{VectorSelector: vs, Range: recentRange}}}
+	olderSelector := *vs
+	olderSelector.OriginalOffset += recentRange + time.Millisecond
+	older := &parser.Call{Func: e.Func, Args: parser.Expressions{&parser.MatrixSelector{VectorSelector: &olderSelector, Range: olderRange}}}
+
+	// Series only present in one part are added by the or operations.
+	both := &parser.BinaryExpr{Op: parser.ADD, LHS: recent, RHS: older, VectorMatching: &parser.VectorMatching{Card: parser.CardOneToOne}}
+	var out parser.Expr = &parser.ParenExpr{Expr: both}
+	for _, part := range []parser.Expr{recent, older} {
+		out = &parser.BinaryExpr{Op: parser.LOR, LHS: out, RHS: part, VectorMatching: &parser.VectorMatching{Card: parser.CardManyToMany}}
+	}
+	return parenExpr(out)
+}
+
+// equivalentMatchers returns copies of the vector selector with one label matcher
+// replaced by an equivalent one.
+func equivalentMatchers(e *parser.VectorSelector) []parser.Expr {
+	out := make([]parser.Expr, 0)
+	for i, m := range e.LabelMatchers {
+		for _, repl := range equivalentMatcher(m) {
+			n := *e
+			n.LabelMatchers = slices.Clone(e.LabelMatchers)
+			n.LabelMatchers[i] = repl
+			if m.Name == labels.MetricName {
+				// Otherwise the printed selector would have two metric names.
+				n.Name = ""
+			}
+			out = append(out, &n)
+		}
+	}
+	return out
+}
+
+func equivalentMatcher(m *labels.Matcher) []*labels.Matcher {
+	out := make([]*labels.Matcher, 0)
+	add := func(t labels.MatchType, v string) {
+		if repl, err := labels.NewMatcher(t, m.Name, v); err == nil {
+			out = append(out, repl)
+		}
+	}
+	switch m.Type {
+	case labels.MatchEqual:
+		add(labels.MatchRegexp, regexp.QuoteMeta(m.Value))
+	case labels.MatchNotEqual:
+		add(labels.MatchNotRegexp, regexp.QuoteMeta(m.Value))
+	case labels.MatchRegexp, labels.MatchNotRegexp:
+		add(m.Type, "(?:"+m.Value+")")
+		if regexp.QuoteMeta(m.Value) == m.Value {
+			t := labels.MatchEqual
+			if m.Type == labels.MatchNotRegexp {
+				t = labels.MatchNotEqual
+			}
+			add(t, m.Value)
+		}
+	}
+	return out
+}
+
+// mayHaveMetricName checks whether the result of expr can contain series with a
+// metric name. Arithmetic operations drop the metric name, so they are only
+// guaranteed to keep the labels of such expressions unchanged.
+func mayHaveMetricName(expr parser.Expr) bool {
+	switch e := expr.(type) {
+	case *parser.NumberLiteral, *parser.StringLiteral:
+		return false
+	case *parser.ParenExpr:
+		return mayHaveMetricName(e.Expr)
+	case *parser.StepInvariantExpr:
+		return mayHaveMetricName(e.Expr)
+	case *parser.SubqueryExpr:
+		return mayHaveMetricName(e.Expr)
+	case *parser.UnaryExpr:
+		return e.Op != parser.SUB && mayHaveMetricName(e.Expr)
+	case *parser.AggregateExpr:
+		switch e.Op {
+		case parser.TOPK, parser.BOTTOMK, parser.LIMITK, parser.LIMIT_RATIO:
+			return mayHaveMetricName(e.Expr)
+		}
+		// Grouping by the metric name keeps it.
+		return !e.Without && slices.Contains(e.Grouping, labels.MetricName)
+	case *parser.BinaryExpr:
+		if e.Op.IsSetOperator() || (e.Op.IsComparisonOperator() && !e.ReturnBool) {
+			return mayHaveMetricName(e.LHS) || mayHaveMetricName(e.RHS)
+		}
+		return false
+	case *parser.Call:
+		switch e.Func.Name {
+		case "label_replace", "label_join", "absent", "absent_over_time", "info":
+			return true
+		}
+		if _, ok := nameKeepingFuncs[e.Func.Name]; ok {
+			return mayHaveMetricName(e.Args[0])
+		}
+		return false
+	}
+	// Selectors and unknown expressions.
+	return true
+}
+
+func negate(expr parser.Expr) parser.Expr {
+	return &parser.UnaryExpr{Op: parser.SUB, Expr: wrapOperand(expr)}
+}
+
+// wrapOperand wraps binary and unary expressions in parentheses. Unlike
+// wrapParenExpr it also wraps unary expressions, since -x ^ y is -(x ^ y).
+func wrapOperand(expr parser.Expr) parser.Expr {
+	switch expr.(type) {
+	case *parser.BinaryExpr, *parser.UnaryExpr:
+		return &parser.ParenExpr{Expr: expr}
+	}
+	return expr
+}
+
+// parenExpr wraps expr in parentheses so that it keeps its meaning wherever it
+// replaces another node, for example as the left side of ^ or inside a subquery.
+func parenExpr(expr parser.Expr) parser.Expr {
+	return &parser.ParenExpr{Expr: expr}
+}
@@ -0,0 +1,187 @@
+package promqlsmith
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/promql/promqltest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEquivalentExprs(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	// The only label that can be added to the grouping labels is instance.
+	ps := New(rnd, []labels.Labels{labels.FromStrings(labels.MetricName, "up", "job", "prometheus", "instance", "a")})
+	for i, tc := range []struct {
+		query       string
+		expected    []string
+		notExpected []string
+	}{
+		{
+			query:    `sum by (job) (up)`,
+			expected: []string{`sum by (job) (sum by (job, instance) (up))`, `(sum by (job) (up) * 1)`, `(-(-sum by (job) (up)))`},
+		},
+		{
+			query:    `count without (job, instance) (up)`,
+			expected: []string{`sum without (job, instance) (count without (job) (up))`},
+		},
+		{
+			query:    `max(up)`,
+			expected: []string{`(-min(-up))`, `(max(up) and max(up))`, `(max(up) or max(up))`},
+		},
+		{
+			query:       `rate(up[5m]) + abs(up)`,
+			expected:    []string{`abs(up) + rate(up[5m])`},
+			notExpected: []string{`rate(up[5m]) + abs((up * 1))`},
+		},
+		{
+			// Both sides can have series with the same labels after dropping the metric name.
+			query:       `up + up`,
+			notExpected: []string{`up + up`, `(up * 1) + up`},
+		},
+		{
+			query:    `2 ^ max(up)`,
+			expected: []string{`2 ^ (-min(-up))`},
+		},
+		{
+			query: `count_over_time(up[5m] offset 1m)`,
+			expected: []string{
+				`((count_over_time(up[2m30s] offset 1m) + count_over_time(up[2m29s999ms] offset 3m30s1ms)) or count_over_time(up[2m30s] offset 1m) or count_over_time(up[2m29s999ms] offset 3m30s1ms))`,
+			},
+		},
+		{
+			query:    `up{job="prometheus",instance!="b"}`,
+			expected: []string{`up{instance!="b",job=~"prometheus"}`, `up{instance!~"b",job="prometheus"}`, `{__name__=~"up",instance!="b",job="prometheus"}`},
+		},
+		{
+			query:    `up{job=~"prom.*",instance!~"a"}`,
+			expected: []string{`up{instance!~"a",job=~"(?:prom.*)"}`, `up{instance!="a",job=~"prom.*"}`},
+		},
+	} {
+		t.Run(fmt.Sprintf("test_case_%d", i), func(t *testing.T) {
+			expr, err := parser.ParseExpr(tc.query)
+			require.NoError(t, err)
+			queries := make([]string, 0)
+			for _, e := range ps.EquivalentExprs(expr) {
+				queries = append(queries, e.String())
+			}
+			for _, q := range tc.expected {
+				require.Contains(t, queries, q)
+			}
+			for _, q := range tc.notExpected {
+				require.NotContains(t, queries, q)
+			}
+		})
+	}
+}
+
+// TestEquivalentExprsReturnSameResults evaluates generated queries and their
+// equivalent expressions with the same engine. Float sums are disabled since
+// nested sums and split ranges are expected to round differently, and so is
+// count_values which turns rounding differences into labels.
+func TestEquivalentExprsReturnSameResults(t *testing.T) {
+	st := promqltest.LoadedStorage(t, `load 30s
+http_requests_total{job="prometheus", status_code="200", cluster="us-west-2", env="prod"} 1+1.1x40
+http_requests_total{job="prometheus", status_code="404", cluster="us-west-2", env="prod"} 2+2.3x50 stale
+http_requests_total{job="prometheus", status_code="500", cluster="us-west-2", env="prod"} _ _ 6+0.8x60
+up{job="prometheus", cluster="us-west-2", env="prod"} 1 1 0 1x50
+up{job="node_exporter", cluster="us-west-2", env="prod"} 0x20 1x40
+`)
+	t.Cleanup(func() { st.Close() })
+
+	funcs := make([]*parser.Function, 0, len(defaultSupportedFuncs))
+	for _, f := range defaultSupportedFuncs {
+		if f.Name != "sum_over_time" {
+			funcs = append(funcs, f)
+		}
+	}
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet,
+		WithEnableOffset(true),
+		WithEnableVectorMatching(true),
+		WithEnabledFunctions(funcs),
+		WithEnabledAggrs([]parser.ItemType{
+			parser.MIN, parser.MAX, parser.AVG, parser.COUNT, parser.GROUP,
+			parser.STDDEV, parser.STDVAR, parser.QUANTILE,
+		}),
+	)
+
+	ctx := context.Background()
+	// The experimental delayed name removal of the test engine can keep metric
+	// names dropped by the original expression.
+	engine := promqltest.NewTestEngineWithOpts(t, promql.EngineOpts{
+		MaxSamples:           promqltest.DefaultMaxSamplesPerQuery,
+		Timeout:              time.Minute,
+		EnableNegativeOffset: true,
+	})
+	end := time.Unix(0, 0).Add(20 * time.Minute)
+	exec := func(query string, instant bool) *promql.Result {
+		var (
+			q   promql.Query
+			err error
+		)
+		if instant {
+			q, err = engine.NewInstantQuery(ctx, st, nil, query, end)
+		} else {
+			q, err = engine.NewRangeQuery(ctx, st, nil, query, end.Add(-10*time.Minute), end, time.Minute)
+		}
+		require.NoError(t, err)
+		t.Cleanup(q.Close)
+		return q.Exec(ctx)
+	}
+
+	for i := 0; i < 20; i++ {
+		for _, instant := range []bool{true, false} {
+			expr := ps.WalkRangeQuery()
+			expected := exec(expr.String(), instant)
+			for _, equivalent := range ps.EquivalentExprs(expr) {
+				result := exec(equivalent.String(), instant)
+				require.Equal(t, expected.Err != nil, result.Err != nil, "%s\n%s", expr, equivalent)
+				if expected.Err != nil {
+					continue
+				}
+				diff := cmp.Diff(sortedResult(expected.Value), sortedResult(result.Value), resultCmpOpts...)
+				require.Empty(t, diff, "%s\n%s", expr, equivalent)
+			}
+		}
+	}
+}
+
+var resultCmpOpts = []cmp.Option{
+	cmpopts.EquateNaNs(),
+	// Rewrites can change the order of series, which changes the rounding of
+	// aggregations like avg or stddev.
+	cmpopts.EquateApprox(1e-9, 1e-9),
+	cmp.Comparer(labels.Equal),
+	// Whether the metric name is dropped only matters for the labels compared above.
+	cmpopts.IgnoreFields(promql.Series{}, "DropName"),
+	cmpopts.IgnoreFields(promql.Sample{}, "DropName"),
+}
+
+// sortedResult sorts vectors by labels since only sort functions return series in
+// a meaningful order. Empty results are set to nil so that they compare equal.
+func sortedResult(v parser.Value) parser.Value {
+	switch v := v.(type) {
+	case promql.Vector:
+		if len(v) == 0 {
+			return promql.Vector(nil)
+		}
+		sort.Slice(v, func(i, j int) bool {
+			return labels.Compare(v[i].Metric, v[j].Metric) < 0
+		})
+	case promql.Matrix:
+		if len(v) == 0 {
+			return promql.Matrix(nil)
+		}
+	}
+	return v
+}
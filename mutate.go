@@ -0,0 +1,144 @@
+package promqlsmith
+
+import (
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+)
+
+// MutateQuery parses query and returns a random mutation of it, see Mutate.
+func (s *PromQLSmith) MutateQuery(query string) (parser.Expr, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+	return s.Mutate(expr), nil
+}
+
+// Mutate returns a copy of expr with a random mutation applied to one of its
+// nodes, which is useful to generate realistic queries from a corpus of real
+// ones. Mutations swap aggregation operators, change grouping labels, replace
+// subtrees with freshly generated ones of the same value type, regenerate label
+// matchers from the series set, toggle offset and @ modifiers and change the
+// range of matrix selectors and subqueries. Offset and @ modifiers are only added
+// if enabled. The mutated expression is a valid PromQL expression of the same
+// value type as expr. expr itself is returned if none of its nodes can be mutated.
+func (s *PromQLSmith) Mutate(expr parser.Expr) parser.Expr {
+	return s.MutateWithSeed(expr, s.rnd.Int63())
+}
+
+// MutateWithSeed is like Mutate but uses the given seed.
+func (s *PromQLSmith) MutateWithSeed(expr parser.Expr, seed int64) (mutated parser.Expr) {
+	s.withSeed(seed, func() { mutated = s.mutate(expr) })
+	return mutated
+}
+
+func (s *PromQLSmith) mutate(expr parser.Expr) parser.Expr {
+	nodes := 0
+	rewriteExpr(expr, func(parser.Expr) []parser.Expr {
+		nodes++
+		return nil
+	})
+	// Try the nodes in random order until one of them has a valid mutation.
+	for _, i := range perm(s.rnd, nodes) {
+		n := 0
+		candidates := parseCandidates(expr, rewriteExpr(expr, func(node parser.Expr) []parser.Expr {
+			defer func() { n++ }()
+			if n != i {
+				return nil
+			}
+			return s.mutateNode(node)
+		}))
+		if len(candidates) > 0 {
+			return candidates[s.rnd.Intn(len(candidates))]
+		}
+	}
+	return expr
+}
+
+// mutateNode returns mutations of the given node.
+func (s *PromQLSmith) mutateNode(expr parser.Expr) []parser.Expr {
+	out := make([]parser.Expr, 0)
+	switch e := expr.(type) {
+	case *parser.AggregateExpr:
+		if ops := slices.DeleteFunc(slices.Clone(s.supportedAggrs), func(op parser.ItemType) bool { return op == e.Op }); len(ops) > 0 {
+			n := *e
+			n.Op = pickWeighted(s.rnd, ops, s.aggrWeights, func(op parser.ItemType) parser.ItemType { return op })
+			n.Param = nil
+			if n.Op.IsAggregatorWithParam() {
+				n.Param = s.walkAggregateParam(n.Op, s.mutationDepth())
+			}
+			out = append(out, &n)
+		}
+		n := *e
+		n.Grouping = s.walkGrouping()
+		n.Without = s.rnd.Intn(2) == 0
+		out = append(out, &n)
+	case *parser.VectorSelector:
+		n := *e
+		n.Name = ""
+		n.LabelMatchers = s.walkLabelMatchers()
+		s.populateSeries(&n)
+		out = append(out, &n)
+		if e.OriginalOffset != 0 {
+			n := *e
+			n.OriginalOffset = 0
+			out = append(out, &n)
+		} else if s.enableOffset {
+			n := *e
+			n.OriginalOffset = s.walkOffset()
+			out = append(out, &n)
+		}
+		if e.Timestamp != nil || e.StartOrEnd != 0 {
+			n := *e
+			n.Timestamp, n.StartOrEnd = nil, 0
+			out = append(out, &n)
+		} else if s.enableAtModifier {
+			n := *e
+			n.Timestamp, n.StartOrEnd = s.walkAtModifier()
+			out = append(out, &n)
+		}
+	case *parser.MatrixSelector:
+		n := *e
+		n.Range = s.walkRange()
+		out = append(out, &n)
+	case *parser.SubqueryExpr:
+		n := *e
+		n.Range, n.Step = s.walkSubqueryRange()
+		out = append(out, &n)
+		if e.OriginalOffset != 0 {
+			n := *e
+			n.OriginalOffset = 0
+			out = append(out, &n)
+		} else if s.enableOffset {
+			n := *e
+			n.OriginalOffset = s.walkOffset()
+			out = append(out, &n)
+		}
+		if e.Timestamp != nil || e.StartOrEnd != 0 {
+			n := *e
+			n.Timestamp, n.StartOrEnd = nil, 0
+			out = append(out, &n)
+		} else if s.enableAtModifier {
+			n := *e
+			n.Timestamp, n.StartOrEnd = s.walkAtModifier()
+			out = append(out, &n)
+		}
+	}
+
+	// Any subtree can be replaced by a new one of the same value type. Parentheses
+	// are kept and their inner expression is replaced instead.
+	switch expr.(type) {
+	case *parser.ParenExpr, *parser.StepInvariantExpr, *parser.StringLiteral:
+	default:
+		if repl := s.walk(s.mutationDepth(), expr.Type()); repl != nil && canReplace(expr, repl) {
+			out = append(out, repl)
+		}
+	}
+	return out
+}
+
+// mutationDepth returns the depth of new subtrees, which is less than the
+// maximum depth since they are inserted in an existing expression.
+func (s *PromQLSmith) mutationDepth() int {
+	return s.rnd.Intn(max(s.maxDepth-1, 1)) + 1
+}
@@ -0,0 +1,83 @@
+package promqlsmith
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutate(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet,
+		WithEnableOffset(true),
+		WithEnableAtModifier(true),
+		WithEnableVectorMatching(true),
+	)
+	for _, query := range []string{
+		`up`,
+		`sum by (job) (rate(http_requests_total{status_code="500"}[5m]))`,
+		`topk(3, max_over_time(up[10m:1m] offset 1m))`,
+		`count_values("value", up) > on (job) group_left () sum by (job) (up @ start())`,
+		`label_replace(up, "foo", "$1", "job", "(.*)") or vector(1)`,
+		`histogram_quantile(0.9, sum by (le) (rate(http_requests_total[5m])))`,
+		`-(1 + 2) * scalar(up)`,
+		`1`,
+	} {
+		expr, err := parser.ParseExpr(query)
+		require.NoError(t, err)
+		for i := 0; i < 20; i++ {
+			mutated := ps.Mutate(expr)
+			_, err := parser.ParseExpr(mutated.String())
+			require.NoError(t, err, mutated.String())
+			require.Equal(t, expr.Type(), mutated.Type(), mutated.String())
+			require.NotEqual(t, query, mutated.String())
+			require.Equal(t, query, expr.String(), "expr must not be modified")
+			require.Equal(t, mutated.String(), ps.MutateWithSeed(expr, ps.LastSeed()).String())
+		}
+	}
+}
+
+func TestMutateKinds(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet, WithEnabledAggrs([]parser.ItemType{parser.SUM, parser.TOPK}))
+	for _, tc := range []struct {
+		query    string
+		expected func(string) bool
+	}{
+		{query: `sum by (job) (up)`, expected: func(q string) bool { return strings.HasPrefix(q, "topk") }},
+		{query: `sum by (job) (up)`, expected: func(q string) bool { return strings.HasPrefix(q, "sum") && !strings.Contains(q, "by (job)") }},
+		{query: `rate(up[10h])`, expected: func(q string) bool { return strings.HasPrefix(q, "rate(up[") && !strings.Contains(q, "[10h]") }},
+		{query: `max_over_time(up[10h:1h])`, expected: func(q string) bool {
+			return strings.HasPrefix(q, "max_over_time(up[") && !strings.Contains(q, "[10h:1h]")
+		}},
+		{query: `up offset 10h`, expected: func(q string) bool { return q == "up" }},
+		{query: `up @ 100`, expected: func(q string) bool { return q == "up" }},
+		{query: `up`, expected: func(q string) bool { return strings.Contains(q, "__name__") }},
+	} {
+		found := false
+		for i := 0; i < 200 && !found; i++ {
+			mutated, err := ps.MutateQuery(tc.query)
+			require.NoError(t, err)
+			found = tc.expected(mutated.String())
+		}
+		require.True(t, found, tc.query)
+	}
+}
+
+func TestMutateRespectsModifierOptions(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet, WithEnabledExprs([]ExprType{VectorSelector}))
+	for i := 0; i < 100; i++ {
+		mutated, err := ps.MutateQuery(`up`)
+		require.NoError(t, err)
+		require.NotContains(t, mutated.String(), "offset")
+		require.NotContains(t, mutated.String(), "@")
+	}
+
+	_, err := ps.MutateQuery(`up{`)
+	require.Error(t, err)
+}
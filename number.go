@@ -0,0 +1,107 @@
+package promqlsmith
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// NumberLiteralKind is a kind of number literal, picked with the weights set by
+// WithNumberLiteralWeights.
+//
+// Literals are printed in decimal or exponent notation by the parser, so
+// hexadecimal literals like 0x1F can't be generated.
+type NumberLiteralKind int
+
+const (
+	// NumberLiteralFraction is a float in [0, 1), the only kind generated by default.
+	NumberLiteralFraction NumberLiteralKind = iota
+	// NumberLiteralInteger is an integer in [-1000, 1000].
+	NumberLiteralInteger
+	// NumberLiteralZero is 0, which makes divisions and modulos by zero.
+	NumberLiteralZero
+	// NumberLiteralNegativeZero is -0.
+	NumberLiteralNegativeZero
+	// NumberLiteralNaN is NaN.
+	NumberLiteralNaN
+	// NumberLiteralInf is +Inf.
+	NumberLiteralInf
+	// NumberLiteralNegativeInf is -Inf.
+	NumberLiteralNegativeInf
+	// NumberLiteralHuge is a positive or negative float with a magnitude between
+	// 1e15 and 1e308, larger than the integers a float represents exactly.
+	NumberLiteralHuge
+	// NumberLiteralTiny is a positive or negative float with a magnitude between
+	// 1e-323 and 1e-5, including subnormal floats.
+	NumberLiteralTiny
+)
+
+// NumberLiteralKinds are all the kinds of number literals.
+var NumberLiteralKinds = []NumberLiteralKind{
+	NumberLiteralFraction,
+	NumberLiteralInteger,
+	NumberLiteralZero,
+	NumberLiteralNegativeZero,
+	NumberLiteralNaN,
+	NumberLiteralInf,
+	NumberLiteralNegativeInf,
+	NumberLiteralHuge,
+	NumberLiteralTiny,
+}
+
+var numberLiteralKindNames = map[NumberLiteralKind]string{
+	NumberLiteralFraction:     "fraction",
+	NumberLiteralInteger:      "integer",
+	NumberLiteralZero:         "zero",
+	NumberLiteralNegativeZero: "negative_zero",
+	NumberLiteralNaN:          "nan",
+	NumberLiteralInf:          "inf",
+	NumberLiteralNegativeInf:  "negative_inf",
+	NumberLiteralHuge:         "huge",
+	NumberLiteralTiny:         "tiny",
+}
+
+func (k NumberLiteralKind) String() string {
+	if name, ok := numberLiteralKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("NumberLiteralKind(%d)", int(k))
+}
+
+func (s *PromQLSmith) walkNumberLiteral() parser.Expr {
+	if s.numberLiteralWeights == nil {
+		return &parser.NumberLiteral{Val: s.rnd.Float64()}
+	}
+	kind := pickWeighted(s.rnd, NumberLiteralKinds, s.numberLiteralWeights, func(k NumberLiteralKind) NumberLiteralKind { return k })
+	return &parser.NumberLiteral{Val: numberOfKind(s.rnd, kind)}
+}
+
+// numberOfKind generates a float of the given kind.
+func numberOfKind(rnd Rand, kind NumberLiteralKind) float64 {
+	sign := 1.0
+	if rnd.Intn(2) == 0 {
+		sign = -1
+	}
+	switch kind {
+	case NumberLiteralInteger:
+		return float64(rnd.Intn(2001) - 1000)
+	case NumberLiteralZero:
+		return 0
+	case NumberLiteralNegativeZero:
+		return math.Copysign(0, -1)
+	case NumberLiteralNaN:
+		return math.NaN()
+	case NumberLiteralInf:
+		return math.Inf(1)
+	case NumberLiteralNegativeInf:
+		return math.Inf(-1)
+	case NumberLiteralHuge:
+		// The mantissa is in [1, 1.79] so that 1e308 doesn't overflow.
+		return sign * (1 + 0.79*rnd.Float64()) * math.Pow10(15+rnd.Intn(294))
+	case NumberLiteralTiny:
+		return sign * (1 + 8*rnd.Float64()) * math.Pow10(-323+rnd.Intn(319))
+	default:
+		return rnd.Float64()
+	}
+}
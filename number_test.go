@@ -0,0 +1,118 @@
+package promqlsmith
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNumberOfKind(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	for _, kind := range NumberLiteralKinds {
+		for i := 0; i < 50; i++ {
+			v := numberOfKind(rnd, kind)
+			switch kind {
+			case NumberLiteralFraction:
+				require.True(t, v >= 0 && v < 1, v)
+			case NumberLiteralInteger:
+				require.Equal(t, math.Trunc(v), v)
+				require.LessOrEqual(t, math.Abs(v), 1000.0)
+			case NumberLiteralZero:
+				require.Equal(t, 0.0, v)
+				require.False(t, math.Signbit(v))
+			case NumberLiteralNegativeZero:
+				require.Equal(t, 0.0, v)
+				require.True(t, math.Signbit(v))
+			case NumberLiteralNaN:
+				require.True(t, math.IsNaN(v))
+			case NumberLiteralInf:
+				require.True(t, math.IsInf(v, 1))
+			case NumberLiteralNegativeInf:
+				require.True(t, math.IsInf(v, -1))
+			case NumberLiteralHuge:
+				require.False(t, math.IsInf(v, 0))
+				require.GreaterOrEqual(t, math.Abs(v), 1e15)
+			case NumberLiteralTiny:
+				require.NotZero(t, v)
+				require.Less(t, math.Abs(v), 1e-4)
+			}
+
+			// Number literals are printed in a form the parser reads back.
+			lit := &parser.NumberLiteral{Val: v}
+			expr, err := parser.ParseExpr(lit.String())
+			require.NoError(t, err, lit.String())
+			parsed := expr.(*parser.NumberLiteral).Val
+			if math.IsNaN(v) {
+				require.True(t, math.IsNaN(parsed))
+				continue
+			}
+			require.Equal(t, v, parsed, lit.String())
+			require.Equal(t, math.Signbit(v), math.Signbit(parsed), lit.String())
+		}
+	}
+}
+
+func TestWalkNumberLiteralWeights(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet)
+	for i := 0; i < 100; i++ {
+		v := ps.walkNumberLiteral().(*parser.NumberLiteral).Val
+		require.True(t, v >= 0 && v < 1, v)
+	}
+
+	ps = New(rnd, testSeriesSet, WithNumberLiteralWeights(map[NumberLiteralKind]float64{
+		NumberLiteralFraction: 0,
+		NumberLiteralInteger:  0,
+		NumberLiteralHuge:     0,
+		NumberLiteralTiny:     0,
+	}))
+	seen := make(map[string]struct{})
+	for i := 0; i < 200; i++ {
+		seen[ps.walkNumberLiteral().String()] = struct{}{}
+	}
+	require.Equal(t, map[string]struct{}{"0": {}, "-0": {}, "NaN": {}, "+Inf": {}, "-Inf": {}}, seen)
+}
+
+func TestWalkWithSpecialNumberLiterals(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet,
+		WithNumberLiteralWeights(map[NumberLiteralKind]float64{}),
+		WithExprWeights(map[ExprType]float64{NumberLiteral: 3}),
+	)
+	for i := 0; i < 100; i++ {
+		expr := ps.WalkRangeQuery()
+		_, err := parser.ParseExpr(expr.String())
+		require.NoError(t, err, expr.String())
+	}
+}
+
+func TestWalkNegativeNumberLiteralLHS(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet,
+		WithNumberLiteralWeights(map[NumberLiteralKind]float64{NumberLiteralInteger: 1, NumberLiteralNegativeInf: 1}),
+		WithEnabledExprs([]ExprType{NumberLiteral}),
+		WithEnabledBinOps([]parser.ItemType{parser.POW}),
+	)
+	wrapped := false
+	for i := 0; i < 100; i++ {
+		expr := ps.walkBinaryExpr(2, parser.ValueTypeScalar).(*parser.BinaryExpr)
+		if _, ok := expr.LHS.(*parser.ParenExpr); ok {
+			wrapped = true
+		}
+		// -5 ^ 2 and +Inf ^ 2 would be parsed as unary expressions.
+		parsed, err := parser.ParseExpr(expr.String())
+		require.NoError(t, err, expr.String())
+		require.IsType(t, &parser.BinaryExpr{}, parsed, expr.String())
+		require.Equal(t, expr.String(), parsed.String())
+	}
+	require.True(t, wrapped)
+
+	require.Equal(t, "(-5)", wrapLHS(&parser.NumberLiteral{Val: -5}).String())
+	require.Equal(t, "(+Inf)", wrapLHS(&parser.NumberLiteral{Val: math.Inf(1)}).String())
+	require.Equal(t, "5", wrapLHS(&parser.NumberLiteral{Val: 5}).String())
+	require.Equal(t, "NaN", wrapLHS(&parser.NumberLiteral{Val: math.NaN()}).String())
+}
@@ -62,6 +62,14 @@ var (
 	experimentalSupportedFuncs []*parser.Function
 )
 
+const (
+	defaultOffsetProbability            = 0.5
+	defaultAtModifierProbability        = 0.3
+	defaultVectorMatchingProbability    = 0.2
+	defaultEmptyLabelValueProbability   = 0.1
+	defaultEmptyResultRejectProbability = 0
+)
+
 func init() {
 	for _, f := range parser.Functions {
 		// Ignore experimental functions for now.
@@ -83,11 +91,37 @@ type options struct {
 	enableAtModifier                  bool
 	enableVectorMatching              bool
 	enableExperimentalPromQLFunctions bool
+	enableUTF8Names                   bool
+	enableNoStepSubqueries            bool
+	enableDurationExpressions         bool
 	atModifierMaxTimestamp            int64
 
 	enforceLabelMatchers []*labels.Matcher
+	sampleTypes          map[string]SampleType
+
+	exprWeights  map[ExprType]float64
+	funcWeights  map[string]float64
+	aggrWeights  map[parser.ItemType]float64
+	binopWeights map[parser.ItemType]float64
+
+	numberLiteralWeights map[NumberLiteralKind]float64
+
+	// Probabilities are pointers to tell apart 0 from unset.
+	offsetProbability            *float64
+	atModifierProbability        *float64
+	vectorMatchingProbability    *float64
+	emptyLabelValueProbability   *float64
+	emptyResultRejectProbability *float64
+
+	rangeDurations  *DurationDistribution
+	offsetDurations *DurationDistribution
+
+	scrapeInterval time.Duration
+	costBudget     *CostBudget
 
 	maxDepth int // Maximum depth of the query expression tree
+
+	newSeededRand func(seed int64) Rand
 }
 
 func (o *options) applyDefaults() {
@@ -119,6 +153,26 @@ func (o *options) applyDefaults() {
 	if o.maxDepth == 0 {
 		o.maxDepth = 5 // Default max depth
 	}
+
+	if o.newSeededRand == nil {
+		o.newSeededRand = newMathRand
+	}
+
+	if o.scrapeInterval <= 0 {
+		o.scrapeInterval = defaultScrapeInterval
+	}
+
+	setDefaultProbability(&o.offsetProbability, defaultOffsetProbability)
+	setDefaultProbability(&o.atModifierProbability, defaultAtModifierProbability)
+	setDefaultProbability(&o.vectorMatchingProbability, defaultVectorMatchingProbability)
+	setDefaultProbability(&o.emptyLabelValueProbability, defaultEmptyLabelValueProbability)
+	setDefaultProbability(&o.emptyResultRejectProbability, defaultEmptyResultRejectProbability)
+}
+
+func setDefaultProbability(p **float64, defaultValue float64) {
+	if *p == nil {
+		*p = &defaultValue
+	}
 }
 
 // Option specifies options when generating queries.
@@ -138,6 +192,17 @@ func WithEnableOffset(enableOffset bool) Option {
 	})
 }
 
+// WithSeededRand sets how the random generator of each query is created from
+// its seed, like in WalkWithSeed. Defaults to *math/rand.Rand generators, the
+// generator passed to New only derives the seeds.
+func WithSeededRand(newSeededRand func(seed int64) Rand) Option {
+	return optionFunc(func(o *options) {
+		o.newSeededRand = newSeededRand
+	})
+}
+
+// WithAtModifierMaxTimestamp sets the max timestamp in milliseconds used in @
+// modifiers. Defaults to the current time when the instance is created.
 func WithAtModifierMaxTimestamp(atModifierMaxTimestamp int64) Option {
 	return optionFunc(func(o *options) {
 		o.atModifierMaxTimestamp = atModifierMaxTimestamp
@@ -162,6 +227,44 @@ func WithEnableExperimentalPromQLFunctions(enableExperimentalPromQLFunctions boo
 	})
 }
 
+// WithEnableNoStepSubqueries enables subqueries without a step, like
+// foo[5m:], which are evaluated at the default resolution of the engine. The
+// engine must set promql.EngineOpts.NoStepSubqueryIntervalFn to evaluate them.
+// Defaults to false.
+func WithEnableNoStepSubqueries(enableNoStepSubqueries bool) Option {
+	return optionFunc(func(o *options) {
+		o.enableNoStepSubqueries = enableNoStepSubqueries
+	})
+}
+
+// WithEnableDurationExpressions makes WalkDurationExprQuery print the ranges of
+// matrix selectors and subqueries, the steps of subqueries and offsets as
+// duration expressions, like x[5m * 2] or x offset (1h + 5m). They are only
+// supported by Prometheus versions with the promql-duration-expr feature flag,
+// and the parser this module depends on can't parse them. Defaults to false.
+func WithEnableDurationExpressions(enableDurationExpressions bool) Option {
+	return optionFunc(func(o *options) {
+		o.enableDurationExpressions = enableDurationExpressions
+	})
+}
+
+// WithEnableUTF8Names enables label names which are not valid legacy names,
+// like "label.with.dots". They are printed as quoted names in label matchers and
+// in by and without clauses, which is only supported since Prometheus 3, and label
+// names and values with random UTF-8 characters are also added to selectors and
+// grouping clauses. Parsing the generated queries requires the caller to set
+// model.NameValidationScheme = model.UTF8Validation. Vector matching with on and
+// ignoring only uses legacy names since the printer writes them unquoted. Metric
+// names which are not valid legacy names, like "my.metric", are matched with
+// {__name__="my.metric"}, which is what {"my.metric"} parses to, since the printer
+// doesn't support the quoted metric name form. If disabled, label names of the
+// series set which are not valid legacy names are ignored.
+func WithEnableUTF8Names(enableUTF8Names bool) Option {
+	return optionFunc(func(o *options) {
+		o.enableUTF8Names = enableUTF8Names
+	})
+}
+
 func WithEnabledBinOps(enabledBinops []parser.ItemType) Option {
 	return optionFunc(func(o *options) {
 		o.enabledBinops = enabledBinops
@@ -198,3 +301,136 @@ func WithMaxDepth(depth int) Option {
 		o.maxDepth = depth
 	})
 }
+
+// WithSeriesSampleTypes sets the sample type of series by metric name. It is used
+// to pick histogram series as arguments of histogram functions like histogram_quantile.
+// Series of metrics not in the map are classic histogram buckets if their name has the
+// _bucket suffix and they have an `le` label, otherwise they are float series.
+func WithSeriesSampleTypes(sampleTypes map[string]SampleType) Option {
+	return optionFunc(func(o *options) {
+		o.sampleTypes = sampleTypes
+	})
+}
+
+// WithExprWeights sets the relative weights used to pick expression types.
+// Expression types without a weight have a weight of 1 and a weight of 0 disables
+// the expression type unless no other one is allowed. Expression types are picked
+// uniformly if no weights are set.
+func WithExprWeights(weights map[ExprType]float64) Option {
+	return optionFunc(func(o *options) {
+		o.exprWeights = weights
+	})
+}
+
+// WithFunctionWeights sets the relative weights used to pick functions by name.
+// Weights work the same way as in WithExprWeights.
+func WithFunctionWeights(weights map[string]float64) Option {
+	return optionFunc(func(o *options) {
+		o.funcWeights = weights
+	})
+}
+
+// WithAggrWeights sets the relative weights used to pick aggregation operators.
+// Weights work the same way as in WithExprWeights.
+func WithAggrWeights(weights map[parser.ItemType]float64) Option {
+	return optionFunc(func(o *options) {
+		o.aggrWeights = weights
+	})
+}
+
+// WithBinOpWeights sets the relative weights used to pick binary operators.
+// Weights work the same way as in WithExprWeights.
+func WithBinOpWeights(weights map[parser.ItemType]float64) Option {
+	return optionFunc(func(o *options) {
+		o.binopWeights = weights
+	})
+}
+
+// WithOffsetProbability sets the probability of adding an offset to vector
+// selectors and subqueries when offset is enabled. Defaults to 0.5.
+func WithOffsetProbability(p float64) Option {
+	return optionFunc(func(o *options) {
+		o.offsetProbability = &p
+	})
+}
+
+// WithAtModifierProbability sets the probability of adding an @ modifier to vector
+// selectors and subqueries when the @ modifier is enabled. Defaults to 0.3.
+func WithAtModifierProbability(p float64) Option {
+	return optionFunc(func(o *options) {
+		o.atModifierProbability = &p
+	})
+}
+
+// WithVectorMatchingProbability sets the probability of generating vector matching
+// for binary expressions between vectors when vector matching is enabled. Defaults to 0.2.
+func WithVectorMatchingProbability(p float64) Option {
+	return optionFunc(func(o *options) {
+		o.vectorMatchingProbability = &p
+	})
+}
+
+// WithEmptyLabelValueProbability sets the probability of using an empty value in
+// equality label matchers. Defaults to 0.1.
+func WithEmptyLabelValueProbability(p float64) Option {
+	return optionFunc(func(o *options) {
+		o.emptyLabelValueProbability = &p
+	})
+}
+
+// WithEmptyResultRejectProbability sets the probability of regenerating vector
+// selectors and label matchers selecting none of the series, and queries which
+// provably return no series, like aggregations of such selectors. Expressions are
+// regenerated a few times at most, so a fraction of empty results remains even with
+// a probability of 1. Defaults to 0.
+func WithEmptyResultRejectProbability(p float64) Option {
+	return optionFunc(func(o *options) {
+		o.emptyResultRejectProbability = &p
+	})
+}
+
+// WithNumberLiteralWeights sets the relative weights used to pick the kinds of
+// number literals, like NaN or -0. Weights work the same way as in WithExprWeights.
+// Only floats in [0, 1) are generated unless weights are set.
+func WithNumberLiteralWeights(weights map[NumberLiteralKind]float64) Option {
+	return optionFunc(func(o *options) {
+		o.numberLiteralWeights = weights
+	})
+}
+
+// WithRangeDurations sets the distribution of the ranges of matrix selectors.
+// Ranges are between 1 and 5 whole minutes by default.
+func WithRangeDurations(d DurationDistribution) Option {
+	return optionFunc(func(o *options) {
+		o.rangeDurations = &d
+	})
+}
+
+// WithOffsetDurations sets the distribution of the absolute value of offsets,
+// which are negative half of the time. Offsets are less than 300 whole seconds
+// by default.
+func WithOffsetDurations(d DurationDistribution) Option {
+	return optionFunc(func(o *options) {
+		o.offsetDurations = &d
+	})
+}
+
+// WithScrapeInterval sets the scrape interval of the series set, which is used to
+// estimate the number of samples read by matrix selectors. Defaults to 1m.
+func WithScrapeInterval(d time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.scrapeInterval = d
+	})
+}
+
+// WithCostBudget sets the maximum estimated cost of generated queries, see
+// EstimateCost. Queries exceeding the budget are regenerated at decreasing depths
+// until one fits, so that shallower queries are generated rather than expensive
+// ones. If the budget is so low that few single selectors fit, the cheapest query
+// found is returned even though it exceeds the budget. Queries are not checked
+// against a budget by default.
+func WithCostBudget(b CostBudget) Option {
+	return optionFunc(func(o *options) {
+		o.costBudget = &b
+	})
+}
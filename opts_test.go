@@ -20,6 +20,24 @@ func TestWithEnableAtModifier(t *testing.T) {
 	require.True(t, o.enableAtModifier)
 }
 
+func TestWithEnableUTF8Names(t *testing.T) {
+	o := &options{}
+	WithEnableUTF8Names(true).apply(o)
+	require.True(t, o.enableUTF8Names)
+}
+
+func TestWithEnableDurationExpressions(t *testing.T) {
+	o := &options{}
+	WithEnableDurationExpressions(true).apply(o)
+	require.True(t, o.enableDurationExpressions)
+}
+
+func TestWithEnableNoStepSubqueries(t *testing.T) {
+	o := &options{}
+	WithEnableNoStepSubqueries(true).apply(o)
+	require.True(t, o.enableNoStepSubqueries)
+}
+
 func TestWithEnableExperimentalPromQL(t *testing.T) {
 	o := &options{}
 	WithEnableExperimentalPromQLFunctions(true).apply(o)
@@ -75,3 +93,64 @@ func TestWithMaxDepth(t *testing.T) {
 	o.applyDefaults()
 	require.Equal(t, 5, o.maxDepth) // Default depth
 }
+
+func TestWithSeriesSampleTypes(t *testing.T) {
+	o := &options{}
+	WithSeriesSampleTypes(map[string]SampleType{"foo": SampleTypeNativeHistogram}).apply(o)
+	require.Equal(t, map[string]SampleType{"foo": SampleTypeNativeHistogram}, o.sampleTypes)
+}
+
+func TestWithWeights(t *testing.T) {
+	o := &options{}
+	WithExprWeights(map[ExprType]float64{VectorSelector: 2}).apply(o)
+	WithFunctionWeights(map[string]float64{"abs": 0}).apply(o)
+	WithAggrWeights(map[parser.ItemType]float64{parser.SUM: 3}).apply(o)
+	WithBinOpWeights(map[parser.ItemType]float64{parser.ADD: 0.5}).apply(o)
+	require.Equal(t, map[ExprType]float64{VectorSelector: 2}, o.exprWeights)
+	require.Equal(t, map[string]float64{"abs": 0}, o.funcWeights)
+	require.Equal(t, map[parser.ItemType]float64{parser.SUM: 3}, o.aggrWeights)
+	require.Equal(t, map[parser.ItemType]float64{parser.ADD: 0.5}, o.binopWeights)
+}
+
+func TestWithProbabilities(t *testing.T) {
+	o := &options{}
+	o.applyDefaults()
+	require.Equal(t, defaultOffsetProbability, *o.offsetProbability)
+	require.Equal(t, defaultAtModifierProbability, *o.atModifierProbability)
+	require.Equal(t, defaultVectorMatchingProbability, *o.vectorMatchingProbability)
+	require.Equal(t, defaultEmptyLabelValueProbability, *o.emptyLabelValueProbability)
+	require.Equal(t, 0.0, *o.emptyResultRejectProbability)
+
+	o = &options{}
+	WithOffsetProbability(0).apply(o)
+	WithAtModifierProbability(1).apply(o)
+	WithVectorMatchingProbability(0.5).apply(o)
+	WithEmptyLabelValueProbability(0).apply(o)
+	WithEmptyResultRejectProbability(0.8).apply(o)
+	o.applyDefaults()
+	require.Equal(t, 0.0, *o.offsetProbability)
+	require.Equal(t, 1.0, *o.atModifierProbability)
+	require.Equal(t, 0.5, *o.vectorMatchingProbability)
+	require.Equal(t, 0.0, *o.emptyLabelValueProbability)
+	require.Equal(t, 0.8, *o.emptyResultRejectProbability)
+}
+
+func TestWithDurations(t *testing.T) {
+	o := &options{}
+	o.applyDefaults()
+	require.Nil(t, o.rangeDurations)
+	require.Nil(t, o.offsetDurations)
+
+	WithRangeDurations(DurationDistribution{Min: time.Second, Max: time.Hour}).apply(o)
+	WithOffsetDurations(DurationDistribution{Max: Day, MaxUnits: 2}).apply(o)
+	require.Equal(t, &DurationDistribution{Min: time.Second, Max: time.Hour}, o.rangeDurations)
+	require.Equal(t, &DurationDistribution{Max: Day, MaxUnits: 2}, o.offsetDurations)
+}
+
+func TestWithNumberLiteralWeights(t *testing.T) {
+	o := &options{}
+	o.applyDefaults()
+	require.Nil(t, o.numberLiteralWeights)
+	WithNumberLiteralWeights(map[NumberLiteralKind]float64{NumberLiteralNaN: 2}).apply(o)
+	require.Equal(t, map[NumberLiteralKind]float64{NumberLiteralNaN: 2}, o.numberLiteralWeights)
+}
@@ -0,0 +1,369 @@
+package promqlsmith
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+)
+
+// unknownLabelValue is the value of labels set from sample values, like the label
+// added by count_values, in the output series inferred by getOutputSeries.
+const unknownLabelValue = "__promqlsmith_unknown__"
+
+// getOutputSeries infers the labels of the series returned by the expression from the
+// series attached to its vector selectors. This is used in fuzzing vector matching and
+// functions taking label names. A bool value is returned alongside the output series,
+// which is true if the vector or matrix expression returns no series or if its output
+// can't be inferred, so the expression is not suitable for vector matching.
+//
+// The labels added by info from info metrics are not inferred.
+func getOutputSeries(expr parser.Expr) ([]labels.Labels, bool) {
+	lbls, ok := inferOutputSeries(expr)
+	if !ok {
+		return nil, true
+	}
+	series := expr.Type() == parser.ValueTypeVector || expr.Type() == parser.ValueTypeMatrix
+	return lbls, series && len(lbls) == 0
+}
+
+// inferOutputSeries returns the labels of the series returned by the expression,
+// and false if they can't be inferred. Expressions returning no series, like
+// selectors without series or scalars, have known empty output series.
+func inferOutputSeries(expr parser.Expr) ([]labels.Labels, bool) {
+	switch node := expr.(type) {
+	case *parser.VectorSelector:
+		lbls := make([]labels.Labels, len(node.Series))
+		for i, s := range node.Series {
+			lbls[i] = s.Labels()
+		}
+		return lbls, true
+	case *parser.StepInvariantExpr:
+		return inferOutputSeries(node.Expr)
+	case *parser.MatrixSelector:
+		return inferOutputSeries(node.VectorSelector)
+	case *parser.ParenExpr:
+		return inferOutputSeries(node.Expr)
+	case *parser.SubqueryExpr:
+		return inferOutputSeries(node.Expr)
+	case *parser.UnaryExpr:
+		lbls, ok := inferOutputSeries(node.Expr)
+		if !ok || node.Op != parser.SUB {
+			return lbls, ok
+		}
+		return dropMetricName(lbls), true
+	case *parser.NumberLiteral, *parser.StringLiteral:
+		return nil, true
+	case *parser.AggregateExpr:
+		return getAggregateOutputSeries(node)
+	case *parser.BinaryExpr:
+		return getBinaryOutputSeries(node)
+	case *parser.Call:
+		return getCallOutputSeries(node)
+	}
+	return nil, false
+}
+
+func getAggregateOutputSeries(node *parser.AggregateExpr) ([]labels.Labels, bool) {
+	lbls, ok := inferOutputSeries(node.Expr)
+	if !ok {
+		return nil, false
+	}
+	switch node.Op {
+	case parser.TOPK, parser.BOTTOMK, parser.LIMITK, parser.LIMIT_RATIO:
+		// The selected series are returned unchanged.
+		return lbls, true
+	}
+
+	countValuesLabel, _ := stringArg(node.Param)
+	output := make([]labels.Labels, 0, len(lbls))
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	for _, lbl := range lbls {
+		lb.Reset(lbl)
+		if node.Without {
+			lb.Del(node.Grouping...)
+			lb.Del(labels.MetricName)
+		} else {
+			lb.Keep(node.Grouping...)
+		}
+		if node.Op == parser.COUNT_VALUES && countValuesLabel != "" {
+			lb.Set(countValuesLabel, unknownLabelValue)
+		}
+		output = append(output, lb.Labels())
+	}
+	return uniqueLabels(output), true
+}
+
+func getBinaryOutputSeries(node *parser.BinaryExpr) ([]labels.Labels, bool) {
+	lhsVector := node.LHS.Type() == parser.ValueTypeVector
+	rhsVector := node.RHS.Type() == parser.ValueTypeVector
+	// Arithmetic operators and comparisons with the bool modifier drop the metric name.
+	dropName := node.ReturnBool || !(node.Op.IsComparisonOperator() || node.Op.IsSetOperator())
+	if !lhsVector || !rhsVector {
+		var lbls []labels.Labels
+		ok := true
+		switch {
+		case lhsVector:
+			lbls, ok = inferOutputSeries(node.LHS)
+		case rhsVector:
+			lbls, ok = inferOutputSeries(node.RHS)
+		}
+		if !ok || !dropName {
+			return lbls, ok
+		}
+		return dropMetricName(lbls), true
+	}
+
+	matching := node.VectorMatching
+	if matching == nil {
+		matching = &parser.VectorMatching{Card: parser.CardOneToOne}
+		if node.Op.IsSetOperator() {
+			matching.Card = parser.CardManyToMany
+		}
+	}
+	// The output of every operator depends on both sides, so it is unknown if
+	// either side is.
+	lhs, lhsOK := inferOutputSeries(node.LHS)
+	rhs, rhsOK := inferOutputSeries(node.RHS)
+	if !lhsOK || !rhsOK {
+		return nil, false
+	}
+	switch node.Op {
+	case parser.LOR:
+		return uniqueLabels(append(slices.Clone(lhs), matchingSeries(rhs, lhs, matching, false)...)), true
+	case parser.LUNLESS:
+		return uniqueLabels(matchingSeries(lhs, rhs, matching, false)), true
+	case parser.LAND:
+		return uniqueLabels(matchingSeries(lhs, rhs, matching, true)), true
+	}
+
+	// The one side of one-to-one and many-to-one matching is the right hand side.
+	many, one := lhs, rhs
+	if matching.Card == parser.CardOneToMany {
+		many, one = rhs, lhs
+	}
+	oneBySignature := make(map[string][]labels.Labels)
+	for _, lbl := range one {
+		sig := matchingSignature(lbl, matching)
+		oneBySignature[sig] = append(oneBySignature[sig], lbl)
+	}
+	output := make([]labels.Labels, 0, len(many))
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	for _, m := range many {
+		for _, o := range oneBySignature[matchingSignature(m, matching)] {
+			lb.Reset(m)
+			if dropName {
+				lb.Del(labels.MetricName)
+			}
+			if matching.Card == parser.CardOneToOne {
+				if matching.On {
+					lb.Keep(matching.MatchingLabels...)
+				} else {
+					lb.Del(matching.MatchingLabels...)
+				}
+			}
+			// Included labels are taken from the one side.
+			for _, name := range matching.Include {
+				lb.Set(name, o.Get(name))
+			}
+			output = append(output, lb.Labels())
+		}
+	}
+	return uniqueLabels(output), true
+}
+
+func getCallOutputSeries(node *parser.Call) ([]labels.Labels, bool) {
+	switch node.Func.Name {
+	case "absent", "absent_over_time":
+		// A series is only returned if the argument is empty, with the labels of its
+		// equality matchers.
+		if len(node.Args) == 0 {
+			return []labels.Labels{labels.EmptyLabels()}, true
+		}
+		return []labels.Labels{absentLabels(node.Args[0])}, true
+	}
+	if node.Func.ReturnType != parser.ValueTypeVector {
+		return nil, true
+	}
+
+	argIdx := -1
+	for i, arg := range node.Func.ArgTypes {
+		if i < len(node.Args) && (arg == parser.ValueTypeMatrix || arg == parser.ValueTypeVector) {
+			argIdx = i
+			break
+		}
+	}
+	// Functions like vector or time functions without argument return a single
+	// series without labels.
+	if argIdx < 0 {
+		return []labels.Labels{labels.EmptyLabels()}, true
+	}
+	lbls, ok := inferOutputSeries(node.Args[argIdx])
+	if !ok {
+		return nil, false
+	}
+
+	switch node.Func.Name {
+	case "label_replace":
+		return labelReplaceOutputSeries(lbls, node.Args)
+	case "label_join":
+		return labelJoinOutputSeries(lbls, node.Args)
+	case "info":
+		return lbls, true
+	case "histogram_quantile":
+		lb := labels.NewBuilder(labels.EmptyLabels())
+		output := make([]labels.Labels, 0, len(lbls))
+		for _, lbl := range lbls {
+			lb.Reset(lbl)
+			output = append(output, lb.Del(labels.MetricName, labels.BucketLabel).Labels())
+		}
+		return uniqueLabels(output), true
+	}
+	if _, ok := nameKeepingFuncs[node.Func.Name]; ok {
+		return lbls, true
+	}
+	return dropMetricName(lbls), true
+}
+
+// labelReplaceOutputSeries applies label_replace to the labels like the engine does.
+func labelReplaceOutputSeries(lbls []labels.Labels, args parser.Expressions) ([]labels.Labels, bool) {
+	if len(args) != 5 {
+		return nil, false
+	}
+	dst, ok1 := stringArg(args[1])
+	replacement, ok2 := stringArg(args[2])
+	src, ok3 := stringArg(args[3])
+	regex, ok4 := stringArg(args[4])
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return nil, false
+	}
+	re, err := regexp.Compile("^(?s:" + regex + ")$")
+	if err != nil {
+		return nil, false
+	}
+	output := make([]labels.Labels, 0, len(lbls))
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	for _, lbl := range lbls {
+		lb.Reset(lbl)
+		value := lbl.Get(src)
+		if indexes := re.FindStringSubmatchIndex(value); indexes != nil {
+			lb.Set(dst, string(re.ExpandString(nil, replacement, value, indexes)))
+		}
+		output = append(output, lb.Labels())
+	}
+	return uniqueLabels(output), true
+}
+
+// labelJoinOutputSeries applies label_join to the labels like the engine does.
+func labelJoinOutputSeries(lbls []labels.Labels, args parser.Expressions) ([]labels.Labels, bool) {
+	if len(args) < 3 {
+		return nil, false
+	}
+	dst, ok1 := stringArg(args[1])
+	sep, ok2 := stringArg(args[2])
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+	srcs := make([]string, 0, len(args)-3)
+	for _, arg := range args[3:] {
+		src, ok := stringArg(arg)
+		if !ok {
+			return nil, false
+		}
+		srcs = append(srcs, src)
+	}
+	output := make([]labels.Labels, 0, len(lbls))
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	values := make([]string, len(srcs))
+	for _, lbl := range lbls {
+		for i, src := range srcs {
+			values[i] = lbl.Get(src)
+		}
+		lb.Reset(lbl)
+		output = append(output, lb.Set(dst, strings.Join(values, sep)).Labels())
+	}
+	return uniqueLabels(output), true
+}
+
+// absentLabels returns the labels of the series returned by absent and
+// absent_over_time, which are the labels of the equality matchers of the selector
+// except labels with several matchers.
+func absentLabels(expr parser.Expr) labels.Labels {
+	var matchers []*labels.Matcher
+	switch node := expr.(type) {
+	case *parser.VectorSelector:
+		matchers = node.LabelMatchers
+	case *parser.MatrixSelector:
+		matchers = node.VectorSelector.(*parser.VectorSelector).LabelMatchers
+	default:
+		return labels.EmptyLabels()
+	}
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	seen := make(map[string]struct{}, len(matchers))
+	for _, m := range matchers {
+		if m.Name == labels.MetricName {
+			continue
+		}
+		if _, ok := seen[m.Name]; !ok && m.Type == labels.MatchEqual {
+			lb.Set(m.Name, m.Value)
+		} else {
+			lb.Del(m.Name)
+		}
+		seen[m.Name] = struct{}{}
+	}
+	return lb.Labels()
+}
+
+// matchingSignature returns the labels used to match series of both sides of a
+// binary expression.
+func matchingSignature(lbls labels.Labels, matching *parser.VectorMatching) string {
+	return lbls.MatchLabels(matching.On, matching.MatchingLabels...).String()
+}
+
+// matchingSeries returns the series of a which match a series of b if match is true,
+// or which don't match any series of b otherwise.
+func matchingSeries(a, b []labels.Labels, matching *parser.VectorMatching, match bool) []labels.Labels {
+	signatures := make(map[string]struct{}, len(b))
+	for _, lbl := range b {
+		signatures[matchingSignature(lbl, matching)] = struct{}{}
+	}
+	output := make([]labels.Labels, 0, len(a))
+	for _, lbl := range a {
+		if _, ok := signatures[matchingSignature(lbl, matching)]; ok == match {
+			output = append(output, lbl)
+		}
+	}
+	return output
+}
+
+func dropMetricName(lbls []labels.Labels) []labels.Labels {
+	output := make([]labels.Labels, 0, len(lbls))
+	for _, lbl := range lbls {
+		output = append(output, lbl.DropMetricName())
+	}
+	return uniqueLabels(output)
+}
+
+// uniqueLabels sorts the labels and removes duplicates.
+func uniqueLabels(lbls []labels.Labels) []labels.Labels {
+	sort.Slice(lbls, func(i, j int) bool {
+		return labels.Compare(lbls[i], lbls[j]) < 0
+	})
+	return slices.CompactFunc(lbls, labels.Equal)
+}
+
+// stringArg returns the value of a string literal argument.
+func stringArg(expr parser.Expr) (string, bool) {
+	switch node := expr.(type) {
+	case *parser.StringLiteral:
+		return node.Val, true
+	case *parser.ParenExpr:
+		return stringArg(node.Expr)
+	case *parser.StepInvariantExpr:
+		return stringArg(node.Expr)
+	}
+	return "", false
+}
@@ -0,0 +1,127 @@
+package promqlsmith
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/promql/promqltest"
+	"github.com/stretchr/testify/require"
+)
+
+// TestGetOutputSeriesMatchesEngine checks that the series returned by the engine
+// are among the output series inferred for generated queries. Metric names are
+// ignored since the engine doesn't always drop them, like in -x <= -x or in
+// last_over_time((-x)[5m:1m]).
+func TestGetOutputSeriesMatchesEngine(t *testing.T) {
+	var load strings.Builder
+	load.WriteString("load 30s\n")
+	for _, lbls := range testSeriesSet {
+		fmt.Fprintf(&load, "%s 1+1x20\n", lbls.String())
+	}
+	st := promqltest.LoadedStorage(t, load.String())
+	t.Cleanup(func() { st.Close() })
+
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet,
+		WithEnableVectorMatching(true),
+		WithVectorMatchingProbability(0.5),
+		// count_values sets labels from sample values, which are not inferred.
+		WithAggrWeights(map[parser.ItemType]float64{parser.COUNT_VALUES: 0}),
+	)
+	ctx := context.Background()
+	engine := promqltest.NewTestEngine(t, false, 0, promqltest.DefaultMaxSamplesPerQuery)
+	for i := 0; i < 100; i++ {
+		expr := ps.WalkInstantQuery()
+		inferred, stop := getOutputSeries(expr)
+		if stop || expr.Type() != parser.ValueTypeVector {
+			continue
+		}
+		q, err := engine.NewInstantQuery(ctx, st, nil, expr.String(), time.Unix(0, 0).Add(5*time.Minute))
+		require.NoError(t, err)
+		res := q.Exec(ctx)
+		q.Close()
+		if res.Err != nil {
+			continue
+		}
+		vector, err := res.Vector()
+		require.NoError(t, err)
+		set := make(map[string]struct{}, len(inferred))
+		for _, lbls := range inferred {
+			set[lbls.DropMetricName().String()] = struct{}{}
+		}
+		for _, s := range vector {
+			require.Contains(t, set, s.Metric.DropMetricName().String(), "%s", expr)
+		}
+	}
+}
+
+func TestGetOutputSeriesFromQuery(t *testing.T) {
+	series := []labels.Labels{
+		labels.FromStrings(labels.MetricName, "a", "job", "prometheus", "instance", "1", "code", "200"),
+		labels.FromStrings(labels.MetricName, "a", "job", "prometheus", "instance", "2", "code", "500"),
+		labels.FromStrings(labels.MetricName, "b", "job", "prometheus", "instance", "1"),
+		labels.FromStrings(labels.MetricName, "b", "job", "node", "instance", "3"),
+	}
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	p := New(rnd, series)
+	for i, tc := range []struct {
+		query        string
+		expected     []string
+		expectedStop bool
+	}{
+		{query: `-b`, expected: []string{`{instance="1", job="prometheus"}`, `{instance="3", job="node"}`}},
+		{query: `b > 1`, expected: []string{`{__name__="b", instance="1", job="prometheus"}`, `{__name__="b", instance="3", job="node"}`}},
+		{query: `b > bool 1`, expected: []string{`{instance="1", job="prometheus"}`, `{instance="3", job="node"}`}},
+		{query: `topk(1, b)`, expected: []string{`{__name__="b", instance="1", job="prometheus"}`, `{__name__="b", instance="3", job="node"}`}},
+		{query: `count_values by (job) ("value", b)`, expected: []string{`{job="node", value="__promqlsmith_unknown__"}`, `{job="prometheus", value="__promqlsmith_unknown__"}`}},
+		{query: `sum without (instance) (a)`, expected: []string{`{code="200", job="prometheus"}`, `{code="500", job="prometheus"}`}},
+		{query: `a + on (instance) b`, expected: []string{`{instance="1"}`}},
+		{query: `a > ignoring (code) b`, expected: []string{`{__name__="a", instance="1", job="prometheus"}`}},
+		{query: `a * on (job) group_left (instance) sum by (job) (b)`, expected: []string{`{code="200", job="prometheus"}`, `{code="500", job="prometheus"}`}},
+		{query: `a * on (instance) group_left (job) label_replace(b, "job", "x", "", "")`, expected: []string{`{code="200", instance="1", job="x"}`}},
+		{query: `sum by (job) (b) / on (job) group_right () a`, expected: []string{`{code="200", instance="1", job="prometheus"}`, `{code="500", instance="2", job="prometheus"}`}},
+		{query: `a + b`, expectedStop: true},
+		{query: `a and on (instance) b`, expected: []string{`{__name__="a", code="200", instance="1", job="prometheus"}`}},
+		{query: `a unless on (instance) b`, expected: []string{`{__name__="a", code="500", instance="2", job="prometheus"}`}},
+		{query: `b or on (instance) a`, expected: []string{`{__name__="a", code="500", instance="2", job="prometheus"}`, `{__name__="b", instance="1", job="prometheus"}`, `{__name__="b", instance="3", job="node"}`}},
+		{query: `not_exist or b{job="node"}`, expected: []string{`{__name__="b", instance="3", job="node"}`}},
+		{query: `label_replace(b, "dst", "$1", "instance", "(") or a`, expectedStop: true},
+		{query: `a or label_replace(b, "dst", "$1", "instance", "(")`, expectedStop: true},
+		{query: `label_replace(b, "dst", "x-$1", "instance", "(.*)")`, expected: []string{`{__name__="b", dst="x-1", instance="1", job="prometheus"}`, `{__name__="b", dst="x-3", instance="3", job="node"}`}},
+		{query: `label_replace(b, "instance", "", "job", "node")`, expected: []string{`{__name__="b", instance="1", job="prometheus"}`, `{__name__="b", job="node"}`}},
+		{query: `label_join(b, "dst", "-", "job", "instance")`, expected: []string{`{__name__="b", dst="node-3", instance="3", job="node"}`, `{__name__="b", dst="prometheus-1", instance="1", job="prometheus"}`}},
+		{query: `sort(rate(b[5m]))`, expected: []string{`{instance="1", job="prometheus"}`, `{instance="3", job="node"}`}},
+		{query: `last_over_time(b[5m])`, expected: []string{`{__name__="b", instance="1", job="prometheus"}`, `{__name__="b", instance="3", job="node"}`}},
+		{query: `absent(not_exist{job="a", instance=~"1", code="1", code="2"})`, expected: []string{`{job="a"}`}},
+		{query: `vector(1)`, expected: []string{`{}`}},
+		{query: `not_exist`, expectedStop: true},
+		{query: `sum(not_exist)`, expectedStop: true},
+	} {
+		t.Run(fmt.Sprintf("test_case_%d", i), func(t *testing.T) {
+			expr, err := parser.ParseExpr(tc.query)
+			require.NoError(t, err)
+			parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+				if vs, ok := node.(*parser.VectorSelector); ok {
+					p.populateSeries(vs)
+				}
+				return nil
+			})
+			output, stop := getOutputSeries(expr)
+			require.Equal(t, tc.expectedStop, stop)
+			if tc.expectedStop {
+				return
+			}
+			result := make([]string, 0, len(output))
+			for _, lbls := range output {
+				result = append(result, lbls.String())
+			}
+			require.Equal(t, tc.expected, result)
+		})
+	}
+}
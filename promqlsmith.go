@@ -1,10 +1,14 @@
 package promqlsmith
 
 import (
-	"math/rand"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
 )
 
 type ExprType int
@@ -20,6 +24,37 @@ const (
 	UnaryExpr
 )
 
+var exprTypeNames = map[ExprType]string{
+	VectorSelector: "VectorSelector",
+	MatrixSelector: "MatrixSelector",
+	AggregateExpr:  "AggregateExpr",
+	BinaryExpr:     "BinaryExpr",
+	SubQueryExpr:   "SubQueryExpr",
+	CallExpr:       "CallExpr",
+	NumberLiteral:  "NumberLiteral",
+	UnaryExpr:      "UnaryExpr",
+}
+
+func (e ExprType) String() string {
+	if name, ok := exprTypeNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("ExprType(%d)", int(e))
+}
+
+// SampleType is the type of samples stored in a series.
+type SampleType int
+
+const (
+	// SampleTypeFloat is a series of float samples like a counter or a gauge.
+	SampleTypeFloat SampleType = iota
+	// SampleTypeClassicHistogramBucket is a bucket series of a classic histogram
+	// with an `le` label.
+	SampleTypeClassicHistogramBucket
+	// SampleTypeNativeHistogram is a series of native histogram samples.
+	SampleTypeNativeHistogram
+)
+
 // Add minimum depth requirements for each ExprType
 var exprMinDepth = map[ExprType]int{
 	VectorSelector: 1,
@@ -40,6 +75,7 @@ var (
 	}
 
 	vectorAndScalarValueTypes = []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeScalar}
+	instantQueryValueTypes    = []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeScalar, parser.ValueTypeMatrix}
 
 	allValueTypes = []parser.ValueType{
 		parser.ValueTypeVector,
@@ -50,16 +86,38 @@ var (
 )
 
 type PromQLSmith struct {
-	rnd *rand.Rand
+	rnd           Rand
+	newSeededRand func(seed int64) Rand
+	lastSeed      int64
 
 	enableOffset             bool
 	enableAtModifier         bool
 	enableVectorMatching     bool
 	enableExperimentalPromQL bool
+	enableUTF8Names          bool
+	enableNoStepSubqueries   bool
+	enableDurationExprs      bool
 	atModifierMaxTimestamp   int64
 	maxDepth                 int
 
+	offsetProbability            float64
+	atModifierProbability        float64
+	vectorMatchingProbability    float64
+	emptyLabelValueProbability   float64
+	emptyResultRejectProbability float64
+
+	numberLiteralWeights map[NumberLiteralKind]float64
+
+	rangeDurations  *DurationDistribution
+	offsetDurations *DurationDistribution
+
+	scrapeInterval time.Duration
+	costBudget     *CostBudget
+
 	seriesSet       []labels.Labels
+	sampleTypes     map[string]SampleType
+	bucketSeries    []labels.Labels
+	histogramSeries []labels.Labels
 	labelNames      []string
 	labelValues     map[string][]string
 	enforceMatchers []*labels.Matcher
@@ -68,10 +126,16 @@ type PromQLSmith struct {
 	supportedAggrs  []parser.ItemType
 	supportedFuncs  []*parser.Function
 	supportedBinops []parser.ItemType
+
+	exprWeights  map[ExprType]float64
+	funcWeights  map[string]float64
+	aggrWeights  map[parser.ItemType]float64
+	binopWeights map[parser.ItemType]float64
 }
 
-// New creates a PromQLsmith instance.
-func New(rnd *rand.Rand, seriesSet []labels.Labels, opts ...Option) *PromQLSmith {
+// New creates a PromQLsmith instance. rnd derives the seed of each query, which
+// is generated with the generator created from its seed, see WithSeededRand.
+func New(rnd Rand, seriesSet []labels.Labels, opts ...Option) *PromQLSmith {
 	options := options{}
 	for _, o := range opts {
 		o.apply(&options)
@@ -80,6 +144,7 @@ func New(rnd *rand.Rand, seriesSet []labels.Labels, opts ...Option) *PromQLSmith
 
 	ps := &PromQLSmith{
 		rnd:                      rnd,
+		newSeededRand:            options.newSeededRand,
 		seriesSet:                filterEmptySeries(seriesSet),
 		supportedExprs:           options.enabledExprs,
 		supportedAggrs:           options.enabledAggrs,
@@ -90,27 +155,87 @@ func New(rnd *rand.Rand, seriesSet []labels.Labels, opts ...Option) *PromQLSmith
 		atModifierMaxTimestamp:   options.atModifierMaxTimestamp,
 		enableVectorMatching:     options.enableVectorMatching,
 		enableExperimentalPromQL: options.enableExperimentalPromQLFunctions,
+		enableUTF8Names:          options.enableUTF8Names,
+		enableNoStepSubqueries:   options.enableNoStepSubqueries,
+		enableDurationExprs:      options.enableDurationExpressions,
 		enforceMatchers:          options.enforceLabelMatchers,
 		maxDepth:                 options.maxDepth,
+		sampleTypes:              options.sampleTypes,
+		exprWeights:              options.exprWeights,
+		funcWeights:              options.funcWeights,
+		aggrWeights:              options.aggrWeights,
+		binopWeights:             options.binopWeights,
+		numberLiteralWeights:     options.numberLiteralWeights,
+		rangeDurations:           options.rangeDurations,
+		offsetDurations:          options.offsetDurations,
+		scrapeInterval:           options.scrapeInterval,
+		costBudget:               options.costBudget,
+
+		offsetProbability:            *options.offsetProbability,
+		atModifierProbability:        *options.atModifierProbability,
+		vectorMatchingProbability:    *options.vectorMatchingProbability,
+		emptyLabelValueProbability:   *options.emptyLabelValueProbability,
+		emptyResultRejectProbability: *options.emptyResultRejectProbability,
 	}
 	ps.labelNames, ps.labelValues = labelNameAndValuesFromLabelSet(seriesSet)
+	if !ps.enableUTF8Names {
+		ps.labelNames = slices.DeleteFunc(ps.labelNames, func(name string) bool {
+			return !isLegacyLabelName(name)
+		})
+	}
+	for _, series := range ps.seriesSet {
+		switch ps.sampleTypeOf(series) {
+		case SampleTypeClassicHistogramBucket:
+			ps.bucketSeries = append(ps.bucketSeries, series)
+		case SampleTypeNativeHistogram:
+			ps.histogramSeries = append(ps.histogramSeries, series)
+		}
+	}
 	return ps
 }
 
+// sampleTypeOf returns the sample type of the series. If the metric doesn't have a
+// sample type configured, series named *_bucket with an `le` label are considered
+// classic histogram buckets and everything else float series.
+func (s *PromQLSmith) sampleTypeOf(series labels.Labels) SampleType {
+	name := series.Get(labels.MetricName)
+	if t, ok := s.sampleTypes[name]; ok {
+		return t
+	}
+	if strings.HasSuffix(name, "_bucket") && series.Has(labels.BucketLabel) {
+		return SampleTypeClassicHistogramBucket
+	}
+	return SampleTypeFloat
+}
+
 // WalkInstantQuery walks the ast and generate an expression that can be used in
 // instant query. Instant query also supports string literal, but we skip it here.
 func (s *PromQLSmith) WalkInstantQuery() parser.Expr {
-	return s.Walk(parser.ValueTypeVector, parser.ValueTypeScalar, parser.ValueTypeMatrix)
+	return s.WalkInstantQueryWithSeed(s.rnd.Int63())
+}
+
+// WalkInstantQueryWithSeed is like WalkInstantQuery but uses the given seed.
+func (s *PromQLSmith) WalkInstantQueryWithSeed(seed int64) parser.Expr {
+	return s.WalkWithSeed(seed, instantQueryValueTypes...)
 }
 
 // WalkRangeQuery walks the ast and generate an expression that can be used in range query.
 func (s *PromQLSmith) WalkRangeQuery() parser.Expr {
-	return s.Walk(vectorAndScalarValueTypes...)
+	return s.WalkRangeQueryWithSeed(s.rnd.Int63())
+}
+
+// WalkRangeQueryWithSeed is like WalkRangeQuery but uses the given seed.
+func (s *PromQLSmith) WalkRangeQueryWithSeed(seed int64) parser.Expr {
+	return s.WalkWithSeed(seed, vectorAndScalarValueTypes...)
 }
 
 // WalkSelectors generates random label matchers based on the input series labels.
 func (s *PromQLSmith) WalkSelectors() []*labels.Matcher {
-	return s.walkSelectors()
+	matchers := s.walkSelectors()
+	for i := 0; i < maxEmptyResultRetries && !s.matchesAnySeries(matchers) && s.rejectEmptyResult(); i++ {
+		matchers = s.walkSelectors()
+	}
+	return matchers
 }
 
 // intersectExprTypes returns the intersection of two ExprType slices
@@ -128,8 +253,66 @@ func intersectExprTypes(a, b []ExprType) []ExprType {
 }
 
 // Walk will walk the ast tree using one of the randomly generated expr type.
+// Each call derives a new seed from the random generator passed to New, which can
+// be retrieved with LastSeed to regenerate the same expression with WalkWithSeed.
 func (s *PromQLSmith) Walk(valueTypes ...parser.ValueType) parser.Expr {
-	return s.walk(s.maxDepth, valueTypes...)
+	return s.WalkWithSeed(s.rnd.Int63(), valueTypes...)
+}
+
+// WalkWithSeed walks the ast tree like Walk, but uses the given seed instead of
+// deriving a new one. PromQLSmith instances created with the same options and
+// series set generate the same expression for the same seed and value types.
+// WithAtModifierMaxTimestamp defaults to the current time, so it must be set
+// explicitly to regenerate expressions with @ modifiers.
+func (s *PromQLSmith) WalkWithSeed(seed int64, valueTypes ...parser.ValueType) (expr parser.Expr) {
+	s.withSeed(seed, func() { expr = s.walkRoot(valueTypes...) })
+	return expr
+}
+
+// WalkRand walks the ast tree like Walk, but draws every random decision from rnd
+// instead of a generator seeded by the one passed to New. Wrapping rnd with
+// NewRecorder records the decisions, which NewReplay replays to generate the
+// same expression again.
+func (s *PromQLSmith) WalkRand(rnd Rand, valueTypes ...parser.ValueType) (expr parser.Expr) {
+	s.withRand(rnd, func() { expr = s.walkRoot(valueTypes...) })
+	return expr
+}
+
+// withSeed runs fn with a generator created from seed by the function set with
+// WithSeededRand, and remembers seed as the last seed.
+func (s *PromQLSmith) withSeed(seed int64, fn func()) {
+	s.lastSeed = seed
+	s.withRand(s.newSeededRand(seed), fn)
+}
+
+// withRand runs fn with rnd as the random generator, restoring the generator
+// passed to New afterwards.
+func (s *PromQLSmith) withRand(rnd Rand, fn func()) {
+	root := s.rnd
+	s.rnd = rnd
+	defer func() { s.rnd = root }()
+	fn()
+}
+
+// walkRoot generates an expression with the current random generator,
+// regenerating it if it provably returns no series or exceeds the cost budget.
+func (s *PromQLSmith) walkRoot(valueTypes ...parser.ValueType) parser.Expr {
+	expr := s.walk(s.maxDepth, valueTypes...)
+	for i := 0; i < maxEmptyResultRetries && returnsNoSeries(expr) && s.rejectEmptyResult(); i++ {
+		expr = s.walk(s.maxDepth, valueTypes...)
+	}
+	return s.fitCostBudget(expr, valueTypes...)
+}
+
+// rejectEmptyResult randomly decides whether an expression or label matchers
+// selecting no series should be regenerated.
+func (s *PromQLSmith) rejectEmptyResult() bool {
+	return s.emptyResultRejectProbability > 0 && s.rnd.Float64() < s.emptyResultRejectProbability
+}
+
+// LastSeed returns the seed used to generate the last expression.
+func (s *PromQLSmith) LastSeed() int64 {
+	return s.lastSeed
 }
 
 // filterNumberLiteral removes NumberLiteral from validExprs unless it's the only option
@@ -156,6 +339,10 @@ func (s *PromQLSmith) walk(depth int, valueTypes ...parser.ValueType) parser.Exp
 	// Filter expressions based on remaining depth
 	validExprs := make([]ExprType, 0, len(supportedExprs))
 	for _, expr := range supportedExprs {
+		// Skip calls if none of the enabled functions returns the wanted value types.
+		if expr == CallExpr && len(s.funcsReturning(valueTypes...)) == 0 {
+			continue
+		}
 		if minDepth := exprMinDepth[expr]; depth >= minDepth {
 			validExprs = append(validExprs, expr)
 		}
@@ -167,11 +354,48 @@ func (s *PromQLSmith) walk(depth int, valueTypes ...parser.ValueType) parser.Exp
 	}
 
 	validExprs = filterNumberLiteral(validExprs)
-	e := validExprs[s.rnd.Intn(len(validExprs))]
+	e := pickWeighted(s.rnd, validExprs, s.exprWeights, func(e ExprType) ExprType { return e })
 	expr, _ := s.walkExpr(e, depth, valueTypes...)
 	return expr
 }
 
+// pickWeighted picks a random item using the weight of its key. Items without a weight
+// have a weight of 1. Items are picked uniformly if there are no weights or if all
+// items have a weight of 0.
+func pickWeighted[T any, K comparable](rnd Rand, items []T, weights map[K]float64, key func(T) K) T {
+	if len(weights) == 0 {
+		return items[rnd.Intn(len(items))]
+	}
+	weightOf := func(item T) float64 {
+		w, ok := weights[key(item)]
+		if !ok {
+			return 1
+		}
+		return max(w, 0)
+	}
+	total := 0.0
+	for _, item := range items {
+		total += weightOf(item)
+	}
+	if total == 0 {
+		return items[rnd.Intn(len(items))]
+	}
+	r := rnd.Float64() * total
+	for _, item := range items {
+		r -= weightOf(item)
+		if r < 0 {
+			return item
+		}
+	}
+	// Only reached because of floating point rounding.
+	for i := len(items) - 1; i >= 0; i-- {
+		if weightOf(items[i]) > 0 {
+			return items[i]
+		}
+	}
+	return items[len(items)-1]
+}
+
 func filterEmptySeries(seriesSet []labels.Labels) []labels.Labels {
 	output := make([]labels.Labels, 0, len(seriesSet))
 	for _, lbls := range seriesSet {
@@ -201,6 +425,9 @@ func labelNameAndValuesFromLabelSet(labelSet []labels.Labels) ([]string, map[str
 		for val := range values {
 			labelValues[name] = append(labelValues[name], val)
 		}
+		// Sort so that the same seed generates the same expression.
+		sort.Strings(labelValues[name])
 	}
+	sort.Strings(labelNames)
 	return labelNames, labelValues
 }
@@ -128,6 +128,38 @@ func TestWalk(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestWalkWithSeed(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	opts := []Option{
+		WithEnableOffset(true),
+		WithEnableAtModifier(true),
+		WithEnableVectorMatching(true),
+		WithAtModifierMaxTimestamp(time.Now().UnixMilli()),
+	}
+	ps := New(rnd, testSeriesSet, opts...)
+	for i := 0; i < 50; i++ {
+		var expr parser.Expr
+		var replay func(*PromQLSmith, int64) parser.Expr
+		switch i % 3 {
+		case 0:
+			expr = ps.Walk()
+			replay = func(ps *PromQLSmith, seed int64) parser.Expr { return ps.WalkWithSeed(seed) }
+		case 1:
+			expr = ps.WalkInstantQuery()
+			replay = (*PromQLSmith).WalkInstantQueryWithSeed
+		case 2:
+			expr = ps.WalkRangeQuery()
+			replay = (*PromQLSmith).WalkRangeQueryWithSeed
+		}
+		seed := ps.LastSeed()
+
+		// A fresh instance with a different root generator regenerates the same query.
+		other := New(rand.New(rand.NewSource(int64(i))), testSeriesSet, opts...)
+		require.Equal(t, expr.String(), replay(other, seed).String())
+		require.Equal(t, seed, other.LastSeed())
+	}
+}
+
 func TestWalkSelectors(t *testing.T) {
 	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
 	ps := New(rnd, testSeriesSet)
@@ -150,6 +182,69 @@ func TestWalkSelectors(t *testing.T) {
 	require.True(t, found)
 }
 
+func TestSampleTypeOf(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	seriesSet := []labels.Labels{
+		labels.FromStrings(labels.MetricName, "foo_bucket", "le", "1"),
+		labels.FromStrings(labels.MetricName, "foo_count"),
+		labels.FromStrings(labels.MetricName, "bar_bucket"),
+		labels.FromStrings(labels.MetricName, "baz", "job", "test"),
+		labels.FromStrings(labels.MetricName, "qux_bucket", "le", "1"),
+	}
+	ps := New(rnd, seriesSet, WithSeriesSampleTypes(map[string]SampleType{
+		"baz":        SampleTypeNativeHistogram,
+		"qux_bucket": SampleTypeFloat,
+	}))
+	for i, expected := range []SampleType{
+		SampleTypeClassicHistogramBucket,
+		SampleTypeFloat,
+		SampleTypeFloat,
+		SampleTypeNativeHistogram,
+		SampleTypeFloat,
+	} {
+		require.Equal(t, expected, ps.sampleTypeOf(seriesSet[i]), seriesSet[i].String())
+	}
+	require.Equal(t, seriesSet[:1], ps.bucketSeries)
+	require.Equal(t, seriesSet[3:4], ps.histogramSeries)
+}
+
+func TestPickWeighted(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	identity := func(s string) string { return s }
+	for i, tc := range []struct {
+		items    []string
+		weights  map[string]float64
+		expected []string
+	}{
+		{
+			items:    []string{"a", "b", "c"},
+			weights:  nil,
+			expected: []string{"a", "b", "c"},
+		},
+		{
+			items:    []string{"a", "b", "c"},
+			weights:  map[string]float64{"a": 0, "b": 0},
+			expected: []string{"c"},
+		},
+		{
+			items:    []string{"a", "b", "c"},
+			weights:  map[string]float64{"a": 0, "b": 0, "c": 0},
+			expected: []string{"a", "b", "c"},
+		},
+		{
+			items:    []string{"a", "b"},
+			weights:  map[string]float64{"a": -1},
+			expected: []string{"b"},
+		},
+	} {
+		t.Run(fmt.Sprintf("test_case_%d", i), func(t *testing.T) {
+			for j := 0; j < 100; j++ {
+				require.Contains(t, tc.expected, pickWeighted(rnd, tc.items, tc.weights, identity))
+			}
+		})
+	}
+}
+
 func TestFilterEmptySeries(t *testing.T) {
 	for i, tc := range []struct {
 		ss       []labels.Labels
@@ -325,3 +420,23 @@ func getExprDepth(expr parser.Expr) int {
 		return 1
 	}
 }
+
+func TestWithEmptyResultRejectProbability(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	countEmpty := func(p float64) (selectors, queries int) {
+		ps := New(rnd, testSeriesSet, WithEmptyResultRejectProbability(p), WithEmptyLabelValueProbability(0.5))
+		for i := 0; i < 200; i++ {
+			if !ps.matchesAnySeries(ps.WalkSelectors()) {
+				selectors++
+			}
+			if returnsNoSeries(ps.WalkRangeQuery()) {
+				queries++
+			}
+		}
+		return selectors, queries
+	}
+	selectors, queries := countEmpty(0)
+	rejectedSelectors, rejectedQueries := countEmpty(1)
+	require.Less(t, rejectedSelectors, selectors)
+	require.Less(t, rejectedQueries, queries)
+}
@@ -0,0 +1,181 @@
+package promqlsmith
+
+import (
+	"fmt"
+	"math/rand"
+	randv2 "math/rand/v2"
+)
+
+// Rand is the source of every random decision made while generating queries.
+// *math/rand.Rand implements it, NewRandV2 adapts math/rand/v2 generators and
+// NewRecorder and NewReplay record and replay the decisions of another Rand.
+type Rand interface {
+	// Int63 returns a non-negative 63-bit integer.
+	Int63() int64
+	// Int63n returns an integer in [0, n). It panics if n <= 0.
+	Int63n(n int64) int64
+	// Intn returns an integer in [0, n). It panics if n <= 0.
+	Intn(n int) int
+	// Float64 returns a float in [0.0, 1.0).
+	Float64() float64
+}
+
+type randV2 struct {
+	rnd *randv2.Rand
+}
+
+// NewRandV2 returns a Rand drawing its values from a math/rand/v2 generator.
+func NewRandV2(rnd *randv2.Rand) Rand {
+	return randV2{rnd: rnd}
+}
+
+func (r randV2) Int63() int64         { return r.rnd.Int64() }
+func (r randV2) Int63n(n int64) int64 { return r.rnd.Int64N(n) }
+func (r randV2) Intn(n int) int       { return r.rnd.IntN(n) }
+func (r randV2) Float64() float64     { return r.rnd.Float64() }
+
+// newMathRand is the default generator of the queries generated from a seed.
+func newMathRand(seed int64) Rand {
+	return rand.New(rand.NewSource(seed))
+}
+
+// perm returns a random permutation of [0, n). It is the same algorithm as
+// math/rand.Rand.Perm, so *math/rand.Rand generators return the same permutations.
+func perm(rnd Rand, n int) []int {
+	m := make([]int, n)
+	for i := 0; i < n; i++ {
+		j := rnd.Intn(i + 1)
+		m[i] = m[j]
+		m[j] = i
+	}
+	return m
+}
+
+// Decision is a value returned by a Rand.
+type Decision struct {
+	// Method is the name of the Rand method which returned the value.
+	Method string `json:"method"`
+	// N is the argument of Int63n and Intn.
+	N int64 `json:"n,omitempty"`
+	// Int is the value returned by Int63, Int63n and Intn.
+	Int int64 `json:"int,omitempty"`
+	// Float is the value returned by Float64.
+	Float float64 `json:"float,omitempty"`
+}
+
+// Recorder is a Rand recording the decisions of another Rand.
+type Recorder struct {
+	rnd       Rand
+	decisions []Decision
+}
+
+// NewRecorder returns a Rand recording the values returned by rnd.
+func NewRecorder(rnd Rand) *Recorder {
+	return &Recorder{rnd: rnd}
+}
+
+// Decisions returns the decisions recorded so far.
+func (r *Recorder) Decisions() []Decision {
+	return r.decisions
+}
+
+func (r *Recorder) Int63() int64 {
+	v := r.rnd.Int63()
+	r.decisions = append(r.decisions, Decision{Method: "Int63", Int: v})
+	return v
+}
+
+func (r *Recorder) Int63n(n int64) int64 {
+	v := r.rnd.Int63n(n)
+	r.decisions = append(r.decisions, Decision{Method: "Int63n", N: n, Int: v})
+	return v
+}
+
+func (r *Recorder) Intn(n int) int {
+	v := r.rnd.Intn(n)
+	r.decisions = append(r.decisions, Decision{Method: "Intn", N: int64(n), Int: int64(v)})
+	return v
+}
+
+func (r *Recorder) Float64() float64 {
+	v := r.rnd.Float64()
+	r.decisions = append(r.decisions, Decision{Method: "Float64", Float: v})
+	return v
+}
+
+// Replay is a Rand returning recorded decisions in order. Decisions can be edited
+// before being replayed: values out of range are wrapped into range. Once the
+// decisions are exhausted, or if a decision was recorded for another method, it
+// returns zeros and Err returns an error.
+type Replay struct {
+	decisions []Decision
+	next      int
+	err       error
+}
+
+// NewReplay returns a Rand replaying decisions.
+func NewReplay(decisions []Decision) *Replay {
+	return &Replay{decisions: decisions}
+}
+
+// Err returns the first error met while replaying decisions, if any.
+func (r *Replay) Err() error {
+	return r.err
+}
+
+// decision returns the next decision if it was recorded for method.
+func (r *Replay) decision(method string) (Decision, bool) {
+	if r.next >= len(r.decisions) {
+		if r.err == nil {
+			r.err = fmt.Errorf("no decision left for %s after %d decisions", method, len(r.decisions))
+		}
+		return Decision{}, false
+	}
+	d := r.decisions[r.next]
+	r.next++
+	if d.Method != method {
+		if r.err == nil {
+			r.err = fmt.Errorf("decision %d was recorded for %s but replayed for %s", r.next-1, d.Method, method)
+		}
+		return Decision{}, false
+	}
+	return d, true
+}
+
+func (r *Replay) Int63() int64 {
+	d, _ := r.decision("Int63")
+	return d.Int & (1<<63 - 1)
+}
+
+func (r *Replay) Int63n(n int64) int64 {
+	if n <= 0 {
+		panic("invalid argument to Int63n")
+	}
+	d, _ := r.decision("Int63n")
+	return wrap(d.Int, n)
+}
+
+func (r *Replay) Intn(n int) int {
+	if n <= 0 {
+		panic("invalid argument to Intn")
+	}
+	d, _ := r.decision("Intn")
+	return int(wrap(d.Int, int64(n)))
+}
+
+func (r *Replay) Float64() float64 {
+	d, _ := r.decision("Float64")
+	if !(d.Float >= 0 && d.Float < 1) {
+		return 0
+	}
+	return d.Float
+}
+
+// wrap returns v modulo n in [0, n).
+func wrap(v, n int64) int64 {
+	v %= n
+	if v < 0 {
+		v += n
+	}
+	return v
+}
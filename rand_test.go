@@ -0,0 +1,105 @@
+package promqlsmith
+
+import (
+	"encoding/json"
+	"math/rand"
+	randv2 "math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPerm(t *testing.T) {
+	seed := time.Now().Unix()
+	rnd := rand.New(rand.NewSource(seed))
+	other := rand.New(rand.NewSource(seed))
+	for n := 0; n < 20; n++ {
+		require.Equal(t, other.Perm(n), perm(rnd, n))
+	}
+}
+
+func TestNewRandV2(t *testing.T) {
+	seed := uint64(time.Now().Unix())
+	ps := New(NewRandV2(randv2.New(randv2.NewPCG(seed, 0))), testSeriesSet)
+	other := New(NewRandV2(randv2.New(randv2.NewPCG(seed, 0))), testSeriesSet)
+	for i := 0; i < 20; i++ {
+		expr := ps.WalkInstantQuery()
+		_, err := parser.ParseExpr(expr.String())
+		require.NoError(t, err, expr.String())
+		require.Equal(t, expr.String(), other.WalkInstantQuery().String())
+	}
+}
+
+func TestWithSeededRand(t *testing.T) {
+	var seeds []int64
+	var recorders []*Recorder
+	newSeededRand := func(seed int64) Rand {
+		seeds = append(seeds, seed)
+		recorders = append(recorders, NewRecorder(NewRandV2(randv2.New(randv2.NewPCG(uint64(seed), 0)))))
+		return recorders[len(recorders)-1]
+	}
+	ps := New(rand.New(rand.NewSource(time.Now().Unix())), testSeriesSet, WithSeededRand(newSeededRand))
+	expr := ps.WalkWithSeed(1)
+	ps.WalkInvalidQueryWithSeed(2)
+	ps.MutateWithSeed(expr, 3)
+	require.Equal(t, []int64{1, 2, 3}, seeds)
+	for _, r := range recorders {
+		require.NotEmpty(t, r.Decisions())
+	}
+
+	// Instances with the same generators regenerate the same queries.
+	other := New(rand.New(rand.NewSource(time.Now().Unix())), testSeriesSet, WithSeededRand(newSeededRand))
+	for i := int64(0); i < 20; i++ {
+		require.Equal(t, ps.WalkWithSeed(i).String(), other.WalkWithSeed(i).String())
+	}
+}
+
+func TestRecorderAndReplay(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet,
+		WithEnableOffset(true),
+		WithEnableAtModifier(true),
+		WithEnableVectorMatching(true),
+	)
+	for i := 0; i < 20; i++ {
+		recorder := NewRecorder(rand.New(rand.NewSource(rnd.Int63())))
+		expr := ps.WalkRand(recorder, vectorAndScalarValueTypes...)
+		require.NotEmpty(t, recorder.Decisions())
+
+		// Decisions survive a JSON round trip.
+		b, err := json.Marshal(recorder.Decisions())
+		require.NoError(t, err)
+		var decisions []Decision
+		require.NoError(t, json.Unmarshal(b, &decisions))
+
+		replay := NewReplay(decisions)
+		require.Equal(t, expr.String(), ps.WalkRand(replay, vectorAndScalarValueTypes...).String())
+		require.NoError(t, replay.Err())
+	}
+}
+
+func TestReplay(t *testing.T) {
+	replay := NewReplay([]Decision{
+		{Method: "Intn", N: 10, Int: 13},
+		{Method: "Int63n", N: 10, Int: -3},
+		{Method: "Float64", Float: 0.5},
+		{Method: "Float64", Float: 2},
+		{Method: "Int63", Int: 42},
+	})
+	require.Equal(t, 3, replay.Intn(5))
+	require.Equal(t, int64(7), replay.Int63n(10))
+	require.Equal(t, 0.5, replay.Float64())
+	require.Equal(t, float64(0), replay.Float64())
+	require.NoError(t, replay.Err())
+
+	require.Equal(t, 0, replay.Intn(5))
+	require.EqualError(t, replay.Err(), "decision 4 was recorded for Int63 but replayed for Intn")
+	require.Equal(t, float64(0), replay.Float64())
+	require.EqualError(t, replay.Err(), "decision 4 was recorded for Int63 but replayed for Intn")
+
+	replay = NewReplay(nil)
+	require.Equal(t, int64(0), replay.Int63())
+	require.EqualError(t, replay.Err(), "no decision left for Int63 after 0 decisions")
+}
@@ -0,0 +1,351 @@
+package promqlsmith
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"golang.org/x/exp/slices"
+)
+
+// QueryShardLabel is the name of the label matcher selecting the series of one
+// shard. Its value is the one based shard index and the shard count, like 1_of_4.
+const QueryShardLabel = "__query_shard__"
+
+// unshardableFuncs are the functions whose result for a series depends on other
+// series of their argument, or which return series that were not selected.
+var unshardableFuncs = map[string]struct{}{
+	"absent":             {},
+	"absent_over_time":   {},
+	"vector":             {},
+	"scalar":             {},
+	"histogram_quantile": {},
+	"info":               {},
+	"label_replace":      {},
+	"label_join":         {},
+}
+
+// roundingFuncs are the functions whose result changes by a step for a slightly
+// different argument.
+var roundingFuncs = map[string]struct{}{
+	"ceil":  {},
+	"floor": {},
+	"round": {},
+	"sgn":   {},
+}
+
+// ShardMatcher returns the matcher selecting the series of the shard with the
+// given zero based index out of count shards. Passing it to WithEnforceLabelMatchers
+// generates queries that only select the series of that shard.
+func ShardMatcher(index, count int) *labels.Matcher {
+	return labels.MustNewMatcher(labels.MatchEqual, QueryShardLabel, fmt.Sprintf("%d_of_%d", index+1, count))
+}
+
+// ShardExpr rewrites expr into the form a sharding query frontend evaluates: every
+// aggregation that can be sharded is evaluated once per shard, with the ShardMatcher
+// of the shard added to its selectors, and the partial results are merged by another
+// aggregation. sum, min, max, group, count, count_values and avg aggregations are
+// sharded, and so are topk and bottomk if they select series by their labels. The
+// aggregated expression can't contain aggregations, binary operations between vectors
+// or functions like absent or histogram_quantile which combine several series.
+//
+// Partial results are told apart by adding the QueryShardLabel to them with
+// label_replace, so the sharded expression is valid PromQL which returns the same
+// result as expr when evaluated against a Queryable returned by NewShardingQueryable.
+// The returned bool is false if no aggregation can be sharded.
+//
+// Merging the partial results of sum and avg adds the values in another order,
+// which changes how they are rounded. These aggregations are not sharded where
+// rounding differences change the result instead of its values slightly: in the
+// argument of count_values, which turns values into labels, of topk and bottomk,
+// of comparisons and of functions like ceil or round.
+func ShardExpr(expr parser.Expr, shards int) (parser.Expr, bool) {
+	if shards < 2 {
+		return expr, false
+	}
+	// Rewrite a copy since nodes are modified in place.
+	parsed, err := parser.ParseExpr(expr.String())
+	if err != nil {
+		return expr, false
+	}
+	if out, ok := shardExpr(parsed, shards, false); ok {
+		return out, true
+	}
+	return expr, false
+}
+
+// shardExpr replaces the outermost aggregations that can be sharded and reports
+// whether any was replaced. If exact is true, only aggregations whose merged
+// results are exactly the same as the ones of the original aggregation are sharded.
+func shardExpr(expr parser.Expr, shards int, exact bool) (parser.Expr, bool) {
+	sharded := false
+	shard := func(e parser.Expr) parser.Expr {
+		out, ok := shardExpr(e, shards, exact)
+		sharded = sharded || ok
+		return out
+	}
+	switch e := expr.(type) {
+	case *parser.AggregateExpr:
+		if out := shardAggregation(e, shards, exact); out != nil {
+			return out, true
+		}
+		exact = exact || e.Op == parser.COUNT_VALUES || e.Op == parser.TOPK || e.Op == parser.BOTTOMK
+		e.Expr = shard(e.Expr)
+		if e.Param != nil {
+			e.Param = shard(e.Param)
+		}
+	case *parser.BinaryExpr:
+		exact = exact || e.Op.IsComparisonOperator()
+		e.LHS, e.RHS = shard(e.LHS), shard(e.RHS)
+	case *parser.Call:
+		_, rounding := roundingFuncs[e.Func.Name]
+		exact = exact || rounding
+		for i := range e.Args {
+			e.Args[i] = shard(e.Args[i])
+		}
+	case *parser.SubqueryExpr:
+		e.Expr = shard(e.Expr)
+	case *parser.ParenExpr:
+		e.Expr = shard(e.Expr)
+	case *parser.UnaryExpr:
+		e.Expr = shard(e.Expr)
+	case *parser.StepInvariantExpr:
+		e.Expr = shard(e.Expr)
+	}
+	return expr, sharded
+}
+
+// shardAggregation returns the sharded form of the aggregation, or nil if it can't
+// be sharded. If exact is true, sum and avg aggregations are not sharded.
+func shardAggregation(e *parser.AggregateExpr, shards int, exact bool) parser.Expr {
+	if !canShard(e.Expr) || (e.Param != nil && !canShard(e.Param)) {
+		return nil
+	}
+	if exact && (e.Op == parser.SUM || e.Op == parser.AVG) {
+		return nil
+	}
+	switch e.Op {
+	case parser.SUM, parser.MIN, parser.MAX, parser.GROUP:
+		return mergeShards(e.Op, e, shards)
+	case parser.COUNT:
+		return mergeShards(parser.SUM, e, shards)
+	case parser.COUNT_VALUES:
+		merged := mergeShards(parser.SUM, e, shards)
+		name := e.Param.(*parser.StringLiteral).Val
+		if !e.Without && !slices.Contains(merged.Grouping, name) {
+			merged.Grouping = append(slices.Clone(merged.Grouping), name)
+		}
+		return merged
+	case parser.AVG:
+		// Division drops the metric name kept by grouping by it.
+		if !e.Without && slices.Contains(e.Grouping, labels.MetricName) {
+			return nil
+		}
+		sum, count := *e, *e
+		sum.Op, count.Op = parser.SUM, parser.COUNT
+		return &parser.ParenExpr{Expr: &parser.BinaryExpr{
+			Op:             parser.DIV,
+			LHS:            mergeShards(parser.SUM, &sum, shards),
+			RHS:            mergeShards(parser.SUM, &count, shards),
+			VectorMatching: &parser.VectorMatching{Card: parser.CardOneToOne},
+		}}
+	case parser.TOPK, parser.BOTTOMK:
+		// Series without the shard label must not have the same labels.
+		if !keepsSeriesLabels(e.Expr) {
+			return nil
+		}
+		merged := mergeShards(e.Op, e, shards)
+		merged.Param = e.Param
+		return labelReplace(merged, QueryShardLabel, "")
+	}
+	return nil
+}
+
+// mergeShards aggregates the results of partial evaluated on every shard with op,
+// using the grouping of partial.
+func mergeShards(op parser.ItemType, partial *parser.AggregateExpr, shards int) *parser.AggregateExpr {
+	var concat parser.Expr
+	for i := 0; i < shards; i++ {
+		part := labelReplace(shardOf(partial, i, shards), QueryShardLabel, ShardMatcher(i, shards).Value)
+		if concat == nil {
+			concat = part
+			continue
+		}
+		concat = &parser.BinaryExpr{Op: parser.LOR, LHS: concat, RHS: part, VectorMatching: &parser.VectorMatching{Card: parser.CardManyToMany}}
+	}
+	grouping := partial.Grouping
+	if partial.Without {
+		grouping = append(slices.Clone(grouping), QueryShardLabel)
+	}
+	return &parser.AggregateExpr{Op: op, Expr: concat, Grouping: grouping, Without: partial.Without}
+}
+
+// shardOf returns a copy of expr only selecting the series of the given shard.
+func shardOf(expr parser.Expr, index, count int) parser.Expr {
+	out, err := parser.ParseExpr(expr.String())
+	if err != nil {
+		// expr is a valid expression, so it can't fail to parse.
+		panic(err)
+	}
+	matcher := ShardMatcher(index, count)
+	parser.Inspect(out, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok {
+			vs.LabelMatchers = append(vs.LabelMatchers, matcher)
+		}
+		return nil
+	})
+	return out
+}
+
+// labelReplace sets the label to value on every series of expr, or removes it if
+// value is empty.
+func labelReplace(expr parser.Expr, name, value string) parser.Expr {
+	return &parser.Call{
+		Func: parser.Functions["label_replace"],
+		Args: parser.Expressions{
+			expr,
+			&parser.StringLiteral{Val: name},
+			&parser.StringLiteral{Val: value},
+			&parser.StringLiteral{Val: ""},
+			&parser.StringLiteral{Val: ""},
+		},
+	}
+}
+
+// canShard checks whether every series returned by expr only depends on a single
+// selected series, so that expr can be evaluated per shard.
+func canShard(expr parser.Expr) bool {
+	switch e := expr.(type) {
+	case *parser.VectorSelector, *parser.MatrixSelector, *parser.NumberLiteral, *parser.StringLiteral:
+		return true
+	case *parser.ParenExpr:
+		return canShard(e.Expr)
+	case *parser.StepInvariantExpr:
+		return canShard(e.Expr)
+	case *parser.UnaryExpr:
+		return canShard(e.Expr)
+	case *parser.SubqueryExpr:
+		return canShard(e.Expr)
+	case *parser.BinaryExpr:
+		if e.LHS.Type() == parser.ValueTypeVector && e.RHS.Type() == parser.ValueTypeVector {
+			return false
+		}
+		return canShard(e.LHS) && canShard(e.RHS)
+	case *parser.Call:
+		if _, ok := unshardableFuncs[e.Func.Name]; ok {
+			return false
+		}
+		for _, arg := range e.Args {
+			if !canShard(arg) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// keepsSeriesLabels checks whether expr returns series with the labels of the
+// selected series, which makes the labels of the returned series unique.
+func keepsSeriesLabels(expr parser.Expr) bool {
+	switch e := expr.(type) {
+	case *parser.VectorSelector:
+		return true
+	case *parser.MatrixSelector:
+		return keepsSeriesLabels(e.VectorSelector)
+	case *parser.SubqueryExpr:
+		return keepsSeriesLabels(e.Expr)
+	case *parser.ParenExpr:
+		return keepsSeriesLabels(e.Expr)
+	case *parser.StepInvariantExpr:
+		return keepsSeriesLabels(e.Expr)
+	case *parser.BinaryExpr:
+		// Comparisons with scalars filter series.
+		if !e.Op.IsComparisonOperator() || e.ReturnBool {
+			return false
+		}
+		if e.RHS.Type() == parser.ValueTypeScalar {
+			return keepsSeriesLabels(e.LHS)
+		}
+		return e.LHS.Type() == parser.ValueTypeScalar && keepsSeriesLabels(e.RHS)
+	case *parser.Call:
+		if _, ok := nameKeepingFuncs[e.Func.Name]; ok {
+			return keepsSeriesLabels(e.Args[0])
+		}
+	}
+	return false
+}
+
+// NewShardingQueryable returns a Queryable which handles the matchers returned by
+// ShardMatcher by only returning the series of q whose label hash falls into the
+// shard. Other matchers are passed to q.
+func NewShardingQueryable(q storage.Queryable) storage.Queryable {
+	return shardingQueryable{Queryable: q}
+}
+
+type shardingQueryable struct {
+	storage.Queryable
+}
+
+func (q shardingQueryable) Querier(mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return shardingQuerier{Querier: querier}, nil
+}
+
+type shardingQuerier struct {
+	storage.Querier
+}
+
+func (q shardingQuerier) Select(ctx context.Context, sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	rest := make([]*labels.Matcher, 0, len(matchers))
+	shards := make([]shardSelector, 0, 1)
+	for _, m := range matchers {
+		if m.Name != QueryShardLabel {
+			rest = append(rest, m)
+			continue
+		}
+		var s shardSelector
+		if _, err := fmt.Sscanf(m.Value, "%d_of_%d", &s.index, &s.count); err != nil || m.Type != labels.MatchEqual || s.index < 1 || s.index > s.count {
+			return storage.ErrSeriesSet(fmt.Errorf("invalid shard matcher %s", m))
+		}
+		shards = append(shards, s)
+	}
+	set := q.Querier.Select(ctx, sortSeries, hints, rest...)
+	if len(shards) == 0 {
+		return set
+	}
+	return &shardedSeriesSet{SeriesSet: set, shards: shards}
+}
+
+type shardSelector struct {
+	index, count int
+}
+
+func (s shardSelector) matches(lbls labels.Labels) bool {
+	return int(lbls.Hash()%uint64(s.count)) == s.index-1
+}
+
+// shardedSeriesSet only returns the series matching all shard selectors.
+type shardedSeriesSet struct {
+	storage.SeriesSet
+	shards []shardSelector
+}
+
+func (s *shardedSeriesSet) Next() bool {
+OUTER:
+	for s.SeriesSet.Next() {
+		lbls := s.SeriesSet.At().Labels()
+		for _, shard := range s.shards {
+			if !shard.matches(lbls) {
+				continue OUTER
+			}
+		}
+		return true
+	}
+	return false
+}
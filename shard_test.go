@@ -0,0 +1,168 @@
+package promqlsmith
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/promql/promqltest"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardExpr(t *testing.T) {
+	for i, tc := range []struct {
+		query    string
+		expected string
+	}{
+		{
+			query:    `sum by (job) (rate(up[5m]))`,
+			expected: `sum by (job) (label_replace(sum by (job) (rate(up{__query_shard__="1_of_2"}[5m])), "__query_shard__", "1_of_2", "", "") or label_replace(sum by (job) (rate(up{__query_shard__="2_of_2"}[5m])), "__query_shard__", "2_of_2", "", ""))`,
+		},
+		{
+			query:    `count without (instance) (up)`,
+			expected: `sum without (instance, __query_shard__) (label_replace(count without (instance) (up{__query_shard__="1_of_2"}), "__query_shard__", "1_of_2", "", "") or label_replace(count without (instance) (up{__query_shard__="2_of_2"}), "__query_shard__", "2_of_2", "", ""))`,
+		},
+		{
+			query:    `count_values by (job) ("value", up)`,
+			expected: `sum by (job, value) (label_replace(count_values by (job) ("value", up{__query_shard__="1_of_2"}), "__query_shard__", "1_of_2", "", "") or label_replace(count_values by (job) ("value", up{__query_shard__="2_of_2"}), "__query_shard__", "2_of_2", "", ""))`,
+		},
+		{
+			query:    `avg(up)`,
+			expected: `(sum(label_replace(sum(up{__query_shard__="1_of_2"}), "__query_shard__", "1_of_2", "", "") or label_replace(sum(up{__query_shard__="2_of_2"}), "__query_shard__", "2_of_2", "", "")) / sum(label_replace(count(up{__query_shard__="1_of_2"}), "__query_shard__", "1_of_2", "", "") or label_replace(count(up{__query_shard__="2_of_2"}), "__query_shard__", "2_of_2", "", "")))`,
+		},
+		{
+			query:    `topk(2, up > 0)`,
+			expected: `label_replace(topk(2, label_replace(topk(2, up{__query_shard__="1_of_2"} > 0), "__query_shard__", "1_of_2", "", "") or label_replace(topk(2, up{__query_shard__="2_of_2"} > 0), "__query_shard__", "2_of_2", "", "")), "__query_shard__", "", "", "")`,
+		},
+		{
+			// The inner aggregation is sharded instead.
+			query:    `stddev(max by (job) (up)) + 1`,
+			expected: `stddev(max by (job) (label_replace(max by (job) (up{__query_shard__="1_of_2"}), "__query_shard__", "1_of_2", "", "") or label_replace(max by (job) (up{__query_shard__="2_of_2"}), "__query_shard__", "2_of_2", "", ""))) + 1`,
+		},
+		{
+			// Only aggregations merged exactly are sharded where rounding matters.
+			query:    `count_values("value", max(up))`,
+			expected: `count_values("value", max(label_replace(max(up{__query_shard__="1_of_2"}), "__query_shard__", "1_of_2", "", "") or label_replace(max(up{__query_shard__="2_of_2"}), "__query_shard__", "2_of_2", "", "")))`,
+		},
+		{query: `count_values("value", sum(up))`},
+		{query: `ceil(avg(up))`},
+		{query: `topk(1, sum by (job) (up))`},
+		{query: `sum(up) > 1`},
+		// Aggregations combining several series can't be sharded.
+		{query: `sum(up + up)`},
+		{query: `sum(absent(up))`},
+		{query: `sum(histogram_quantile(0.9, up))`},
+		{query: `topk(1, rate(up[5m]))`},
+		{query: `quantile(0.9, up)`},
+		{query: `rate(up[5m])`},
+	} {
+		t.Run(fmt.Sprintf("test_case_%d", i), func(t *testing.T) {
+			expr, err := parser.ParseExpr(tc.query)
+			require.NoError(t, err)
+			sharded, ok := ShardExpr(expr, 2)
+			require.Equal(t, tc.expected != "", ok)
+			if !ok {
+				require.Equal(t, tc.query, sharded.String())
+				return
+			}
+			require.Equal(t, tc.expected, sharded.String())
+			// The original expression is not modified.
+			require.Equal(t, tc.query, expr.String())
+		})
+	}
+}
+
+func TestShardingQueryable(t *testing.T) {
+	st := promqltest.LoadedStorage(t, `load 30s
+up{job="a"} 1
+up{job="b"} 1
+up{job="c"} 1
+up{job="d"} 1
+`)
+	t.Cleanup(func() { st.Close() })
+
+	ctx := context.Background()
+	q, err := NewShardingQueryable(st).Querier(0, 1000)
+	require.NoError(t, err)
+	t.Cleanup(func() { q.Close() })
+
+	name := labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "up")
+	seen := make(map[string]struct{})
+	for i := 0; i < 3; i++ {
+		set := q.Select(ctx, false, nil, name, ShardMatcher(i, 3))
+		for set.Next() {
+			lbls := set.At().Labels().String()
+			require.NotContains(t, seen, lbls)
+			seen[lbls] = struct{}{}
+		}
+		require.NoError(t, set.Err())
+	}
+	require.Len(t, seen, 4)
+
+	set := q.Select(ctx, false, nil, name, labels.MustNewMatcher(labels.MatchEqual, QueryShardLabel, "4_of_3"))
+	require.False(t, set.Next())
+	require.Error(t, set.Err())
+}
+
+// TestShardExprReturnsSameResults evaluates generated queries and their sharded
+// form with the same engine. topk and bottomk are disabled since they pick any of
+// the series with equal values.
+func TestShardExprReturnsSameResults(t *testing.T) {
+	st := promqltest.LoadedStorage(t, `load 30s
+http_requests_total{job="prometheus", status_code="200", cluster="us-west-2", env="prod"} 1+1.1x40
+http_requests_total{job="prometheus", status_code="404", cluster="us-west-2", env="prod"} 2+2.3x50 stale
+http_requests_total{job="prometheus", status_code="500", cluster="us-west-2", env="prod"} _ _ 6+0.8x60
+up{job="prometheus", cluster="us-west-2", env="prod"} 1 1 0 1x50
+up{job="node_exporter", cluster="us-west-2", env="prod"} 0x20 1x40
+`)
+	t.Cleanup(func() { st.Close() })
+	queryable := NewShardingQueryable(st)
+
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	ps := New(rnd, testSeriesSet,
+		WithEnableOffset(true),
+		WithEnableVectorMatching(true),
+		WithEnabledAggrs([]parser.ItemType{
+			parser.SUM, parser.MIN, parser.MAX, parser.AVG, parser.COUNT, parser.GROUP,
+			parser.STDDEV, parser.QUANTILE, parser.COUNT_VALUES,
+		}),
+		WithExprWeights(map[ExprType]float64{AggregateExpr: 3}),
+	)
+
+	ctx := context.Background()
+	engine := promqltest.NewTestEngineWithOpts(t, promql.EngineOpts{
+		MaxSamples:           promqltest.DefaultMaxSamplesPerQuery,
+		Timeout:              time.Minute,
+		EnableNegativeOffset: true,
+	})
+	end := time.Unix(0, 0).Add(20 * time.Minute)
+	exec := func(q storage.Queryable, query string) *promql.Result {
+		qry, err := engine.NewRangeQuery(ctx, q, nil, query, end.Add(-10*time.Minute), end, time.Minute)
+		require.NoError(t, err)
+		t.Cleanup(qry.Close)
+		return qry.Exec(ctx)
+	}
+
+	for i := 0; i < 30; i++ {
+		expr := ps.WalkRangeQuery()
+		sharded, ok := ShardExpr(expr, 2+rnd.Intn(3))
+		if !ok {
+			continue
+		}
+		expected := exec(st, expr.String())
+		result := exec(queryable, sharded.String())
+		require.Equal(t, expected.Err != nil, result.Err != nil, "%s\n%s", expr, sharded)
+		if expected.Err != nil {
+			continue
+		}
+		diff := cmp.Diff(sortedResult(expected.Value), sortedResult(result.Value), resultCmpOpts...)
+		require.Empty(t, diff, "%s\n%s", expr, sharded)
+	}
+}
@@ -0,0 +1,264 @@
+package promqlsmith
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+)
+
+// Shrink minimizes expr while stillFails keeps returning true for it. It
+// repeatedly tries to replace subtrees with smaller ones: aggregations with their
+// inner expression, binary expressions with one of their sides, function calls with
+// their arguments and scalar subtrees with a number literal. It also drops label
+// matchers, grouping labels, vector matching modifiers, offsets and @ modifiers.
+// Every candidate passed to stillFails has the same value type as the subtree it
+// replaces and is a valid PromQL expression. The smallest failing expression found
+// is returned, or expr itself if no smaller candidate fails.
+func Shrink(expr parser.Expr, stillFails func(parser.Expr) bool) parser.Expr {
+	for {
+		reduced := false
+		for _, candidate := range shrinkCandidates(expr) {
+			if stillFails(candidate) {
+				expr = candidate
+				reduced = true
+				break
+			}
+		}
+		if !reduced {
+			return expr
+		}
+	}
+}
+
+// shrinkCandidates returns all expressions that can be derived from expr
+// by applying a single reduction to one of its nodes.
+func shrinkCandidates(expr parser.Expr) []parser.Expr {
+	return parseCandidates(expr, rewriteExpr(expr, reduceExpr))
+}
+
+// parseCandidates round trips the candidates through the parser so that only
+// valid queries different from expr are returned.
+func parseCandidates(expr parser.Expr, rewritten []parser.Expr) []parser.Expr {
+	current := expr.String()
+	seen := map[string]struct{}{current: {}}
+	candidates := make([]parser.Expr, 0)
+	for _, c := range rewritten {
+		query := c.String()
+		if _, ok := seen[query]; ok {
+			continue
+		}
+		seen[query] = struct{}{}
+		parsed, err := parser.ParseExpr(query)
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, parsed)
+	}
+	return candidates
+}
+
+// reduceExpr returns smaller replacements for the given node.
+func reduceExpr(expr parser.Expr) []parser.Expr {
+	out := make([]parser.Expr, 0)
+	add := func(repl parser.Expr) {
+		if repl != nil && canReplace(expr, repl) {
+			out = append(out, repl)
+		}
+	}
+
+	switch e := expr.(type) {
+	case *parser.AggregateExpr:
+		add(e.Expr)
+		if len(e.Grouping) > 0 || e.Without {
+			n := *e
+			n.Grouping = nil
+			n.Without = false
+			out = append(out, &n)
+		}
+	case *parser.BinaryExpr:
+		add(e.LHS)
+		add(e.RHS)
+		if vm := e.VectorMatching; vm != nil && (vm.On || len(vm.MatchingLabels) > 0 || len(vm.Include) > 0) {
+			n := *e
+			n.VectorMatching = &parser.VectorMatching{Card: parser.CardOneToOne}
+			if e.Op.IsSetOperator() {
+				n.VectorMatching.Card = parser.CardManyToMany
+			}
+			out = append(out, &n)
+		}
+	case *parser.Call:
+		for _, arg := range e.Args {
+			add(arg)
+			// Unwrap range vector arguments so that rate(x[5m]) can become x.
+			switch a := arg.(type) {
+			case *parser.MatrixSelector:
+				add(a.VectorSelector)
+			case *parser.SubqueryExpr:
+				add(a.Expr)
+			}
+		}
+	case *parser.SubqueryExpr:
+		if vs, ok := e.Expr.(*parser.VectorSelector); ok {
+			add(&parser.MatrixSelector{VectorSelector: vs, Range: e.Range})
+		}
+		if e.OriginalOffset != 0 {
+			n := *e
+			n.OriginalOffset = 0
+			out = append(out, &n)
+		}
+		if e.Timestamp != nil || e.StartOrEnd != 0 {
+			n := *e
+			n.Timestamp, n.StartOrEnd = nil, 0
+			out = append(out, &n)
+		}
+	case *parser.ParenExpr:
+		// Parens around binary expressions are kept to preserve precedence.
+		if _, ok := e.Expr.(*parser.BinaryExpr); !ok {
+			add(e.Expr)
+		}
+	case *parser.UnaryExpr:
+		add(e.Expr)
+	case *parser.StepInvariantExpr:
+		add(e.Expr)
+	case *parser.VectorSelector:
+		for i, m := range e.LabelMatchers {
+			n := *e
+			n.LabelMatchers = slices.Delete(slices.Clone(e.LabelMatchers), i, i+1)
+			if m.Name == labels.MetricName {
+				n.Name = ""
+			}
+			out = append(out, &n)
+		}
+		if e.OriginalOffset != 0 {
+			n := *e
+			n.OriginalOffset = 0
+			out = append(out, &n)
+		}
+		if e.Timestamp != nil || e.StartOrEnd != 0 {
+			n := *e
+			n.Timestamp, n.StartOrEnd = nil, 0
+			out = append(out, &n)
+		}
+	}
+
+	// Any scalar subtree can be replaced by a number literal.
+	if _, ok := expr.(*parser.NumberLiteral); !ok && expr.Type() == parser.ValueTypeScalar {
+		out = append(out, &parser.NumberLiteral{Val: 1})
+	}
+	return out
+}
+
+// canReplace checks whether repl can take the place of orig without changing
+// the value type expected by the parent of orig.
+func canReplace(orig, repl parser.Expr) bool {
+	vt := orig.Type()
+	if len(keepValueTypes([]parser.ValueType{repl.Type()}, []parser.ValueType{vt})) == 0 {
+		return false
+	}
+	e, ok := exprTypeOf(repl)
+	return ok && slices.Contains(valueTypeToExprsMap[vt], e)
+}
+
+// exprTypeOf returns the ExprType that generates the given expression.
+func exprTypeOf(expr parser.Expr) (ExprType, bool) {
+	switch e := expr.(type) {
+	case *parser.ParenExpr:
+		return exprTypeOf(e.Expr)
+	case *parser.StepInvariantExpr:
+		return exprTypeOf(e.Expr)
+	case *parser.VectorSelector:
+		return VectorSelector, true
+	case *parser.MatrixSelector:
+		return MatrixSelector, true
+	case *parser.AggregateExpr:
+		return AggregateExpr, true
+	case *parser.BinaryExpr:
+		return BinaryExpr, true
+	case *parser.SubqueryExpr:
+		return SubQueryExpr, true
+	case *parser.Call:
+		return CallExpr, true
+	case *parser.NumberLiteral:
+		return NumberLiteral, true
+	case *parser.UnaryExpr:
+		return UnaryExpr, true
+	}
+	return 0, false
+}
+
+// rewriteExpr calls fn for every node of expr and returns a copy of expr for each
+// replacement returned by fn. Nodes outside of the path to the replaced node are
+// shared with expr, so the results must not be modified in place.
+func rewriteExpr(expr parser.Expr, fn func(parser.Expr) []parser.Expr) []parser.Expr {
+	out := fn(expr)
+	switch e := expr.(type) {
+	case *parser.AggregateExpr:
+		for _, c := range rewriteExpr(e.Expr, fn) {
+			n := *e
+			n.Expr = c
+			out = append(out, &n)
+		}
+		if e.Param != nil {
+			for _, c := range rewriteExpr(e.Param, fn) {
+				n := *e
+				n.Param = c
+				out = append(out, &n)
+			}
+		}
+	case *parser.BinaryExpr:
+		for _, c := range rewriteExpr(e.LHS, fn) {
+			n := *e
+			n.LHS = wrapLHS(c)
+			out = append(out, &n)
+		}
+		for _, c := range rewriteExpr(e.RHS, fn) {
+			n := *e
+			n.RHS = wrapParenExpr(c)
+			out = append(out, &n)
+		}
+	case *parser.Call:
+		for i, arg := range e.Args {
+			for _, c := range rewriteExpr(arg, fn) {
+				n := *e
+				n.Args = slices.Clone(e.Args)
+				n.Args[i] = c
+				out = append(out, &n)
+			}
+		}
+	case *parser.MatrixSelector:
+		for _, c := range rewriteExpr(e.VectorSelector, fn) {
+			// Matrix selectors can only wrap vector selectors.
+			if _, ok := c.(*parser.VectorSelector); !ok {
+				continue
+			}
+			n := *e
+			n.VectorSelector = c
+			out = append(out, &n)
+		}
+	case *parser.SubqueryExpr:
+		for _, c := range rewriteExpr(e.Expr, fn) {
+			n := *e
+			n.Expr = c
+			out = append(out, &n)
+		}
+	case *parser.ParenExpr:
+		for _, c := range rewriteExpr(e.Expr, fn) {
+			n := *e
+			n.Expr = c
+			out = append(out, &n)
+		}
+	case *parser.UnaryExpr:
+		for _, c := range rewriteExpr(e.Expr, fn) {
+			n := *e
+			n.Expr = wrapParenExpr(c)
+			out = append(out, &n)
+		}
+	case *parser.StepInvariantExpr:
+		for _, c := range rewriteExpr(e.Expr, fn) {
+			n := *e
+			n.Expr = c
+			out = append(out, &n)
+		}
+	}
+	return out
+}
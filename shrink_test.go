@@ -0,0 +1,110 @@
+package promqlsmith
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShrink(t *testing.T) {
+	for i, tc := range []struct {
+		query      string
+		stillFails func(parser.Expr) bool
+		expected   string
+	}{
+		{
+			query: `sum by (job) (rate(http_requests_total{job="prometheus"}[5m])) * on (job) group_left () max by (job) (up)`,
+			stillFails: func(expr parser.Expr) bool {
+				return strings.Contains(expr.String(), "http_requests_total")
+			},
+			expected: `http_requests_total`,
+		},
+		{
+			query: `topk(3, -abs(up{job="prometheus"} offset 5m))`,
+			stillFails: func(expr parser.Expr) bool {
+				return strings.Contains(expr.String(), "offset")
+			},
+			expected: `up offset 5m`,
+		},
+		{
+			query: `sum_over_time(up[1h:1m]) > bool scalar(http_requests_total)`,
+			stillFails: func(expr parser.Expr) bool {
+				return strings.Contains(expr.String(), "bool")
+			},
+			expected: `up > bool 1`,
+		},
+		{
+			query: `sum(up)`,
+			stillFails: func(parser.Expr) bool {
+				return false
+			},
+			expected: `sum(up)`,
+		},
+	} {
+		t.Run(fmt.Sprintf("test_case_%d", i), func(t *testing.T) {
+			expr, err := parser.ParseExpr(tc.query)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, Shrink(expr, tc.stillFails).String())
+		})
+	}
+}
+
+func TestShrinkKeepsValueType(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	opts := []Option{WithEnableOffset(true), WithEnableAtModifier(true), WithEnableVectorMatching(true)}
+	ps := New(rnd, testSeriesSet, opts...)
+	for i := 0; i < 20; i++ {
+		expr := ps.WalkInstantQuery()
+		valueType := expr.Type()
+		shrunk := Shrink(expr, func(candidate parser.Expr) bool {
+			_, err := parser.ParseExpr(candidate.String())
+			require.NoError(t, err)
+			return true
+		})
+		require.Equal(t, valueType, shrunk.Type(), "original: %s, shrunk: %s", expr, shrunk)
+		require.LessOrEqual(t, len(shrunk.String()), len(expr.String()))
+	}
+}
+
+func TestCanReplace(t *testing.T) {
+	for i, tc := range []struct {
+		orig     parser.Expr
+		repl     parser.Expr
+		expected bool
+	}{
+		{
+			orig:     &parser.AggregateExpr{Op: parser.SUM, Expr: &parser.VectorSelector{}},
+			repl:     &parser.VectorSelector{},
+			expected: true,
+		},
+		{
+			orig:     &parser.Call{Func: parser.Functions["scalar"]},
+			repl:     &parser.NumberLiteral{Val: 1},
+			expected: true,
+		},
+		{
+			orig:     &parser.VectorSelector{},
+			repl:     &parser.NumberLiteral{Val: 1},
+			expected: false,
+		},
+		{
+			orig:     &parser.Call{Func: parser.Functions["rate"]},
+			repl:     &parser.MatrixSelector{VectorSelector: &parser.VectorSelector{}},
+			expected: false,
+		},
+		{
+			orig:     &parser.VectorSelector{},
+			repl:     &parser.StringLiteral{Val: "foo"},
+			expected: false,
+		},
+	} {
+		t.Run(fmt.Sprintf("test_case_%d", i), func(t *testing.T) {
+			require.Equal(t, tc.expected, canReplace(tc.orig, tc.repl))
+		})
+	}
+}
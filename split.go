@@ -0,0 +1,79 @@
+package promqlsmith
+
+import (
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// SplitQuery is a part of a range query split by time.
+type SplitQuery struct {
+	Expr  parser.Expr
+	Start time.Time
+	End   time.Time
+}
+
+// SplitByInterval splits the range query expr from start to end with the given
+// step into queries whose steps fall into the same interval since the Unix epoch,
+// like a query frontend splitting queries by day. Split queries evaluate the steps
+// of the original query, so their results put together are the result of the
+// original query. @ start() and @ end() modifiers are replaced by the start and
+// end timestamps of the original query, and every split query shares the same
+// rewritten expression.
+func SplitByInterval(expr parser.Expr, start, end time.Time, step, interval time.Duration) []SplitQuery {
+	expr = resolveStartEnd(expr, start, end)
+	stepMs, intervalMs := step.Milliseconds(), interval.Milliseconds()
+	if stepMs <= 0 || intervalMs <= 0 || end.Before(start) {
+		return []SplitQuery{{Expr: expr, Start: start, End: end}}
+	}
+
+	startMs, endMs := start.UnixMilli(), end.UnixMilli()
+	out := make([]SplitQuery, 0)
+	for t := startMs; t <= endMs; {
+		boundary := (floorDiv(t, intervalMs) + 1) * intervalMs
+		// Last step before the next interval or the end of the query.
+		last := t + (min(boundary-1, endMs)-t)/stepMs*stepMs
+		out = append(out, SplitQuery{Expr: expr, Start: time.UnixMilli(t), End: time.UnixMilli(last)})
+		t = last + stepMs
+	}
+	return out
+}
+
+// resolveStartEnd returns a copy of expr with @ start() and @ end() replaced by
+// the given timestamps.
+func resolveStartEnd(expr parser.Expr, start, end time.Time) parser.Expr {
+	parsed, err := parser.ParseExpr(expr.String())
+	if err != nil {
+		return expr
+	}
+	resolve := func(ts **int64, startOrEnd *parser.ItemType) {
+		var t int64
+		switch *startOrEnd {
+		case parser.START:
+			t = start.UnixMilli()
+		case parser.END:
+			t = end.UnixMilli()
+		default:
+			return
+		}
+		*ts, *startOrEnd = &t, 0
+	}
+	parser.Inspect(parsed, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			resolve(&n.Timestamp, &n.StartOrEnd)
+		case *parser.SubqueryExpr:
+			resolve(&n.Timestamp, &n.StartOrEnd)
+		}
+		return nil
+	})
+	return parsed
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
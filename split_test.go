@@ -0,0 +1,150 @@
+package promqlsmith
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/promql/promqltest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitByInterval(t *testing.T) {
+	ts := func(s int64) time.Time { return time.Unix(s, 0) }
+	for i, tc := range []struct {
+		start, end     int64
+		step, interval time.Duration
+		expected       [][2]int64
+	}{
+		{
+			start: 0, end: 100, step: 10 * time.Second, interval: 30 * time.Second,
+			expected: [][2]int64{{0, 20}, {30, 50}, {60, 80}, {90, 100}},
+		},
+		{
+			// Steps not aligned to the interval.
+			start: 5, end: 95, step: 20 * time.Second, interval: 50 * time.Second,
+			expected: [][2]int64{{5, 45}, {65, 85}},
+		},
+		{
+			// The end doesn't fall on a step.
+			start: 0, end: 25, step: 10 * time.Second, interval: time.Hour,
+			expected: [][2]int64{{0, 20}},
+		},
+		{
+			start: -30, end: 30, step: 20 * time.Second, interval: 30 * time.Second,
+			expected: [][2]int64{{-30, -10}, {10, 10}, {30, 30}},
+		},
+		{
+			start: 0, end: 0, step: 10 * time.Second, interval: 30 * time.Second,
+			expected: [][2]int64{{0, 0}},
+		},
+	} {
+		t.Run(fmt.Sprintf("test_case_%d", i), func(t *testing.T) {
+			expr, err := parser.ParseExpr(`up`)
+			require.NoError(t, err)
+			ranges := make([][2]int64, 0)
+			for _, q := range SplitByInterval(expr, ts(tc.start), ts(tc.end), tc.step, tc.interval) {
+				require.Equal(t, `up`, q.Expr.String())
+				ranges = append(ranges, [2]int64{q.Start.Unix(), q.End.Unix()})
+			}
+			require.Equal(t, tc.expected, ranges)
+		})
+	}
+}
+
+func TestSplitByIntervalResolvesStartEnd(t *testing.T) {
+	expr, err := parser.ParseExpr(`rate(up[5m] @ start()) + max_over_time(up[5m:1m] @ end())`)
+	require.NoError(t, err)
+	split := SplitByInterval(expr, time.Unix(60, 0), time.Unix(600, 0), time.Minute, 5*time.Minute)
+	require.Len(t, split, 3)
+	require.Equal(t, `rate(up[5m] @ 60.000) + max_over_time(up[5m:1m] @ 600.000)`, split[0].Expr.String())
+}
+
+// TestSplitByIntervalReturnsSameResults evaluates generated range queries and
+// their split queries with the same engine. quantile is disabled since the engine
+// evaluates its parameter only at the start of the query if the aggregated
+// expression is step invariant, like a selector with an @ modifier.
+func TestSplitByIntervalReturnsSameResults(t *testing.T) {
+	st := promqltest.LoadedStorage(t, `load 30s
+http_requests_total{job="prometheus", status_code="200", cluster="us-west-2", env="prod"} 1+1.1x40
+http_requests_total{job="prometheus", status_code="404", cluster="us-west-2", env="prod"} 2+2.3x50 stale
+http_requests_total{job="prometheus", status_code="500", cluster="us-west-2", env="prod"} _ _ 6+0.8x60
+up{job="prometheus", cluster="us-west-2", env="prod"} 1 1 0 1x50
+up{job="node_exporter", cluster="us-west-2", env="prod"} 0x20 1x40
+`)
+	t.Cleanup(func() { st.Close() })
+
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	start, end := time.Unix(0, 0).Add(5*time.Minute), time.Unix(0, 0).Add(30*time.Minute)
+	ps := New(rnd, testSeriesSet,
+		WithEnableOffset(true),
+		WithEnableAtModifier(true),
+		WithAtModifierMaxTimestamp(end.UnixMilli()),
+		WithEnabledAggrs([]parser.ItemType{
+			parser.SUM, parser.MIN, parser.MAX, parser.AVG, parser.COUNT, parser.GROUP,
+			parser.STDDEV, parser.STDVAR, parser.COUNT_VALUES,
+		}),
+	)
+
+	ctx := context.Background()
+	engine := promqltest.NewTestEngine(t, true, 0, promqltest.DefaultMaxSamplesPerQuery)
+	exec := func(query string, start, end time.Time) *promql.Result {
+		q, err := engine.NewRangeQuery(ctx, st, nil, query, start, end, time.Minute)
+		require.NoError(t, err)
+		t.Cleanup(q.Close)
+		return q.Exec(ctx)
+	}
+
+	for i := 0; i < 20; i++ {
+		expr := ps.WalkRangeQuery()
+		expected := exec(expr.String(), start, end)
+		if expected.Err != nil {
+			continue
+		}
+		merged := make(map[string]*promql.Series)
+		for _, q := range SplitByInterval(expr, start, end, time.Minute, 7*time.Minute) {
+			result := exec(q.Expr.String(), q.Start, q.End)
+			require.NoError(t, result.Err, "%s\n%s", expr, q.Expr)
+			matrix, err := result.Matrix()
+			require.NoError(t, err)
+			for _, s := range matrix {
+				key := s.Metric.String()
+				if _, ok := merged[key]; !ok {
+					merged[key] = &promql.Series{Metric: s.Metric}
+				}
+				merged[key].Floats = append(merged[key].Floats, s.Floats...)
+				merged[key].Histograms = append(merged[key].Histograms, s.Histograms...)
+			}
+		}
+		matrix := make(promql.Matrix, 0, len(merged))
+		for _, s := range merged {
+			matrix = append(matrix, *s)
+		}
+		expectedMatrix, err := expected.Matrix()
+		require.NoError(t, err)
+		diff := cmp.Diff(sortedMatrix(expectedMatrix), sortedMatrix(matrix), resultCmpOpts...)
+		require.Empty(t, diff, "%s", expr)
+	}
+}
+
+func sortedMatrix(m promql.Matrix) promql.Matrix {
+	for i := range m {
+		if len(m[i].Floats) == 0 {
+			m[i].Floats = nil
+		}
+		if len(m[i].Histograms) == 0 {
+			m[i].Histograms = nil
+		}
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	sort.Sort(m)
+	return m
+}
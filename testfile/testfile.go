@@ -0,0 +1,331 @@
+// Package testfile writes queries together with the results of a reference
+// engine as test files that can be run by the Prometheus promqltest package.
+package testfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// Case is a query and its expected result.
+type Case struct {
+	Expr parser.Expr
+	// Start, End and Step are the range query parameters. Instant queries
+	// have a zero Step and are evaluated at End.
+	Start time.Time
+	End   time.Time
+	Step  time.Duration
+	// Result is the result of the query returned by a reference engine.
+	Result *promql.Result
+}
+
+func (c Case) isInstant() bool {
+	return c.Step == 0
+}
+
+// Write writes a test file loading data at the given interval followed by one
+// eval command per case. Times are relative to the Unix epoch, which is where
+// promqltest starts loading samples, so every sample timestamp must be a
+// non-negative multiple of interval. Stale markers are written as stale values.
+//
+// Results of failed queries are written as eval_fail commands and results with
+// warnings as eval_warn commands. Instant queries sorting their result are
+// written as eval_ordered commands. promqltest doesn't support expecting matrix
+// or string results for instant queries, so such cases return an error.
+func Write(w io.Writer, interval time.Duration, data promql.Matrix, cases ...Case) error {
+	if interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+
+	var sb strings.Builder
+	if len(data) > 0 {
+		fmt.Fprintf(&sb, "load %s\n", model.Duration(interval))
+		for _, series := range data {
+			line, err := loadLine(interval, series)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&sb, "  %s\n", line)
+		}
+	}
+
+	for _, c := range cases {
+		sb.WriteString("\n")
+		if err := writeCase(&sb, c); err != nil {
+			return fmt.Errorf("query %q: %w", c.Expr, err)
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// loadLine formats the samples of the series as a load command line.
+func loadLine(interval time.Duration, series promql.Series) (string, error) {
+	values := make(map[int64]string, len(series.Floats)+len(series.Histograms))
+	last := int64(-1)
+	add := func(t int64, v string) error {
+		if t < 0 || t%interval.Milliseconds() != 0 {
+			return fmt.Errorf("sample of series %s at %d is not aligned to the %s interval", series.Metric, t, interval)
+		}
+		step := t / interval.Milliseconds()
+		values[step] = v
+		last = max(last, step)
+		return nil
+	}
+	for _, p := range series.Floats {
+		v := formatFloat(p.F)
+		if value.IsStaleNaN(p.F) {
+			v = "stale"
+		}
+		if err := add(p.T, v); err != nil {
+			return "", err
+		}
+	}
+	for _, p := range series.Histograms {
+		v := formatHistogram(p.H)
+		if value.IsStaleNaN(p.H.Sum) {
+			v = "stale"
+		}
+		if err := add(p.T, v); err != nil {
+			return "", err
+		}
+	}
+
+	return series.Metric.String() + " " + sequence(last, values), nil
+}
+
+// sequence formats values as a sequence of values from step 0 to last. Steps
+// without values are omitted.
+func sequence(last int64, values map[int64]string) string {
+	items := make([]string, 0, last+1)
+	for i := int64(0); i <= last; i++ {
+		v, ok := values[i]
+		if !ok {
+			v = "_"
+		}
+		items = append(items, v)
+	}
+	return strings.Join(items, " ")
+}
+
+func writeCase(sb *strings.Builder, c Case) error {
+	query := c.Expr.String()
+	if strings.Contains(query, "\n") {
+		return errors.New("query must be on a single line")
+	}
+
+	suffix := ""
+	switch {
+	case c.Result.Err != nil:
+		suffix = "_fail"
+	case hasWarnings(c.Result):
+		suffix = "_warn"
+	case c.isInstant() && isOrdered(c.Expr, c.Result.Value):
+		suffix = "_ordered"
+	}
+
+	if c.isInstant() {
+		at, err := offset(c.End)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sb, "eval%s instant at %s %s\n", suffix, at, query)
+	} else {
+		start, err := offset(c.Start)
+		if err != nil {
+			return err
+		}
+		end, err := offset(c.End)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sb, "eval%s range from %s to %s step %s %s\n", suffix, start, end, model.Duration(c.Step), query)
+	}
+	if c.Result.Err != nil {
+		return nil
+	}
+
+	switch v := c.Result.Value.(type) {
+	case promql.Scalar:
+		if !c.isInstant() {
+			return fmt.Errorf("unexpected scalar result for range query")
+		}
+		fmt.Fprintf(sb, "  %s\n", formatFloat(v.V))
+	case promql.Vector:
+		if !c.isInstant() {
+			return fmt.Errorf("unexpected vector result for range query")
+		}
+		for _, s := range v {
+			val := formatFloat(s.F)
+			if s.H != nil {
+				val = formatHistogram(s.H)
+			}
+			fmt.Fprintf(sb, "  %s %s\n", s.Metric, val)
+		}
+	case promql.Matrix:
+		if c.isInstant() {
+			return errors.New("promqltest doesn't support matrix results for instant queries")
+		}
+		for _, s := range v {
+			line, err := resultLine(c, s)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(sb, "  %s\n", line)
+		}
+	default:
+		return fmt.Errorf("promqltest doesn't support %s results", c.Result.Value.Type())
+	}
+	return nil
+}
+
+// resultLine formats a series of a range query result as its expected values
+// at every step.
+func resultLine(c Case, series promql.Series) (string, error) {
+	start, step := c.Start.UnixMilli(), c.Step.Milliseconds()
+	values := make(map[int64]string, len(series.Floats)+len(series.Histograms))
+	last := int64(-1)
+	add := func(t int64, v string) error {
+		if t < start || (t-start)%step != 0 {
+			return fmt.Errorf("point of series %s at %d is not aligned to the query steps", series.Metric, t)
+		}
+		i := (t - start) / step
+		values[i] = v
+		last = max(last, i)
+		return nil
+	}
+	for _, p := range series.Floats {
+		if err := add(p.T, formatFloat(p.F)); err != nil {
+			return "", err
+		}
+	}
+	for _, p := range series.Histograms {
+		if err := add(p.T, formatHistogram(p.H)); err != nil {
+			return "", err
+		}
+	}
+	return series.Metric.String() + " " + sequence(last, values), nil
+}
+
+// offset returns t as a duration since the Unix epoch, which is where
+// promqltest evaluations start.
+func offset(t time.Time) (model.Duration, error) {
+	d := t.Sub(time.Unix(0, 0))
+	if d < 0 {
+		return 0, fmt.Errorf("time %s is before the Unix epoch", t)
+	}
+	if d%time.Millisecond != 0 {
+		return 0, fmt.Errorf("time %s has sub millisecond precision", t)
+	}
+	return model.Duration(d), nil
+}
+
+func hasWarnings(r *promql.Result) bool {
+	warnings, _ := r.Warnings.CountWarningsAndInfo()
+	return warnings > 0
+}
+
+// isOrdered checks whether the order of the result is meaningful, which is only
+// the case for results sorted by a sort function. Results of sort and sort_desc
+// with equal values can be returned in any order.
+func isOrdered(expr parser.Expr, v parser.Value) bool {
+	switch e := expr.(type) {
+	case *parser.ParenExpr:
+		return isOrdered(e.Expr, v)
+	case *parser.StepInvariantExpr:
+		return isOrdered(e.Expr, v)
+	case *parser.Call:
+		switch e.Func.Name {
+		case "sort_by_label", "sort_by_label_desc":
+			return true
+		case "sort", "sort_desc":
+			vec, ok := v.(promql.Vector)
+			if !ok {
+				return false
+			}
+			for i := 1; i < len(vec); i++ {
+				if vec[i].F == vec[i-1].F || math.IsNaN(vec[i].F) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func formatHistogram(h *histogram.FloatHistogram) string {
+	return h.TestExpression()
+}
+
+// Select reads the samples of the given series between mint and maxt from the
+// queryable, so that they can be passed to Write.
+func Select(ctx context.Context, q storage.Queryable, mint, maxt int64, seriesSet []labels.Labels) (promql.Matrix, error) {
+	querier, err := q.Querier(mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	defer querier.Close()
+
+	out := make(promql.Matrix, 0, len(seriesSet))
+	for _, lbls := range seriesSet {
+		matchers := make([]*labels.Matcher, 0, lbls.Len())
+		lbls.Range(func(l labels.Label) {
+			matchers = append(matchers, labels.MustNewMatcher(labels.MatchEqual, l.Name, l.Value))
+		})
+		ss := querier.Select(ctx, false, nil, matchers...)
+		for ss.Next() {
+			s := ss.At()
+			if !labels.Equal(s.Labels(), lbls) {
+				continue
+			}
+			series := promql.Series{Metric: s.Labels()}
+			it := s.Iterator(nil)
+			for typ := it.Next(); typ != chunkenc.ValNone; typ = it.Next() {
+				switch typ {
+				case chunkenc.ValFloat:
+					t, f := it.At()
+					series.Floats = append(series.Floats, promql.FPoint{T: t, F: f})
+				case chunkenc.ValHistogram, chunkenc.ValFloatHistogram:
+					t, h := it.AtFloatHistogram(nil)
+					series.Histograms = append(series.Histograms, promql.HPoint{T: t, H: h})
+				}
+			}
+			if err := it.Err(); err != nil {
+				return nil, err
+			}
+			out = append(out, series)
+		}
+		if err := ss.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
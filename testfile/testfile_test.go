@@ -0,0 +1,213 @@
+package testfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/promql/promqltest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	data := promql.Matrix{
+		{
+			Metric: labels.FromStrings(labels.MetricName, "foo", "a", "1"),
+			Floats: []promql.FPoint{{T: 0, F: 1}, {T: 60000, F: math.Inf(1)}, {T: 90000, F: math.Float64frombits(value.StaleNaN)}},
+		},
+		{
+			Metric:     labels.FromStrings(labels.MetricName, "bar"),
+			Histograms: []promql.HPoint{{T: 30000, H: &histogram.FloatHistogram{Count: 3, Sum: 5, PositiveSpans: []histogram.Span{{Offset: 0, Length: 2}}, PositiveBuckets: []float64{1, 2}}}},
+		},
+	}
+	for i, tc := range []struct {
+		c        Case
+		expected string
+		err      bool
+	}{
+		{
+			c: Case{
+				Expr: mustParse(t, `sum(foo)`),
+				End:  time.Unix(60, 0),
+				Result: &promql.Result{Value: promql.Vector{
+					{Metric: labels.EmptyLabels(), F: math.Inf(1)},
+				}},
+			},
+			expected: "eval instant at 1m sum(foo)\n  {} Inf\n",
+		},
+		{
+			c: Case{
+				Expr:   mustParse(t, `sort_desc(foo)`),
+				End:    time.Unix(0, 0),
+				Result: &promql.Result{Value: promql.Vector{{Metric: labels.FromStrings("a", "1"), F: -0.5}}},
+			},
+			expected: "eval_ordered instant at 0s sort_desc(foo)\n  {a=\"1\"} -0.5\n",
+		},
+		{
+			c: Case{
+				Expr: mustParse(t, `sort(foo)`),
+				End:  time.Unix(0, 0),
+				Result: &promql.Result{Value: promql.Vector{
+					{Metric: labels.FromStrings("a", "1"), F: 1},
+					{Metric: labels.FromStrings("a", "2"), F: 1},
+				}},
+			},
+			expected: "eval instant at 0s sort(foo)\n  {a=\"1\"} 1\n  {a=\"2\"} 1\n",
+		},
+		{
+			c: Case{
+				Expr:   mustParse(t, `scalar(foo)`),
+				End:    time.Unix(30, 0),
+				Result: &promql.Result{Value: promql.Scalar{V: math.NaN()}},
+			},
+			expected: "eval instant at 30s scalar(foo)\n  NaN\n",
+		},
+		{
+			c: Case{
+				Expr:  mustParse(t, `foo`),
+				Start: time.Unix(0, 0),
+				End:   time.Unix(90, 0),
+				Step:  30 * time.Second,
+				Result: &promql.Result{Value: promql.Matrix{
+					{Metric: labels.FromStrings(labels.MetricName, "foo", "a", "1"), Floats: []promql.FPoint{{T: 0, F: 1}, {T: 60000, F: 2}}},
+				}},
+			},
+			expected: "eval range from 0s to 1m30s step 30s foo\n  {__name__=\"foo\", a=\"1\"} 1 _ 2\n",
+		},
+		{
+			c: Case{
+				Expr:   mustParse(t, `foo`),
+				End:    time.Unix(0, 0),
+				Result: &promql.Result{Err: errors.New("error")},
+			},
+			expected: "eval_fail instant at 0s foo\n",
+		},
+		{
+			c: Case{
+				Expr:   mustParse(t, `foo[1m]`),
+				End:    time.Unix(0, 0),
+				Result: &promql.Result{Value: promql.Matrix{}},
+			},
+			err: true,
+		},
+		{
+			c: Case{
+				Expr:   mustParse(t, `foo`),
+				End:    time.Unix(-1, 0),
+				Result: &promql.Result{Value: promql.Vector{}},
+			},
+			err: true,
+		},
+	} {
+		t.Run(fmt.Sprintf("test_case_%d", i), func(t *testing.T) {
+			var sb strings.Builder
+			err := Write(&sb, 30*time.Second, data, tc.c)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			load := "load 30s\n" +
+				"  {__name__=\"foo\", a=\"1\"} 1 _ Inf stale\n" +
+				"  {__name__=\"bar\"} _ {{count:3 sum:5 buckets:[1 2]}}\n"
+			require.Equal(t, load+"\n"+tc.expected, sb.String())
+		})
+	}
+
+	require.Error(t, Write(&strings.Builder{}, 45*time.Second, data))
+}
+
+// TestWriteRunsInPromQLTest checks that test files written for the results of
+// an engine pass when run by promqltest with the same engine.
+//
+// The queries are a fixed set covering every kind of command and result written
+// by Write, rather than generated ones. promqltest evaluates each instant query
+// again in range mode and with @ modifiers at other times, and the results of
+// some generated queries depend on the order in which the engine returns series,
+// which isn't deterministic. For example stdvar rounds differently depending on
+// the order of its input, which count_values turns into different labels, and
+// grouping by __name__ after a function dropping it sometimes keeps the name.
+func TestWriteRunsInPromQLTest(t *testing.T) {
+	load := `load 30s
+http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+http_requests_total{pod="nginx-2", series="2"} 2+2.3x50 stale
+http_requests_total{pod="nginx-3", series="3"} 6+0.8x60
+http_requests_total{pod="nginx-4", series="3"} _ _ 5+2.4x50
+request_duration_seconds{pod="nginx-1"} {{schema:0 sum:5 count:4 buckets:[1 2 1]}}+{{schema:0 sum:2 count:1 buckets:[1]}}x40
+`
+	st := promqltest.LoadedStorage(t, load)
+	t.Cleanup(func() { st.Close() })
+
+	ctx := context.Background()
+	series := []labels.Labels{
+		labels.FromStrings(labels.MetricName, "http_requests_total", "pod", "nginx-1", "series", "1"),
+		labels.FromStrings(labels.MetricName, "http_requests_total", "pod", "nginx-2", "series", "2"),
+		labels.FromStrings(labels.MetricName, "http_requests_total", "pod", "nginx-3", "series", "3"),
+		labels.FromStrings(labels.MetricName, "http_requests_total", "pod", "nginx-4", "series", "3"),
+		labels.FromStrings(labels.MetricName, "request_duration_seconds", "pod", "nginx-1"),
+	}
+	data, err := Select(ctx, st, math.MinInt64, math.MaxInt64, series)
+	require.NoError(t, err)
+	require.Len(t, data, len(series))
+
+	engine := promqltest.NewTestEngine(t, false, 0, promqltest.DefaultMaxSamplesPerQuery)
+	instant := []string{
+		`http_requests_total`,
+		`http_requests_total offset 5m`,
+		`sum by (series) (rate(http_requests_total[5m]))`,
+		`sort_desc(http_requests_total)`,
+		`scalar(http_requests_total{series="1"})`,
+		`request_duration_seconds`,
+		`histogram_count(rate(request_duration_seconds[5m]))`,
+		// Fails with an invalid label name.
+		`label_replace(http_requests_total, "1", "x", "pod", "(.*)")`,
+		// Warns about the missing le label.
+		`histogram_quantile(0.5, http_requests_total)`,
+	}
+	ranged := []string{
+		`http_requests_total`,
+		`rate(http_requests_total[5m])`,
+		`sum(request_duration_seconds)`,
+		`time()`,
+	}
+
+	cases := make([]Case, 0)
+	for _, at := range []time.Duration{0, 20 * time.Minute, 30 * time.Minute} {
+		for _, query := range instant {
+			c := Case{Expr: mustParse(t, query), End: time.Unix(0, 0).Add(at)}
+			q, err := engine.NewInstantQuery(ctx, st, nil, query, c.End)
+			require.NoError(t, err)
+			c.Result = q.Exec(ctx)
+			cases = append(cases, c)
+		}
+	}
+	for _, query := range ranged {
+		c := Case{Expr: mustParse(t, query), Start: time.Unix(0, 0), End: time.Unix(0, 0).Add(30 * time.Minute), Step: 2 * time.Minute}
+		q, err := engine.NewRangeQuery(ctx, st, nil, query, c.Start, c.End, c.Step)
+		require.NoError(t, err)
+		c.Result = q.Exec(ctx)
+		cases = append(cases, c)
+	}
+
+	var sb strings.Builder
+	require.NoError(t, Write(&sb, 30*time.Second, data, cases...))
+	for _, cmd := range []string{"eval instant", "eval_ordered instant", "eval_fail instant", "eval_warn instant", "eval range"} {
+		require.Contains(t, sb.String(), "\n"+cmd+" ")
+	}
+	promqltest.RunTest(t, sb.String(), engine)
+}
+
+func mustParse(t *testing.T, query string) parser.Expr {
+	expr, err := parser.ParseExpr(query)
+	require.NoError(t, err)
+	return expr
+}
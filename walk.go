@@ -3,11 +3,12 @@ package promqlsmith
 import (
 	"fmt"
 	"math"
-	"math/rand"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
 
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
@@ -20,8 +21,42 @@ const (
 
 	// Destination label used in functions like label_replace and label_join.
 	destinationLabel = "__promqlsmith_dst_label__"
+
+	// Bounds of the range of subqueries in seconds.
+	minSubqueryRangeSeconds = 60
+	maxSubqueryRangeSeconds = 3600
+	// max number of steps of subqueries with an explicit step.
+	maxSubqueryPoints = 60
+
+	// max number of runes in random UTF-8 label names and values.
+	maxUTF8Runes = 8
+
+	// max number of times queries, selectors and label matchers selecting no series
+	// are regenerated.
+	maxEmptyResultRetries = 3
 )
 
+// utf8RuneRanges are the ranges of runes used in random UTF-8 label names and values.
+var utf8RuneRanges = [][2]rune{
+	{0x20, 0x7e},       // ASCII
+	{0xa1, 0xff},       // Latin-1
+	{0x391, 0x3c9},     // Greek
+	{0x4e00, 0x4fff},   // CJK
+	{0x1f300, 0x1f5ff}, // Emoji
+}
+
+// histogramFuncArgs maps histogram functions to the index of their argument
+// that expects histogram samples.
+var histogramFuncArgs = map[string]int{
+	"histogram_avg":      0,
+	"histogram_count":    0,
+	"histogram_sum":      0,
+	"histogram_stddev":   0,
+	"histogram_stdvar":   0,
+	"histogram_fraction": 2,
+	"histogram_quantile": 1,
+}
+
 // walkExpr generates the given expression type with one of the required value type.
 // valueTypes is only used for expressions that could have multiple possible return value types.
 func (s *PromQLSmith) walkExpr(e ExprType, depth int, valueTypes ...parser.ValueType) (parser.Expr, error) {
@@ -32,7 +67,7 @@ func (s *PromQLSmith) walkExpr(e ExprType, depth int, valueTypes ...parser.Value
 		// Wrap binary expression with paren for readability.
 		return wrapParenExpr(s.walkBinaryExpr(depth, valueTypes...)), nil
 	case SubQueryExpr:
-		return s.walkSubQueryExpr(), nil
+		return s.walkSubQueryExpr(depth), nil
 	case MatrixSelector:
 		return s.walkMatrixSelector(), nil
 	case VectorSelector:
@@ -50,8 +85,8 @@ func (s *PromQLSmith) walkExpr(e ExprType, depth int, valueTypes ...parser.Value
 
 func (s *PromQLSmith) walkAggregateExpr(depth int) parser.Expr {
 	expr := &parser.AggregateExpr{
-		Op:       s.supportedAggrs[s.rnd.Intn(len(s.supportedAggrs))],
-		Without:  s.rnd.Int()%2 == 0,
+		Op:       pickWeighted(s.rnd, s.supportedAggrs, s.aggrWeights, func(op parser.ItemType) parser.ItemType { return op }),
+		Without:  s.rnd.Int63()%2 == 0,
 		Expr:     s.walk(depth-1, parser.ValueTypeVector),
 		Grouping: s.walkGrouping(),
 	}
@@ -62,20 +97,43 @@ func (s *PromQLSmith) walkAggregateExpr(depth int) parser.Expr {
 }
 
 // walkGrouping randomly generates grouping labels by picking from series label names.
+// Label names which are not legacy names are printed quoted in by and without
+// clauses, which the parser accepts with the UTF-8 name validation scheme.
 // TODO(yeya24): can we reduce the label sets by picking from labels of selected series?
 func (s *PromQLSmith) walkGrouping() []string {
-	if len(s.labelNames) == 0 {
+	names := s.labelNames
+	if s.enableUTF8Names {
+		names = slices.DeleteFunc(slices.Clone(names), func(name string) bool { return !isGroupingLabelName(name) })
+	}
+	if len(names) == 0 {
 		return nil
 	}
-	orders := s.rnd.Perm(len(s.labelNames))
-	items := s.rnd.Intn(min(len(s.labelNames), maxGroupingLabels))
+	orders := perm(s.rnd, len(names))
+	items := s.rnd.Intn(min(len(names), maxGroupingLabels))
 	grouping := make([]string, items)
 	for i := 0; i < items; i++ {
-		grouping[i] = s.labelNames[orders[i]]
+		grouping[i] = names[orders[i]]
+	}
+	if s.enableUTF8Names && s.rnd.Intn(4) == 0 {
+		name := s.walkUTF8LabelName()
+		for !isGroupingLabelName(name) {
+			name = s.walkUTF8LabelName()
+		}
+		grouping = append(grouping, name)
 	}
 	return grouping
 }
 
+// isGroupingLabelName returns true if the label name can be printed in a grouping
+// clause. The printer quotes names which are not legacy names without escaping
+// them, and leaves names starting with a quote as is.
+func isGroupingLabelName(name string) bool {
+	if isLegacyLabelName(name) {
+		return true
+	}
+	return !strings.ContainsAny(name, "\"\\\n") && name[0] != '\'' && name[0] != '`'
+}
+
 func (s *PromQLSmith) walkAggregateParam(op parser.ItemType, depth int) parser.Expr {
 	switch op {
 	case parser.TOPK, parser.BOTTOMK:
@@ -109,13 +167,11 @@ func (s *PromQLSmith) walkBinaryExpr(depth int, valueTypes ...parser.ValueType)
 		expr.VectorMatching.Card = parser.CardManyToMany
 	}
 
-	// Generate vector matching only if we know it asks for vector value type.
-	if !expr.Op.IsSetOperator() && len(valueTypes) == 1 && valueTypes[0] == parser.ValueTypeVector && s.enableVectorMatching && s.rnd.Float64() > 0.8 {
-		lhs, _ := s.walkExpr(VectorSelector, depth-1, valueTypes...)
-		expr.LHS = wrapParenExpr(lhs)
-		rhs, _ := s.walkExpr(VectorSelector, depth-1, valueTypes...)
-		expr.RHS = wrapParenExpr(rhs)
+	expr.LHS = wrapLHS(s.walk(depth-1, valueTypes...))
+	expr.RHS = wrapParenExpr(s.walk(depth-1, valueTypes...))
 
+	// Generate vector matching only if we know it asks for vector value type.
+	if !expr.Op.IsSetOperator() && len(valueTypes) == 1 && valueTypes[0] == parser.ValueTypeVector && s.enableVectorMatching && s.rnd.Float64() < s.vectorMatchingProbability {
 		leftSeriesSet, stop := getOutputSeries(expr.LHS)
 		if stop {
 			return expr
@@ -125,9 +181,6 @@ func (s *PromQLSmith) walkBinaryExpr(depth int, valueTypes ...parser.ValueType)
 			return expr
 		}
 		s.walkVectorMatching(expr, leftSeriesSet, rightSeriesSet, s.rnd.Intn(2) == 0, s.rnd.Intn(4) == 0)
-	} else {
-		expr.LHS = wrapParenExpr(s.walk(depth-1, valueTypes...))
-		expr.RHS = wrapParenExpr(s.walk(depth-1, valueTypes...))
 	}
 
 	lvt := expr.LHS.Type()
@@ -143,10 +196,12 @@ func (s *PromQLSmith) walkBinaryExpr(depth int, valueTypes ...parser.ValueType)
 }
 
 func (s *PromQLSmith) walkVectorMatching(expr *parser.BinaryExpr, seriesSetA []labels.Labels, seriesSetB []labels.Labels, on, includeLabels bool) {
+	// The printer writes the label names of on and ignoring unquoted, which doesn't
+	// parse for names that are not legacy names, so only legacy label names are used.
 	sa := make(map[string]struct{})
 	for _, series := range seriesSetA {
 		series.Range(func(lbl labels.Label) {
-			if lbl.Name == labels.MetricName {
+			if lbl.Name == labels.MetricName || !isLegacyLabelName(lbl.Name) {
 				return
 			}
 			sa[lbl.Name] = struct{}{}
@@ -156,7 +211,7 @@ func (s *PromQLSmith) walkVectorMatching(expr *parser.BinaryExpr, seriesSetA []l
 	sb := make(map[string]struct{})
 	for _, series := range seriesSetB {
 		series.Range(func(lbl labels.Label) {
-			if lbl.Name == labels.MetricName {
+			if lbl.Name == labels.MetricName || !isLegacyLabelName(lbl.Name) {
 				return
 			}
 			sb[lbl.Name] = struct{}{}
@@ -178,7 +233,7 @@ func (s *PromQLSmith) walkVectorMatching(expr *parser.BinaryExpr, seriesSetA []l
 	// Randomly select a subset of matched labels
 	sort.Strings(allMatchedLabels)                     // Sort for deterministic selection
 	numLabels := s.rnd.Intn(len(allMatchedLabels)) + 1 // Select at least 1 label
-	selectedIndices := s.rnd.Perm(len(allMatchedLabels))[:numLabels]
+	selectedIndices := perm(s.rnd, len(allMatchedLabels))[:numLabels]
 	sort.Ints(selectedIndices) // Sort indices for consistent order
 
 	matchedLabels := make([]string, numLabels)
@@ -261,7 +316,7 @@ func getIncludeLabels(labelNameSet map[string]struct{}, matchedLabels []string)
 }
 
 // Helper function to randomly select a subset of include labels
-func getRandomIncludeLabels(rnd *rand.Rand, labelNameSet map[string]struct{}, matchedLabels []string) []string {
+func getRandomIncludeLabels(rnd Rand, labelNameSet map[string]struct{}, matchedLabels []string) []string {
 	eligible := getIncludeLabels(labelNameSet, matchedLabels)
 	if len(eligible) == 0 {
 		return nil
@@ -274,7 +329,7 @@ func getRandomIncludeLabels(rnd *rand.Rand, labelNameSet map[string]struct{}, ma
 	}
 
 	// Randomly select the labels
-	indices := rnd.Perm(len(eligible))[:numLabels]
+	indices := perm(rnd, len(eligible))[:numLabels]
 	sort.Ints(indices)
 
 	// Create the final selection
@@ -300,50 +355,77 @@ func (s *PromQLSmith) walkBinaryOp(disallowVector bool) parser.ItemType {
 			binops = append(binops, binop)
 		}
 	}
-	return binops[s.rnd.Intn(len(binops))]
+	return pickWeighted(s.rnd, binops, s.binopWeights, func(op parser.ItemType) parser.ItemType { return op })
 }
 
-func (s *PromQLSmith) walkSubQueryExpr() parser.Expr {
-	expr := &parser.SubqueryExpr{
-		Range: time.Hour,
-		Step:  time.Minute,
-		Expr:  s.walkVectorSelector(s.enableAtModifier),
+// walkSubQueryExpr generates a subquery over any vector expression, so that subqueries
+// can be nested through functions like max_over_time. The range is between 1m and 1h
+// and the step is omitted to use the default resolution or splits the range in up to
+// maxSubqueryPoints steps, which don't need to be a divisor of the range.
+func (s *PromQLSmith) walkSubQueryExpr(depth int) parser.Expr {
+	inner := s.walk(depth-1, parser.ValueTypeVector)
+	if inner == nil {
+		inner = s.walkVectorSelector(s.enableAtModifier)
 	}
-	if s.enableOffset && s.rnd.Int()%2 == 0 {
-		negativeOffset := s.rnd.Intn(2) == 0
-		expr.OriginalOffset = time.Duration(s.rnd.Intn(300)) * time.Second
-		if negativeOffset {
-			expr.OriginalOffset = -expr.OriginalOffset
-		}
+	expr := &parser.SubqueryExpr{Expr: wrapSubqueryExpr(inner)}
+	expr.Range, expr.Step = s.walkSubqueryRange()
+	if s.enableOffset && s.rnd.Float64() < s.offsetProbability {
+		expr.OriginalOffset = s.walkOffset()
 	}
-	if s.enableAtModifier && s.rnd.Float64() > 0.7 {
+	if s.enableAtModifier && s.rnd.Float64() < s.atModifierProbability {
 		expr.Timestamp, expr.StartOrEnd = s.walkAtModifier()
 	}
 	return expr
 }
 
+// walkSubqueryRange generates the range and the step of a subquery. If step-less
+// subqueries are enabled, the step is 0 to use the default resolution a quarter
+// of the time.
+func (s *PromQLSmith) walkSubqueryRange() (rng, step time.Duration) {
+	rng = time.Duration(randRange(s.rnd, minSubqueryRangeSeconds, maxSubqueryRangeSeconds+1)) * time.Second
+	if !s.enableNoStepSubqueries || s.rnd.Intn(4) > 0 {
+		step = max((rng / time.Duration(s.rnd.Intn(maxSubqueryPoints)+1)).Truncate(time.Second), time.Second)
+	}
+	return rng, step
+}
+
+// wrapSubqueryExpr wraps unary expressions in parentheses since the range of a
+// subquery binds tighter than the unary operator.
+func wrapSubqueryExpr(expr parser.Expr) parser.Expr {
+	if _, ok := expr.(*parser.UnaryExpr); ok {
+		return &parser.ParenExpr{Expr: expr}
+	}
+	return expr
+}
+
 func (s *PromQLSmith) walkCall(depth int, valueTypes ...parser.ValueType) parser.Expr {
 	expr := &parser.Call{}
 
-	funcs := s.supportedFuncs
-	if len(valueTypes) > 0 {
-		funcs = make([]*parser.Function, 0)
-		valueTypeSet := make(map[parser.ValueType]struct{})
-		for _, vt := range valueTypes {
-			valueTypeSet[vt] = struct{}{}
-		}
-		for _, f := range s.supportedFuncs {
-			if _, ok := valueTypeSet[f.ReturnType]; ok {
-				funcs = append(funcs, f)
-			}
-		}
-	}
+	funcs := s.funcsReturning(valueTypes...)
 	sort.Slice(funcs, func(i, j int) bool { return strings.Compare(funcs[i].Name, funcs[j].Name) < 0 })
-	expr.Func = funcs[s.rnd.Intn(len(funcs))]
+	expr.Func = pickWeighted(s.rnd, funcs, s.funcWeights, func(f *parser.Function) string { return f.Name })
 	s.walkFunctions(expr, depth)
 	return expr
 }
 
+// funcsReturning returns the supported functions returning one of the value types.
+func (s *PromQLSmith) funcsReturning(valueTypes ...parser.ValueType) []*parser.Function {
+	if len(valueTypes) == 0 {
+		return s.supportedFuncs
+	}
+	funcs := make([]*parser.Function, 0)
+	valueTypeSet := make(map[parser.ValueType]struct{})
+	for _, vt := range valueTypes {
+		valueTypeSet[vt] = struct{}{}
+	}
+	for _, f := range s.supportedFuncs {
+		if _, ok := valueTypeSet[f.ReturnType]; ok {
+			funcs = append(funcs, f)
+		}
+	}
+	return funcs
+}
+
 func (s *PromQLSmith) walkFunctions(expr *parser.Call, depth int) {
 	switch expr.Func.Name {
 	case "label_join":
@@ -356,6 +438,10 @@ func (s *PromQLSmith) walkFunctions(expr *parser.Call, depth int) {
 	}
 
 	expr.Args = make([]parser.Expr, len(expr.Func.ArgTypes))
+	if idx, ok := histogramFuncArgs[expr.Func.Name]; ok && s.hasHistogramArg(expr.Func.Name) {
+		s.walkHistogramFunction(expr, idx, depth)
+		return
+	}
 	switch expr.Func.Name {
 	case "holt_winters":
 		s.walkHoltWinters(expr, depth)
@@ -382,9 +468,81 @@ func (s *PromQLSmith) walkHoltWinters(expr *parser.Call, depth int) {
 	expr.Args[2] = &parser.NumberLiteral{Val: getNonZeroFloat64(s.rnd)}
 }
 
+// hasHistogramArg checks whether there are histogram series that can be used
+// as argument of the given histogram function.
+func (s *PromQLSmith) hasHistogramArg(funcName string) bool {
+	if len(s.histogramSeries) > 0 {
+		return true
+	}
+	// Only histogram_quantile works with classic histograms.
+	return funcName == "histogram_quantile" && len(s.bucketSeries) > 0
+}
+
+func (s *PromQLSmith) walkHistogramFunction(expr *parser.Call, histogramArg int, depth int) {
+	for i, arg := range expr.Func.ArgTypes {
+		if i == histogramArg {
+			expr.Args[i] = s.walkHistogramArg(depth-1, expr.Func.Name == "histogram_quantile")
+			continue
+		}
+		expr.Args[i] = s.walk(depth-1, arg)
+	}
+}
+
+// walkHistogramArg generates a vector of histogram samples that fits in the given depth.
+// Native histograms are either selected directly or passed to rate. Classic histogram
+// buckets are additionally aggregated by the `le` label like rate(x_bucket[5m]) grouped by le.
+func (s *PromQLSmith) walkHistogramArg(depth int, allowClassic bool) parser.Expr {
+	candidates := make([]func() parser.Expr, 0, 5)
+	if len(s.histogramSeries) > 0 {
+		candidates = append(candidates, func() parser.Expr {
+			return s.walkVectorSelectorFrom(s.histogramSeries, s.enableAtModifier)
+		})
+		if depth >= 2 {
+			candidates = append(candidates, func() parser.Expr {
+				return s.walkRate(s.histogramSeries)
+			})
+		}
+	}
+	if allowClassic && len(s.bucketSeries) > 0 {
+		candidates = append(candidates, func() parser.Expr {
+			return s.walkVectorSelectorFrom(s.bucketSeries, s.enableAtModifier)
+		})
+		if depth >= 2 {
+			candidates = append(candidates, func() parser.Expr {
+				return s.walkRate(s.bucketSeries)
+			})
+		}
+		if depth >= 3 {
+			candidates = append(candidates, func() parser.Expr {
+				grouping := s.walkGrouping()
+				if !slices.Contains(grouping, labels.BucketLabel) {
+					grouping = append(grouping, labels.BucketLabel)
+				}
+				return &parser.AggregateExpr{
+					Op:       parser.SUM,
+					Expr:     s.walkRate(s.bucketSeries),
+					Grouping: grouping,
+				}
+			})
+		}
+	}
+	if len(candidates) == 0 {
+		return s.walk(depth, parser.ValueTypeVector)
+	}
+	return candidates[s.rnd.Intn(len(candidates))]()
+}
+
+// walkRate generates a rate function call over series picked from the given series set.
+func (s *PromQLSmith) walkRate(seriesSet []labels.Labels) parser.Expr {
+	return &parser.Call{
+		Func: parser.Functions["rate"],
+		Args: []parser.Expr{s.walkMatrixSelectorFrom(seriesSet)},
+	}
+}
+
 func (s *PromQLSmith) walkInfo(expr *parser.Call, depth int) {
 	expr.Args[0] = s.walk(depth-1, expr.Func.ArgTypes[0])
-	if s.rnd.Int()%2 == 0 {
+	if s.rnd.Int63()%2 == 0 {
 		// skip second parameter
 		expr.Args = expr.Args[:1]
 	} else {
@@ -412,7 +570,7 @@ func (s *PromQLSmith) walkLabelReplace(expr *parser.Call, depth int) {
 			})
 		}
 	}
-	if srcLabel != "" {
+	if srcLabel == "" {
 		// It is possible that the vector selector match nothing. In this case, it doesn't matter which label
 		// we pick. Just pick something from all series labels.
 		idx := s.rnd.Intn(len(s.labelNames))
@@ -433,7 +591,7 @@ func (s *PromQLSmith) walkSortByLabel(expr *parser.Call, depth int) {
 	if len(seriesSet) > 0 {
 		seriesSet[0].Range(func(lbl labels.Label) {
 			if cnt < 2 {
-				if s.rnd.Int()%2 == 0 {
+				if s.rnd.Int63()%2 == 0 {
 					expr.Args = append(expr.Args, &parser.StringLiteral{Val: lbl.Name})
 					cnt++
 				}
@@ -447,7 +605,7 @@ func (s *PromQLSmith) walkSortByLabel(expr *parser.Call, depth int) {
 	// we pick. Just pick something from all series labels.
 	for _, name := range s.labelNames {
 		if cnt < 1 {
-			if s.rnd.Int()%2 == 0 {
+			if s.rnd.Int63()%2 == 0 {
 				expr.Args = append(expr.Args, &parser.StringLiteral{Val: name})
 				cnt++
 			}
@@ -467,7 +625,7 @@ func (s *PromQLSmith) walkLabelJoin(expr *parser.Call, depth int) {
 	if len(seriesSet) > 0 {
 		seriesSet[0].Range(func(lbl labels.Label) {
 			if cnt < 2 {
-				if s.rnd.Int()%2 == 0 {
+				if s.rnd.Int63()%2 == 0 {
 					expr.Args = append(expr.Args, &parser.StringLiteral{Val: lbl.Name})
 					cnt++
 				}
@@ -480,7 +638,7 @@ func (s *PromQLSmith) walkLabelJoin(expr *parser.Call, depth int) {
 	// we pick. Just pick something from all series labels.
 	for _, name := range s.labelNames {
 		if cnt < 2 {
-			if s.rnd.Int()%2 == 0 {
+			if s.rnd.Int63()%2 == 0 {
 				expr.Args = append(expr.Args, &parser.StringLiteral{Val: name})
 				cnt++
 			}
@@ -507,17 +665,23 @@ func (s *PromQLSmith) walkVariadicFunctions(expr *parser.Call, depth int) {
 }
 
 func (s *PromQLSmith) walkVectorSelector(enableAtModifier bool) parser.Expr {
+	return s.walkVectorSelectorFrom(s.seriesSet, enableAtModifier)
+}
+
+// walkVectorSelectorFrom generates a vector selector with label matchers picked
+// from one of the series in seriesSet.
+func (s *PromQLSmith) walkVectorSelectorFrom(seriesSet []labels.Labels, enableAtModifier bool) parser.Expr {
 	expr := &parser.VectorSelector{}
-	expr.LabelMatchers = s.walkLabelMatchers()
+	expr.LabelMatchers = s.walkLabelMatchersFrom(seriesSet)
 	s.populateSeries(expr)
-	if s.enableOffset && s.rnd.Int()%2 == 0 {
-		negativeOffset := s.rnd.Intn(2) == 0
-		expr.OriginalOffset = time.Duration(s.rnd.Intn(300)) * time.Second
-		if negativeOffset {
-			expr.OriginalOffset = -expr.OriginalOffset
-		}
+	for i := 0; i < maxEmptyResultRetries && len(expr.Series) == 0 && s.rejectEmptyResult(); i++ {
+		expr.LabelMatchers = s.walkLabelMatchersFrom(seriesSet)
+		s.populateSeries(expr)
+	}
+	if s.enableOffset && s.rnd.Float64() < s.offsetProbability {
+		expr.OriginalOffset = s.walkOffset()
 	}
-	if enableAtModifier && s.rnd.Float64() > 0.7 {
+	if enableAtModifier && s.rnd.Float64() < s.atModifierProbability {
 		expr.Timestamp, expr.StartOrEnd = s.walkAtModifier()
 	}
 
@@ -526,24 +690,44 @@ func (s *PromQLSmith) walkVectorSelector(enableAtModifier bool) parser.Expr {
 
 func (s *PromQLSmith) populateSeries(expr *parser.VectorSelector) {
 	expr.Series = make([]storage.Series, 0)
-OUTER:
 	for _, series := range s.seriesSet {
-		for _, matcher := range expr.LabelMatchers {
-			m := matcher
-			if !m.Matches(series.Get(m.Name)) {
-				continue OUTER
-			}
+		if matchesSeries(series, expr.LabelMatchers) {
+			expr.Series = append(expr.Series, &storage.SeriesEntry{Lset: series})
+		}
+	}
+}
+
+// matchesAnySeries returns true if the matchers select at least one series of the
+// series set.
+func (s *PromQLSmith) matchesAnySeries(matchers []*labels.Matcher) bool {
+	for _, series := range s.seriesSet {
+		if matchesSeries(series, matchers) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesSeries(series labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(series.Get(m.Name)) {
+			return false
 		}
-		expr.Series = append(expr.Series, &storage.SeriesEntry{Lset: series})
 	}
+	return true
 }
 
 func (s *PromQLSmith) walkLabelMatchers() []*labels.Matcher {
-	if len(s.seriesSet) == 0 {
+	return s.walkLabelMatchersFrom(s.seriesSet)
+}
+
+func (s *PromQLSmith) walkLabelMatchersFrom(seriesSet []labels.Labels) []*labels.Matcher {
+	if len(seriesSet) == 0 {
 		return nil
 	}
-	series := s.seriesSet[s.rnd.Intn(len(s.seriesSet))]
-	orders := s.rnd.Perm(series.Len())
+	series := seriesSet[s.rnd.Intn(len(seriesSet))]
+	isBucket := s.sampleTypeOf(series) == SampleTypeClassicHistogramBucket
+	orders := perm(s.rnd, series.Len())
 	items := s.rnd.Intn(int(math.Ceil(float64(series.Len()+1) / 2)))
 	matchers := make([]*labels.Matcher, 0, items)
 	containsName := false
@@ -567,9 +751,9 @@ func (s *PromQLSmith) walkLabelMatchers() []*labels.Matcher {
 		case val > 0.85:
 			return ".+"
 		case val > 0.75:
-			return fmt.Sprintf(".*%v", v[len(v)/2:])
+			return ".*" + regexSuffix(v)
 		default:
-			return fmt.Sprintf("%v.*", v[:len(v)/2])
+			return regexPrefix(v) + ".*"
 		}
 	}
 
@@ -577,6 +761,14 @@ func (s *PromQLSmith) walkLabelMatchers() []*labels.Matcher {
 
 		var matcher *labels.Matcher
 
+		// Matching a single bucket breaks functions like histogram_quantile.
+		if isBucket && lbls[orders[i]].Name == labels.BucketLabel {
+			continue
+		}
+		if !s.enableUTF8Names && !isLegacyLabelName(lbls[orders[i]].Name) {
+			continue
+		}
+
 		if lbls[orders[i]].Name == labels.MetricName {
 			containsName = true
 			matcher = labels.MustNewMatcher(labels.MatchEqual, lbls[orders[i]].Name, lbls[orders[i]].Value)
@@ -586,13 +778,13 @@ func (s *PromQLSmith) walkLabelMatchers() []*labels.Matcher {
 			switch matchType {
 			case labels.MatchEqual:
 				val := lbls[orders[i]].Value
-				if s.rnd.Float64() > 0.9 {
+				if s.rnd.Float64() < s.emptyLabelValueProbability {
 					val = ""
 				}
 				matcher = labels.MustNewMatcher(labels.MatchEqual, lbls[orders[i]].Name, val)
 			case labels.MatchNotEqual:
 				val := lbls[orders[i]].Value
-				if s.rnd.Float64() > 0.9 {
+				if s.rnd.Float64() < s.emptyLabelValueProbability {
 					val = ""
 				}
 				matcher = labels.MustNewMatcher(labels.MatchNotEqual, lbls[orders[i]].Name, val)
@@ -615,6 +807,9 @@ func (s *PromQLSmith) walkLabelMatchers() []*labels.Matcher {
 			matchers = append(matchers, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, metricName))
 		}
 	}
+	if s.enableUTF8Names && s.rnd.Intn(4) == 0 {
+		matchers = append(matchers, s.walkUTF8LabelMatcher())
+	}
 	matchers = append(matchers, s.enforceMatchers...)
 
 	return matchers
@@ -626,8 +821,8 @@ func (s *PromQLSmith) walkSelectors() []*labels.Matcher {
 	if len(s.seriesSet) == 0 {
 		return nil
 	}
-	orders := s.rnd.Perm(len(s.labelNames))
-	items := randRange((len(s.labelNames)+1)/2, len(s.labelNames))
+	orders := perm(s.rnd, len(s.labelNames))
+	items := randRange(s.rnd, (len(s.labelNames)+1)/2, len(s.labelNames))
 	matchers := make([]*labels.Matcher, 0, items)
 
 	var (
@@ -646,8 +841,7 @@ func (s *PromQLSmith) walkSelectors() []*labels.Matcher {
 			} else if val > 0.9 {
 				value = "not_exist_value"
 			} else if val > 0.8 {
-				// TODO: randomize the non existent value using random UTF8 runes.
-				value = "."
+				value = randomUTF8String(s.rnd)
 			} else {
 				idx := s.rnd.Intn(len(s.labelValues[name]))
 				value = s.labelValues[name][idx]
@@ -659,8 +853,7 @@ func (s *PromQLSmith) walkSelectors() []*labels.Matcher {
 			case 1:
 				value = "not_exist_value"
 			case 2:
-				// TODO: randomize the non existent value using random UTF8 runes.
-				value = "."
+				value = randomUTF8String(s.rnd)
 			default:
 				idx := s.rnd.Intn(len(s.labelValues[name]))
 				value = s.labelValues[name][idx]
@@ -672,8 +865,7 @@ func (s *PromQLSmith) walkSelectors() []*labels.Matcher {
 			} else if val > 0.9 {
 				value = "not_exist_value"
 			} else if val > 0.85 {
-				// TODO: randomize the non existent value using random UTF8 runes.
-				value = "."
+				value = regexp.QuoteMeta(randomUTF8String(s.rnd))
 			} else if val > 0.8 {
 				value = ".*"
 			} else if val > 0.7 {
@@ -681,13 +873,13 @@ func (s *PromQLSmith) walkSelectors() []*labels.Matcher {
 			} else if val > 0.5 {
 				// Prefix
 				idx := s.rnd.Intn(len(s.labelValues[name]))
-				value = s.labelValues[name][idx][:len(s.labelValues[name][idx])/2] + ".*"
+				value = regexPrefix(s.labelValues[name][idx]) + ".*"
 			} else {
-				valueOrders := s.rnd.Perm(len(s.labelValues[name]))
+				valueOrders := perm(s.rnd, len(s.labelValues[name]))
 				valueItems := s.rnd.Intn(len(s.labelValues[name]))
 				var sb strings.Builder
 				for j := 0; j < valueItems; j++ {
-					sb.WriteString(s.labelValues[name][valueOrders[j]])
+					sb.WriteString(regexp.QuoteMeta(s.labelValues[name][valueOrders[j]]))
 					if j < valueItems-1 {
 						sb.WriteString("|")
 					}
@@ -696,6 +888,7 @@ func (s *PromQLSmith) walkSelectors() []*labels.Matcher {
 				if s.rnd.Intn(2) == 1 {
 					sb.WriteString("|not_exist_value")
 				}
+				value = sb.String()
 			}
 		case labels.MatchNotRegexp:
 			val := s.rnd.Float64()
@@ -704,18 +897,17 @@ func (s *PromQLSmith) walkSelectors() []*labels.Matcher {
 			} else if val > 0.7 {
 				value = "not_exist_value"
 			} else if val > 0.6 {
-				// TODO: randomize the non existent value using random UTF8 runes.
-				value = "."
+				value = regexp.QuoteMeta(randomUTF8String(s.rnd))
 			} else if val > 0.4 {
 				// Prefix
 				idx := s.rnd.Intn(len(s.labelValues[name]))
-				value = s.labelValues[name][idx][:len(s.labelValues[name][idx])/2] + ".*"
+				value = regexPrefix(s.labelValues[name][idx]) + ".*"
 			} else {
-				valueOrders := s.rnd.Perm(len(s.labelValues[name]))
+				valueOrders := perm(s.rnd, len(s.labelValues[name]))
 				valueItems := s.rnd.Intn(len(s.labelValues[name]))
 				var sb strings.Builder
 				for j := 0; j < valueItems; j++ {
-					sb.WriteString(s.labelValues[name][valueOrders[j]])
+					sb.WriteString(regexp.QuoteMeta(s.labelValues[name][valueOrders[j]]))
 					if j < valueItems-1 {
 						sb.WriteString("|")
 					}
@@ -724,6 +916,7 @@ func (s *PromQLSmith) walkSelectors() []*labels.Matcher {
 				if s.rnd.Intn(2) == 1 {
 					sb.WriteString("|not_exist_value")
 				}
+				value = sb.String()
 			}
 		default:
 			panic("unsupported label matcher type")
@@ -736,11 +929,69 @@ func (s *PromQLSmith) walkSelectors() []*labels.Matcher {
 			i++
 		}
 	}
+	if s.enableUTF8Names && s.rnd.Intn(4) == 0 {
+		matchers = append(matchers, s.walkUTF8LabelMatcher())
+	}
 	matchers = append(matchers, s.enforceMatchers...)
 
 	return matchers
 }
 
+// walkUTF8LabelName generates a label name which is not a valid legacy label name
+// and doesn't exist in the series set.
+func (s *PromQLSmith) walkUTF8LabelName() string {
+	for {
+		name := randomUTF8String(s.rnd)
+		if isLegacyLabelName(name) {
+			name += "."
+		}
+		// Names starting with __ are reserved.
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+		if _, ok := s.labelValues[name]; !ok {
+			return name
+		}
+	}
+}
+
+// walkUTF8LabelMatcher generates a matcher on a label name that doesn't exist,
+// so that it matches every series.
+func (s *PromQLSmith) walkUTF8LabelMatcher() *labels.Matcher {
+	name := s.walkUTF8LabelName()
+	if s.rnd.Intn(2) == 0 {
+		return labels.MustNewMatcher(labels.MatchEqual, name, "")
+	}
+	return labels.MustNewMatcher(labels.MatchNotEqual, name, randomUTF8String(s.rnd))
+}
+
+// randomUTF8String generates a string of up to maxUTF8Runes random runes.
+func randomUTF8String(rnd Rand) string {
+	n := rnd.Intn(maxUTF8Runes) + 1
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		r := utf8RuneRanges[rnd.Intn(len(utf8RuneRanges))]
+		sb.WriteRune(r[0] + rune(rnd.Intn(int(r[1]-r[0]+1))))
+	}
+	return sb.String()
+}
+
+// regexPrefix returns a regular expression matching the first half of the runes of v.
+func regexPrefix(v string) string {
+	runes := []rune(v)
+	return regexp.QuoteMeta(string(runes[:len(runes)/2]))
+}
+
+// regexSuffix returns a regular expression matching the second half of the runes of v.
+func regexSuffix(v string) string {
+	runes := []rune(v)
+	return regexp.QuoteMeta(string(runes[len(runes)/2:]))
+}
+
+func isLegacyLabelName(name string) bool {
+	return model.LabelName(name).IsValidLegacy()
+}
+
 func (s *PromQLSmith) walkAtModifier() (ts *int64, op parser.ItemType) {
 	res := s.rnd.Intn(3)
 	switch res {
@@ -756,11 +1007,40 @@ func (s *PromQLSmith) walkAtModifier() (ts *int64, op parser.ItemType) {
 }
 
 func (s *PromQLSmith) walkMatrixSelector() parser.Expr {
+	return s.walkMatrixSelectorFrom(s.seriesSet)
+}
+
+func (s *PromQLSmith) walkMatrixSelectorFrom(seriesSet []labels.Labels) parser.Expr {
 	return &parser.MatrixSelector{
-		// Make sure the time range is > 0s.
-		Range:          time.Duration(s.rnd.Intn(5)+1) * time.Minute,
-		VectorSelector: s.walkVectorSelector(s.enableAtModifier),
+		Range:          s.walkRange(),
+		VectorSelector: s.walkVectorSelectorFrom(seriesSet, s.enableAtModifier),
+	}
+}
+
+// walkRange generates the range of a matrix selector, which is 1 to 5 minutes
+// unless a distribution is set with WithRangeDurations.
+func (s *PromQLSmith) walkRange() time.Duration {
+	if s.rangeDurations != nil {
+		return s.rangeDurations.walkDuration(s.rnd)
 	}
+	// Make sure the time range is > 0s.
+	return time.Duration(s.rnd.Intn(5)+1) * time.Minute
+}
+
+// walkOffset generates a positive or negative offset of less than 300s, unless a
+// distribution is set with WithOffsetDurations.
+func (s *PromQLSmith) walkOffset() time.Duration {
+	negativeOffset := s.rnd.Intn(2) == 0
+	var offset time.Duration
+	if s.offsetDurations != nil {
+		offset = s.offsetDurations.walkDuration(s.rnd)
+	} else {
+		offset = time.Duration(s.rnd.Intn(300)) * time.Second
+	}
+	if negativeOffset {
+		return -offset
+	}
+	return offset
 }
 
 // Only vector and scalar result is allowed.
@@ -773,10 +1053,6 @@ func (s *PromQLSmith) walkUnaryExpr(depth int, valueTypes ...parser.ValueType) p
 	return expr
 }
 
-func (s *PromQLSmith) walkNumberLiteral() parser.Expr {
-	return &parser.NumberLiteral{Val: s.rnd.Float64()}
-}
-
 func exprsFromValueTypes(valueTypes []parser.ValueType) []ExprType {
 	set := make(map[ExprType]struct{})
 	res := make([]ExprType, 0)
@@ -804,6 +1080,16 @@ func wrapParenExpr(expr parser.Expr) parser.Expr {
 	return expr
 }
 
+// wrapLHS wraps the left operand of a binary expr. Number literals printed with
+// a sign, like -5 or +Inf, are wrapped in parentheses too, since -5 ^ 2 is parsed
+// as -(5 ^ 2).
+func wrapLHS(expr parser.Expr) parser.Expr {
+	if n, ok := expr.(*parser.NumberLiteral); ok && (math.IsInf(n.Val, 1) || math.Signbit(n.Val) && !math.IsNaN(n.Val)) {
+		return &parser.ParenExpr{Expr: expr}
+	}
+	return wrapParenExpr(expr)
+}
+
 // keepValueTypes picks value types that we should keep from the input.
 // input shouldn't contain duplicate value types.
 // If no input value types are provided, use value types to keep as result.
@@ -825,123 +1111,63 @@ func keepValueTypes(input []parser.ValueType, keep []parser.ValueType) []parser.
 	return out
 }
 
-// generate a non-zero float64 value randomly.
-func getNonZeroFloat64(rnd *rand.Rand) float64 {
-	for {
-		res := rnd.Float64()
-		if res == 0 {
-			continue
-		}
-		return res
-	}
+// generate a non-zero float64 value in (0, 1] randomly. It doesn't retry on zero
+// so that sources returning only zeros, like exhausted byte sources, terminate.
+func getNonZeroFloat64(rnd Rand) float64 {
+	return 1 - rnd.Float64()
 }
 
-// Get output series for the expr using best-effort guess. This can be used in fuzzing
-// vector matching. A bool value will also be returned alongside with the output series.
-// This is used to determine whether the expression is suitable to do vector matching or not.
-func getOutputSeries(expr parser.Expr) ([]labels.Labels, bool) {
-	stop := false
-	var lbls []labels.Labels
-	switch node := (expr).(type) {
+// returnsNoSeries returns true if the expression provably returns no series because
+// the selectors it depends on select none of the series of the series set.
+func returnsNoSeries(expr parser.Expr) bool {
+	switch node := expr.(type) {
 	case *parser.VectorSelector:
-		lbls := make([]labels.Labels, len(node.Series))
-		for i, s := range node.Series {
-			lbls[i] = s.Labels()
-		}
-		return lbls, len(lbls) == 0
-	case *parser.StepInvariantExpr:
-		return getOutputSeries(node.Expr)
+		return len(node.Series) == 0
 	case *parser.MatrixSelector:
-		return getOutputSeries(node.VectorSelector)
+		return returnsNoSeries(node.VectorSelector)
+	case *parser.SubqueryExpr:
+		return returnsNoSeries(node.Expr)
+	case *parser.StepInvariantExpr:
+		return returnsNoSeries(node.Expr)
 	case *parser.ParenExpr:
-		return getOutputSeries(node.Expr)
+		return returnsNoSeries(node.Expr)
 	case *parser.UnaryExpr:
-		return getOutputSeries(node.Expr)
-	case *parser.NumberLiteral:
-		return nil, false
-	case *parser.StringLiteral:
-		return nil, false
+		return returnsNoSeries(node.Expr)
 	case *parser.AggregateExpr:
-		lbls, stop = getOutputSeries(node.Expr)
-		if stop {
-			return nil, true
-		}
-
-		m := make(map[uint64]labels.Labels)
-		b := make([]byte, 1024)
-		output := make([]labels.Labels, 0)
-		lb := labels.NewBuilder(labels.EmptyLabels())
-		if !node.Without {
-			for _, lbl := range lbls {
-				for _, groupLabel := range node.Grouping {
-					if val := lbl.Get(groupLabel); val != "" {
-						lb.Set(groupLabel, val)
-					}
-				}
-				newLbl := lb.Labels()
-				h, _ := newLbl.HashForLabels(b, node.Grouping...)
-				if _, ok := m[h]; !ok {
-					m[h] = newLbl
-				}
-			}
-		} else {
-			set := make(map[string]struct{})
-			for _, g := range node.Grouping {
-				set[g] = struct{}{}
-			}
-			for _, lbl := range lbls {
-				lbl.Range(func(l labels.Label) {
-					if l.Name == labels.MetricName {
-						return
-					}
-					if _, ok := set[l.Name]; !ok {
-						val := lbl.Get(l.Name)
-						if val == "" {
-							return
-						}
-
-						lb.Set(l.Name, val)
-					}
-				})
-
-				newLbl := lb.Labels()
-				h, _ := newLbl.HashWithoutLabels(b, node.Grouping...)
-				if _, ok := m[h]; !ok {
-					m[h] = newLbl
-				}
-			}
-		}
-
-		for _, v := range m {
-			output = append(output, v)
-		}
-		sort.Slice(output, func(i, j int) bool {
-			return labels.Compare(output[i], output[j]) < 0
-		})
-		return output, false
-	case *parser.SubqueryExpr:
-		return getOutputSeries(node.Expr)
-	case *parser.BinaryExpr:
-		// Stop introducing complexity if there is a binary expr already.
-		return nil, true
+		return returnsNoSeries(node.Expr)
 	case *parser.Call:
-		// For function, we ignore `absent` and `absent_over_time`. And we continue
-		// traversal by checking the first matrix or vector argument.
-		if node.Func.Name == "absent" || node.Func.Name == "absent_over_time" {
-			return nil, true
+		// absent returns a series when its argument is empty.
+		if node.Func.ReturnType != parser.ValueTypeVector || node.Func.Name == "absent" || node.Func.Name == "absent_over_time" {
+			return false
 		}
 		for i, arg := range node.Func.ArgTypes {
-			// Find first matrix or vector type parameter, and we only
-			// check series from it.
-			if arg == parser.ValueTypeMatrix || arg == parser.ValueTypeVector {
-				return getOutputSeries(node.Args[i])
+			if i < len(node.Args) && (arg == parser.ValueTypeMatrix || arg == parser.ValueTypeVector) {
+				return returnsNoSeries(node.Args[i])
+			}
+		}
+		return false
+	case *parser.BinaryExpr:
+		lhsVector := node.LHS.Type() == parser.ValueTypeVector
+		rhsVector := node.RHS.Type() == parser.ValueTypeVector
+		switch {
+		case lhsVector && rhsVector:
+			switch node.Op {
+			case parser.LOR:
+				return returnsNoSeries(node.LHS) && returnsNoSeries(node.RHS)
+			case parser.LUNLESS:
+				return returnsNoSeries(node.LHS)
+			default:
+				return returnsNoSeries(node.LHS) || returnsNoSeries(node.RHS)
 			}
+		case lhsVector:
+			return returnsNoSeries(node.LHS)
+		case rhsVector:
+			return returnsNoSeries(node.RHS)
 		}
-		return nil, false
 	}
-	return lbls, stop
+	return false
 }
 
-func randRange(low, high int) int {
-	return rand.Intn(high-low) + low
+func randRange(rnd Rand, low, high int) int {
+	return rnd.Intn(high-low) + low
 }
@@ -3,10 +3,14 @@ package promqlsmith
 import (
 	"fmt"
 	"math/rand"
+	"regexp"
 	"sort"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
@@ -97,6 +101,17 @@ func TestWalkCall(t *testing.T) {
 	}
 }
 
+func TestWalkWithoutMatchingFunctions(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	p := New(rnd, testSeriesSet, WithEnabledFunctions([]*parser.Function{parser.Functions["rate"]}))
+	for i := 0; i < 50; i++ {
+		expr := p.walk(3, parser.ValueTypeScalar)
+		require.Equal(t, parser.ValueTypeScalar, expr.Type())
+		_, isCall := expr.(*parser.Call)
+		require.False(t, isCall)
+	}
+}
+
 func TestWalkBinaryExpr(t *testing.T) {
 	rnd := rand.New(rand.NewSource(time.Now().Unix()))
 	opts := []Option{WithEnableOffset(true), WithEnableAtModifier(true)}
@@ -345,6 +360,82 @@ func TestWalkBinaryOp(t *testing.T) {
 	}
 }
 
+func TestWalkWithWeights(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	exprWeights := map[ExprType]float64{}
+	for _, e := range valueTypeToExprsMap[parser.ValueTypeVector] {
+		exprWeights[e] = 0
+	}
+	exprWeights[AggregateExpr] = 1
+	exprWeights[BinaryExpr] = 1
+	aggrWeights := map[parser.ItemType]float64{}
+	for _, op := range defaultSupportedAggrs {
+		aggrWeights[op] = 0
+	}
+	aggrWeights[parser.SUM] = 1
+	binopWeights := map[parser.ItemType]float64{}
+	for _, op := range defaultSupportedBinOps {
+		binopWeights[op] = 0
+	}
+	binopWeights[parser.ADD] = 1
+	funcWeights := map[string]float64{}
+	for _, f := range defaultSupportedFuncs {
+		funcWeights[f.Name] = 0
+	}
+	funcWeights["abs"] = 1
+
+	p := New(rnd, testSeriesSet,
+		WithExprWeights(exprWeights),
+		WithAggrWeights(aggrWeights),
+		WithBinOpWeights(binopWeights),
+		WithFunctionWeights(funcWeights),
+	)
+	for i := 0; i < 100; i++ {
+		expr := p.walk(3, parser.ValueTypeVector)
+		switch e := expr.(type) {
+		case *parser.AggregateExpr:
+			require.Equal(t, parser.ItemType(parser.SUM), e.Op)
+		case *parser.ParenExpr:
+			require.Equal(t, parser.ItemType(parser.ADD), e.Expr.(*parser.BinaryExpr).Op)
+		default:
+			t.Fatalf("unexpected expression %s", expr)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		expr := p.walkCall(1, parser.ValueTypeVector)
+		require.Equal(t, "abs", expr.(*parser.Call).Func.Name)
+	}
+}
+
+func TestWalkProbabilities(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	opts := []Option{
+		WithEnableOffset(true),
+		WithEnableAtModifier(true),
+		WithOffsetProbability(0),
+		WithAtModifierProbability(0),
+		WithEmptyLabelValueProbability(0),
+	}
+	p := New(rnd, testSeriesSet, opts...)
+	for i := 0; i < 20; i++ {
+		vs := p.walkVectorSelector(true).(*parser.VectorSelector)
+		require.Zero(t, vs.OriginalOffset)
+		require.Nil(t, vs.Timestamp)
+		require.Zero(t, vs.StartOrEnd)
+		for _, m := range vs.LabelMatchers {
+			if m.Type == labels.MatchEqual || m.Type == labels.MatchNotEqual {
+				require.NotEmpty(t, m.Value)
+			}
+		}
+	}
+
+	p = New(rnd, testSeriesSet, append(opts, WithAtModifierProbability(1))...)
+	for i := 0; i < 20; i++ {
+		vs := p.walkVectorSelector(true).(*parser.VectorSelector)
+		require.True(t, vs.Timestamp != nil || vs.StartOrEnd != 0)
+	}
+}
+
 func TestWalkMatrixSelector(t *testing.T) {
 	rnd := rand.New(rand.NewSource(time.Now().Unix()))
 	opts := []Option{WithEnableOffset(true), WithEnableAtModifier(true)}
@@ -404,14 +495,51 @@ func TestWalkSubQueryExpr(t *testing.T) {
 	rnd := rand.New(rand.NewSource(time.Now().Unix()))
 	opts := []Option{WithEnableOffset(true), WithEnableAtModifier(true)}
 	p := New(rnd, testSeriesSet, opts...)
-	expr := p.walkSubQueryExpr()
-	e, ok := expr.(*parser.SubqueryExpr)
-	require.True(t, ok)
-	require.Equal(t, time.Hour, e.Range)
-	require.Equal(t, time.Minute, e.Step)
-	if e.StartOrEnd != 0 {
-		require.True(t, e.StartOrEnd == parser.START || e.StartOrEnd == parser.END)
+	var nonSelector bool
+	for i := 0; i < 100; i++ {
+		expr := p.walkSubQueryExpr(4)
+		e, ok := expr.(*parser.SubqueryExpr)
+		require.True(t, ok)
+		require.GreaterOrEqual(t, e.Range, time.Minute)
+		require.LessOrEqual(t, e.Range, time.Hour)
+		require.GreaterOrEqual(t, e.Step, time.Second)
+		require.LessOrEqual(t, e.Step, e.Range)
+		require.Equal(t, e.Step, e.Step.Truncate(time.Second))
+		if e.StartOrEnd != 0 {
+			require.True(t, e.StartOrEnd == parser.START || e.StartOrEnd == parser.END)
+		}
+		if _, ok := e.Expr.(*parser.VectorSelector); !ok {
+			nonSelector = true
+		}
+		require.LessOrEqual(t, getExprDepth(expr), 4)
+
+		parsed, err := parser.ParseExpr(expr.String())
+		require.NoError(t, err)
+		require.Equal(t, expr.String(), parsed.String())
 	}
+	require.True(t, nonSelector)
+}
+
+func TestWalkSubQueryExprNoStep(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	p := New(rnd, testSeriesSet, WithEnableNoStepSubqueries(true))
+	var omittedStep, withStep bool
+	for i := 0; i < 100; i++ {
+		expr := p.walkSubQueryExpr(4)
+		e, ok := expr.(*parser.SubqueryExpr)
+		require.True(t, ok)
+		if e.Step == 0 {
+			omittedStep = true
+		} else {
+			withStep = true
+		}
+
+		parsed, err := parser.ParseExpr(expr.String())
+		require.NoError(t, err)
+		require.Equal(t, expr.String(), parsed.String())
+	}
+	require.True(t, omittedStep)
+	require.True(t, withStep)
 }
 
 func TestWalkFunctions(t *testing.T) {
@@ -542,6 +670,142 @@ func TestWalkLabelMatchers(t *testing.T) {
 	}
 }
 
+func TestWalkSelectorsRegexAlternation(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	seriesSet := []labels.Labels{
+		labels.FromStrings(labels.MetricName, "http_requests_total", "path", "/a.b"),
+		labels.FromStrings(labels.MetricName, "http_requests_total", "path", "/a+b"),
+		labels.FromStrings(labels.MetricName, "http_requests_total", "path", "/(c)"),
+	}
+	// No label value is picked at times, which leaves an empty alternative.
+	values := map[string]struct{}{"not_exist_value": {}, "": {}}
+	for _, series := range seriesSet {
+		series.Range(func(l labels.Label) { values[l.Value] = struct{}{} })
+	}
+	p := New(rnd, seriesSet)
+	alternation := false
+	for i := 0; i < 500; i++ {
+		for _, m := range p.walkSelectors() {
+			// Quoted pipes come from random UTF-8 values, not from alternations.
+			if (m.Type != labels.MatchRegexp && m.Type != labels.MatchNotRegexp) || !strings.Contains(m.Value, "|") || strings.Contains(m.Value, `\|`) {
+				continue
+			}
+			alternation = true
+			// Alternatives are quoted label values, matched literally.
+			for _, alt := range strings.Split(m.Value, "|") {
+				unquoted := strings.ReplaceAll(alt, `\`, "")
+				require.Contains(t, values, unquoted, m.String())
+				require.Equal(t, regexp.QuoteMeta(unquoted), alt, m.String())
+			}
+		}
+	}
+	require.True(t, alternation)
+}
+
+func TestWalkUTF8Names(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	seriesSet := []labels.Labels{
+		labels.FromStrings(labels.MetricName, "my.metric", "label.with.dots", "a", "job", "test"),
+		labels.FromStrings(labels.MetricName, "up", "label.with.dots", "b", "job", "test"),
+	}
+
+	p := New(rnd, seriesSet, WithEnableVectorMatching(true))
+	require.Equal(t, []string{labels.MetricName, "job"}, p.labelNames)
+	for i := 0; i < 100; i++ {
+		for _, m := range p.walkLabelMatchers() {
+			require.True(t, isLegacyLabelName(m.Name), m.Name)
+		}
+		for _, name := range p.walkGrouping() {
+			require.True(t, isLegacyLabelName(name), name)
+		}
+		// Queries without UTF-8 names parse with the legacy validation scheme.
+		_, err := parser.ParseExpr(p.WalkRangeQuery().String())
+		require.NoError(t, err)
+	}
+
+	p = New(rnd, seriesSet, WithEnableUTF8Names(true), WithEnableVectorMatching(true))
+	require.Equal(t, []string{labels.MetricName, "job", "label.with.dots"}, p.labelNames)
+	var quoted bool
+	for i := 0; i < 100; i++ {
+		vs := p.walkVectorSelector(false)
+		query := vs.String()
+		parsed, err := parser.ParseExpr(query)
+		require.NoError(t, err)
+		require.Equal(t, query, parsed.String())
+		quoted = quoted || strings.Contains(query, `"label.with.dots"`)
+
+		for _, name := range p.walkGrouping() {
+			_, ok := p.labelValues[name]
+			require.True(t, ok || !isLegacyLabelName(name), name)
+		}
+		for _, m := range p.WalkSelectors() {
+			require.True(t, utf8.ValidString(m.Name))
+			require.True(t, utf8.ValidString(m.Value))
+		}
+	}
+	require.True(t, quoted)
+
+	seriesA := []labels.Labels{labels.FromStrings("label.with.dots", "a", "job", "test")}
+	seriesB := []labels.Labels{labels.FromStrings("label.with.dots", "a", "job", "test", "instance", "b")}
+	for i := 0; i < 10; i++ {
+		expr := &parser.BinaryExpr{VectorMatching: &parser.VectorMatching{}}
+		p.walkVectorMatching(expr, seriesA, seriesB, i%2 == 0, true)
+		require.NotContains(t, expr.VectorMatching.MatchingLabels, "label.with.dots")
+		require.NotContains(t, expr.VectorMatching.Include, "label.with.dots")
+	}
+}
+
+// TestWalkUTF8NamesParses checks that full queries generated with UTF-8 names
+// are accepted by the parser with the UTF-8 name validation scheme.
+func TestWalkUTF8NamesParses(t *testing.T) {
+	scheme := model.NameValidationScheme
+	model.NameValidationScheme = model.UTF8Validation
+	t.Cleanup(func() { model.NameValidationScheme = scheme })
+
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	seriesSet := []labels.Labels{
+		labels.FromStrings(labels.MetricName, "my.metric", "label.with.dots", "a", "job", "test"),
+		labels.FromStrings(labels.MetricName, "up", "label.with.dots", "b", "job", "test", "instance", "1"),
+		labels.FromStrings(labels.MetricName, "up", "job", "test", "instance", "2"),
+	}
+	p := New(rnd, seriesSet,
+		WithEnableUTF8Names(true),
+		WithEnableVectorMatching(true),
+		WithEnableOffset(true),
+		WithEnableAtModifier(true),
+		WithAtModifierMaxTimestamp(time.Hour.Milliseconds()),
+	)
+
+	var quotedLabel, quotedGrouping, utf8Metric bool
+	for i := 0; i < 1000; i++ {
+		expr := p.Walk(parser.ValueTypeVector, parser.ValueTypeScalar)
+		query := expr.String()
+		_, err := parser.ParseExpr(query)
+		require.NoError(t, err, query)
+		quotedLabel = quotedLabel || strings.Contains(query, `"label.with.dots"`)
+		utf8Metric = utf8Metric || strings.Contains(query, `__name__="my.metric"`)
+		parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+			if e, ok := node.(*parser.AggregateExpr); ok {
+				for _, name := range e.Grouping {
+					quotedGrouping = quotedGrouping || !isLegacyLabelName(name)
+				}
+			}
+			return nil
+		})
+	}
+	require.True(t, quotedLabel)
+	require.True(t, quotedGrouping)
+	require.True(t, utf8Metric)
+}
+
+func TestRegexPrefixAndSuffix(t *testing.T) {
+	require.Equal(t, `a\.`, regexPrefix("a.bc"))
+	require.Equal(t, `bc`, regexSuffix("a.bc"))
+	require.Equal(t, `日`, regexPrefix("日本語"))
+	require.Equal(t, `本語`, regexSuffix("日本語"))
+	require.Equal(t, ``, regexPrefix("x"))
+}
+
 func TestWalkHoltWinters(t *testing.T) {
 	rnd := rand.New(rand.NewSource(time.Now().Unix()))
 	opts := []Option{WithEnableOffset(true), WithEnableAtModifier(true)}
@@ -682,22 +946,25 @@ func TestGetOutputSeries(t *testing.T) {
 					},
 				},
 			},
-			expectedOutput: nil,
-			expectedStop:   true,
+			expectedOutput: []labels.Labels{
+				labels.FromStrings("foo", "bar", "job", "prometheus"),
+				labels.FromStrings("foo", "baz", "job", "prometheus"),
+			},
+			expectedStop: false,
 		},
 		{
 			expr: &parser.Call{
 				Func: parser.Functions["absent"],
 			},
-			expectedOutput: nil,
-			expectedStop:   true,
+			expectedOutput: []labels.Labels{labels.EmptyLabels()},
+			expectedStop:   false,
 		},
 		{
 			expr: &parser.Call{
 				Func: parser.Functions["absent_over_time"],
 			},
-			expectedOutput: nil,
-			expectedStop:   true,
+			expectedOutput: []labels.Labels{labels.EmptyLabels()},
+			expectedStop:   false,
 		},
 		{
 			expr: &parser.Call{
@@ -712,7 +979,7 @@ func TestGetOutputSeries(t *testing.T) {
 					},
 				},
 			},
-			expectedOutput: []labels.Labels{labels.FromStrings("__name__", "test", "job", "prometheus", "foo", "bar")},
+			expectedOutput: []labels.Labels{labels.FromStrings("job", "prometheus", "foo", "bar")},
 			expectedStop:   false,
 		},
 		{
@@ -813,3 +1080,112 @@ func TestWalkLabelReplace(t *testing.T) {
 		require.Equal(t, expr.Args[i].Type(), f.ArgTypes[i])
 	}
 }
+
+func TestWalkHistogramFunctions(t *testing.T) {
+	seriesSet := []labels.Labels{
+		labels.FromStrings(labels.MetricName, "http_request_duration_seconds_bucket", "job", "api", "le", "0.1"),
+		labels.FromStrings(labels.MetricName, "http_request_duration_seconds_bucket", "job", "api", "le", "1"),
+		labels.FromStrings(labels.MetricName, "http_request_duration_seconds_bucket", "job", "api", "le", "+Inf"),
+		labels.FromStrings(labels.MetricName, "http_request_duration_seconds_count", "job", "api"),
+		labels.FromStrings(labels.MetricName, "rpc_duration_seconds", "job", "api"),
+		labels.FromStrings(labels.MetricName, "up", "job", "api"),
+	}
+	for _, tc := range []struct {
+		name        string
+		sampleTypes map[string]SampleType
+		// Metric names allowed in the histogram argument per function.
+		expected map[string][]string
+	}{
+		{
+			name: "classic histograms only",
+			expected: map[string][]string{
+				"histogram_quantile": {"http_request_duration_seconds_bucket"},
+			},
+		},
+		{
+			name:        "classic and native histograms",
+			sampleTypes: map[string]SampleType{"rpc_duration_seconds": SampleTypeNativeHistogram},
+			expected: map[string][]string{
+				"histogram_quantile": {"http_request_duration_seconds_bucket", "rpc_duration_seconds"},
+				"histogram_fraction": {"rpc_duration_seconds"},
+				"histogram_count":    {"rpc_duration_seconds"},
+				"histogram_sum":      {"rpc_duration_seconds"},
+				"histogram_avg":      {"rpc_duration_seconds"},
+				"histogram_stddev":   {"rpc_duration_seconds"},
+				"histogram_stdvar":   {"rpc_duration_seconds"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(time.Now().Unix()))
+			p := New(rnd, seriesSet, WithEnableOffset(true), WithSeriesSampleTypes(tc.sampleTypes))
+			for name, metrics := range tc.expected {
+				f := parser.Functions[name]
+				for i := 0; i < 50; i++ {
+					call := &parser.Call{Func: f}
+					p.walkFunctions(call, 4)
+					for j, arg := range call.Args {
+						require.Equal(t, f.ArgTypes[j], arg.Type())
+					}
+					_, err := parser.ParseExpr(call.String())
+					require.NoError(t, err)
+
+					parser.Inspect(call.Args[histogramFuncArgs[name]], func(node parser.Node, _ []parser.Node) error {
+						vs, ok := node.(*parser.VectorSelector)
+						if !ok {
+							return nil
+						}
+						for _, m := range vs.LabelMatchers {
+							require.NotEqual(t, labels.BucketLabel, m.Name)
+							if m.Name == labels.MetricName {
+								require.Contains(t, metrics, m.Value, call.String())
+							}
+						}
+						return nil
+					})
+				}
+			}
+		})
+	}
+}
+
+func TestReturnsNoSeries(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	p := New(rnd, testSeriesSet)
+	for i, tc := range []struct {
+		query    string
+		expected bool
+	}{
+		{query: `up`},
+		{query: `not_exist`, expected: true},
+		{query: `up{job="not_exist"}`, expected: true},
+		{query: `sum by (job) (rate(not_exist[5m]))`, expected: true},
+		{query: `max_over_time(not_exist[5m:1m])`, expected: true},
+		{query: `-(not_exist)`, expected: true},
+		{query: `absent(not_exist)`},
+		{query: `absent_over_time(not_exist[5m])`},
+		{query: `scalar(not_exist)`},
+		{query: `vector(1)`},
+		{query: `histogram_quantile(0.9, not_exist)`, expected: true},
+		{query: `up or not_exist`},
+		{query: `not_exist or not_exist`, expected: true},
+		{query: `up unless not_exist`},
+		{query: `not_exist unless up`, expected: true},
+		{query: `up and not_exist`, expected: true},
+		{query: `up + not_exist`, expected: true},
+		{query: `1 + not_exist`, expected: true},
+		{query: `1 + up`},
+	} {
+		t.Run(fmt.Sprintf("test_case_%d", i), func(t *testing.T) {
+			expr, err := parser.ParseExpr(tc.query)
+			require.NoError(t, err)
+			parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+				if vs, ok := node.(*parser.VectorSelector); ok {
+					p.populateSeries(vs)
+				}
+				return nil
+			})
+			require.Equal(t, tc.expected, returnsNoSeries(expr))
+		})
+	}
+}